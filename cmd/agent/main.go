@@ -7,15 +7,32 @@ import (
 )
 
 func main() {
+	token := os.Getenv("AGENT_TOKEN")
+	tlsFiles := agent.TLSFiles{
+		CertFile: os.Getenv("AGENT_CERT_FILE"),
+		KeyFile:  os.Getenv("AGENT_KEY_FILE"),
+		CAFile:   os.Getenv("AGENT_CA_FILE"),
+	}
+
 	orchestratorAddress := os.Getenv("ORCHESTRATOR_ADDRESS")
 	if orchestratorAddress == "" {
+		// С TLS оркестратор отдает внутренний API только на INTERNAL_ADDRESS.
 		orchestratorAddress = "http://localhost:8080"
+		if tlsFiles != (agent.TLSFiles{}) {
+			orchestratorAddress = "https://localhost:8443"
+		}
 		log.Printf("ORCHESTRATOR_ADDRESS не установлен, используем значение по умолчанию: %s", orchestratorAddress)
 	}
+	if token == "" && tlsFiles.CertFile == "" {
+		log.Printf("Не заданы ни AGENT_TOKEN, ни AGENT_CERT_FILE, оркестратор отклонит запросы агента")
+	}
 
 	numWorkers := 5
 
-	agent := agent.NewAgent(numWorkers, orchestratorAddress)
+	agent, err := agent.NewAgent(numWorkers, orchestratorAddress, token, tlsFiles)
+	if err != nil {
+		log.Fatalf("Не удалось создать агента: %v", err)
+	}
 
 	agent.Start()
 
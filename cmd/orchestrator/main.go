@@ -3,10 +3,27 @@ package main
 import (
 	"distributed-calculator/internal/orchestrator"
 	"log"
+	"os"
 )
 
 func main() {
-	server, _ := orchestrator.NewServer()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := orchestrator.MigrateCommand(orchestrator.LoadConfig(), os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := orchestrator.CACommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	server, err := orchestrator.NewServer()
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 	log.Println("Orchestrator is starting...")
 	server.Start()
 }
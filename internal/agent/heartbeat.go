@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const defaultHeartbeatInterval = 5 * time.Second
+
+func (a *Agent) heartbeat() {
+	interval := a.registerUntilSuccess()
+
+	for {
+		time.Sleep(interval)
+
+		err := a.sendHeartbeat()
+		if err == errNotRegistered {
+			log.Printf("Orchestrator does not know agent %s, registering again", a.ID)
+			interval = a.registerUntilSuccess()
+			continue
+		}
+		if err != nil {
+			log.Printf("Heartbeat failed: %v", err)
+		}
+	}
+}
+
+func (a *Agent) registerUntilSuccess() time.Duration {
+	for {
+		interval, err := a.register()
+		if err == nil {
+			log.Printf("Agent %s registered, heartbeat every %v", a.ID, interval)
+			return interval
+		}
+		log.Printf("Registration failed: %v", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (a *Agent) register() (time.Duration, error) {
+	hostname, _ := os.Hostname()
+
+	payload := struct {
+		ID       string `json:"id"`
+		Hostname string `json:"hostname"`
+		Workers  int    `json:"workers"`
+		Version  string `json:"version"`
+	}{
+		ID:       a.ID,
+		Hostname: hostname,
+		Workers:  a.NumWorkers,
+		Version:  Version,
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("marshal failed: %w", err)
+	}
+
+	req, err := a.newRequest(http.MethodPost, "/internal/agents/register", bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("create request failed: %w", err)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return 0, fmt.Errorf("orchestrator rejected the agent token, check AGENT_TOKEN")
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return 0, fmt.Errorf("orchestrator rejected agent ID %s for this credential", a.ID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval_ms"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, fmt.Errorf("decode failed: %w", err)
+	}
+
+	if response.HeartbeatInterval <= 0 {
+		return defaultHeartbeatInterval, nil
+	}
+	return time.Duration(response.HeartbeatInterval) * time.Millisecond, nil
+}
+
+var errNotRegistered = fmt.Errorf("agent not registered")
+
+func (a *Agent) sendHeartbeat() error {
+	data, err := json.Marshal(map[string]string{"id": a.ID})
+	if err != nil {
+		return fmt.Errorf("marshal failed: %w", err)
+	}
+
+	req, err := a.newRequest(http.MethodPost, "/internal/agents/heartbeat", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create request failed: %w", err)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotRegistered
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response struct {
+		CancelledOperations []string `json:"cancelled_operations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("decode failed: %w", err)
+	}
+	a.cancelOperations(response.CancelledOperations)
+	return nil
+}
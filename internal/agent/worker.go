@@ -2,50 +2,163 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"distributed-calculator/internal/expr"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/Knetic/govaluate"
+	"github.com/google/uuid"
 )
 
 type Task struct {
-	ID         string  `json:"id"`
-	Expression string  `json:"expression"`
-	Status     string  `json:"status"`
-	Result     float64 `json:"result"`
-	UserLogin  string  `json:"user_login"`
-	CreatedAt  string  `json:"created_at"`
-	UpdatedAt  string  `json:"updated_at"`
+	ID            string  `json:"id"`
+	TaskID        string  `json:"task_id"`
+	Operand1      float64 `json:"operand1"`
+	Operand2      float64 `json:"operand2"`
+	Operator      string  `json:"operator"`
+	OperationTime int64   `json:"operation_time"`
+	Status        string  `json:"status"`
+	Result        float64 `json:"result"`
+	CreatedAt     string  `json:"created_at"`
+	UpdatedAt     string  `json:"updated_at"`
 }
 
+var Version = "dev"
+
+const (
+	StatusNew        = "New"
+	StatusInProgress = "In Progress"
+	StatusCompleted  = "Completed"
+	StatusFailed     = "Failed"
+)
+
 const (
-	StatusNew        = "new"
-	StatusInProgress = "in_progress"
-	StatusCompleted  = "completed"
-	StatusFailed     = "failed"
+	ErrorCodeDivisionByZero = "division_by_zero"
+	ErrorCodeInvalidOp      = "invalid_operation"
+	ErrorCodeUnknown        = "unknown"
 )
 
 type Agent struct {
+	ID                  string
 	NumWorkers          int
 	OrchestratorAddress string
 	HTTPClient          *http.Client
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+// TLSFiles are the PEM files an agent uses for mutual TLS with the
+// orchestrator: its own certificate and key and the CA bundle the
+// orchestrator's certificate is verified against.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
 }
 
-func NewAgent(numWorkers int, orchestratorAddress string) *Agent {
+// NewAgent creates an agent whose HTTPClient authenticates every request to
+// the orchestrator with token and, when tlsFiles are given, with a client
+// certificate.
+func NewAgent(numWorkers int, orchestratorAddress string, token string, tlsFiles TLSFiles) (*Agent, error) {
+	id := uuid.New().String()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsFiles != (TLSFiles{}) {
+		if !strings.HasPrefix(orchestratorAddress, "https://") {
+			return nil, fmt.Errorf("client certificate is set but orchestrator address %s is not https; the internal API is served over TLS on INTERNAL_ADDRESS", orchestratorAddress)
+		}
+		tlsConfig, err := loadTLSConfig(tlsFiles)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+
+		// The orchestrator knows an agent with a certificate by its common
+		// name.
+		certificate, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse agent certificate: %v", err)
+		}
+		if certificate.Subject.CommonName == "" {
+			return nil, fmt.Errorf("agent certificate has no common name")
+		}
+		id = certificate.Subject.CommonName
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if token != "" {
+		roundTripper = &tokenTransport{token: token, base: transport}
+	}
+
 	return &Agent{
+		ID:                  id,
 		NumWorkers:          numWorkers,
 		OrchestratorAddress: orchestratorAddress,
 		HTTPClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   30 * time.Second,
+			Transport: roundTripper,
 		},
+		running: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+func loadTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if files.CertFile == "" || files.KeyFile == "" || files.CAFile == "" {
+		return nil, fmt.Errorf("certificate, key and CA bundle must be set together")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load agent certificate: %v", err)
 	}
+	data, err := os.ReadFile(files.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", files.CAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      roots,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// tokenTransport adds the agent token to every request.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
 }
 
+var (
+	errCancelled = errors.New("task was cancelled")
+	errTransport = errors.New("request failed")
+)
+
+const reportAttempts = 3
+
 func (a *Agent) Start() {
+	go a.heartbeat()
+
 	for i := 0; i < a.NumWorkers; i++ {
 		go a.worker()
 	}
@@ -65,17 +178,85 @@ func (a *Agent) worker() {
 			continue
 		}
 
-		result, err := a.calculate(task.Expression)
-		if err != nil {
-			log.Printf("Calculation failed: %v", err)
-			if err := a.saveTaskResult(task, 0, StatusFailed, err.Error()); err != nil {
-				log.Printf("Failed to save failed task: %v", err)
-			}
-			continue
+		a.process(task)
+	}
+}
+
+// process computes one operation. The orchestrator may cancel the task while
+// the operation is running; the work is then dropped without a report.
+func (a *Agent) process(task *Task) {
+	ctx, cancel := a.track(task.ID)
+	defer cancel()
+
+	if task.OperationTime > 0 {
+		select {
+		case <-time.After(time.Duration(task.OperationTime) * time.Millisecond):
+		case <-ctx.Done():
+			log.Printf("Operation %s was cancelled, dropping it", task.ID)
+			return
 		}
+	}
 
-		if err := a.saveTaskResult(task, result, StatusCompleted, ""); err != nil {
-			log.Printf("Failed to save completed task: %v", err)
+	result, err := a.calculate(task)
+	status, code, errorMsg := StatusCompleted, "", ""
+	if err != nil {
+		log.Printf("Calculation failed: %v", err)
+		status, code, errorMsg = StatusFailed, errorCode(err), err.Error()
+	}
+	if ctx.Err() != nil {
+		log.Printf("Operation %s was cancelled, dropping it", task.ID)
+		return
+	}
+
+	err = a.reportResult(task, result, status, code, errorMsg)
+	if err == errCancelled {
+		log.Printf("Operation %s was cancelled, result dropped", task.ID)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save %s task: %v", status, err)
+	}
+}
+
+// reportResult retries a report that did not reach the orchestrator, so a
+// dropped connection does not throw away a computed result.
+func (a *Agent) reportResult(task *Task, result float64, status string, code string, errorMsg string) error {
+	var err error
+	for attempt := 0; attempt < reportAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		err = a.saveTaskResult(task, result, status, code, errorMsg)
+		if !errors.Is(err, errTransport) {
+			return err
+		}
+		log.Printf("Reporting operation %s failed, retrying: %v", task.ID, err)
+	}
+	return err
+}
+
+func (a *Agent) track(id string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a.mu.Lock()
+	a.running[id] = cancel
+	a.mu.Unlock()
+
+	return ctx, func() {
+		a.mu.Lock()
+		delete(a.running, id)
+		a.mu.Unlock()
+		cancel()
+	}
+}
+
+func (a *Agent) cancelOperations(ids []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, id := range ids {
+		if cancel, ok := a.running[id]; ok {
+			cancel()
 		}
 	}
 }
@@ -94,15 +275,10 @@ func (a *Agent) saveCompletedTask(task *Task, result float64) error {
 		return fmt.Errorf("marshal failed: %w", err)
 	}
 
-	req, err := http.NewRequest(
-		"PUT",
-		a.OrchestratorAddress+"/internal/task",
-		bytes.NewReader(data),
-	)
+	req, err := a.newRequest(http.MethodPut, "/internal/task", bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("create request failed: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
@@ -110,6 +286,9 @@ func (a *Agent) saveCompletedTask(task *Task, result float64) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return errCancelled
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
@@ -133,11 +312,12 @@ func (a *Agent) saveFailedTask(task *Task, errorMsg string) error {
 		return fmt.Errorf("marshal failed: %w", err)
 	}
 
-	resp, err := a.HTTPClient.Post(
-		a.OrchestratorAddress+"/internal/task/fail",
-		"application/json",
-		bytes.NewReader(data),
-	)
+	req, err := a.newRequest(http.MethodPost, "/internal/task/fail", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create request failed: %w", err)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -150,7 +330,12 @@ func (a *Agent) saveFailedTask(task *Task, errorMsg string) error {
 }
 
 func (a *Agent) getTask() (*Task, error) {
-	resp, err := a.HTTPClient.Get(a.OrchestratorAddress + "/internal/task")
+	req, err := a.newRequest(http.MethodGet, "/internal/task", nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %w", err)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -188,11 +373,12 @@ func (a *Agent) updateTaskStatus(taskID, status string) error {
 		return fmt.Errorf("marshal failed: %w", err)
 	}
 
-	resp, err := a.HTTPClient.Post(
-		a.OrchestratorAddress+"/internal/task/status",
-		"application/json",
-		bytes.NewReader(data),
-	)
+	req, err := a.newRequest(http.MethodPost, "/internal/task/status", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create request failed: %w", err)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -219,11 +405,12 @@ func (a *Agent) sendResult(taskID string, result float64) error {
 		return fmt.Errorf("marshal failed: %w", err)
 	}
 
-	resp, err := a.HTTPClient.Post(
-		a.OrchestratorAddress+"/internal/task/result",
-		"application/json",
-		bytes.NewReader(data),
-	)
+	req, err := a.newRequest(http.MethodPost, "/internal/task/result", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create request failed: %w", err)
+	}
+
+	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -236,38 +423,46 @@ func (a *Agent) sendResult(taskID string, result float64) error {
 	return nil
 }
 
-func (a *Agent) calculate(expression string) (float64, error) {
-	expr, err := govaluate.NewEvaluableExpression(expression)
+func (a *Agent) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, a.OrchestratorAddress+path, body)
 	if err != nil {
-		return 0, fmt.Errorf("expression parse failed: %w", err)
+		return nil, err
 	}
-
-	result, err := expr.Evaluate(nil)
-	if err != nil {
-		return 0, fmt.Errorf("evaluation failed: %w", err)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
+	req.Header.Set("X-Agent-ID", a.ID)
+	return req, nil
+}
+
+func (a *Agent) calculate(task *Task) (float64, error) {
+	return expr.Apply(task.Operator, task.Operand1, task.Operand2)
+}
 
-	switch v := result.(type) {
-	case float64:
-		return v, nil
-	case int:
-		return float64(v), nil
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, expr.ErrDivisionByZero):
+		return ErrorCodeDivisionByZero
+	case errors.Is(err, expr.ErrUnsupportedOperator):
+		return ErrorCodeInvalidOp
 	default:
-		return 0, fmt.Errorf("unexpected result type: %T", result)
+		return ErrorCodeUnknown
 	}
 }
 
-func (a *Agent) saveTaskResult(task *Task, result float64, status string, errorMsg string) error {
+func (a *Agent) saveTaskResult(task *Task, result float64, status string, code string, errorMsg string) error {
 	payload := struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result,omitempty"`
-		Status string  `json:"status"`
-		Error  string  `json:"error,omitempty"`
+		ID        string  `json:"id"`
+		Result    float64 `json:"result,omitempty"`
+		Status    string  `json:"status"`
+		Error     string  `json:"error,omitempty"`
+		ErrorCode string  `json:"error_code,omitempty"`
 	}{
-		ID:     task.ID,
-		Result: result,
-		Status: status,
-		Error:  errorMsg,
+		ID:        task.ID,
+		Result:    result,
+		Status:    status,
+		Error:     errorMsg,
+		ErrorCode: code,
 	}
 
 	data, err := json.Marshal(payload)
@@ -275,22 +470,20 @@ func (a *Agent) saveTaskResult(task *Task, result float64, status string, errorM
 		return fmt.Errorf("marshal failed: %w", err)
 	}
 
-	req, err := http.NewRequest(
-		"PUT",
-		a.OrchestratorAddress+"/internal/task",
-		bytes.NewReader(data),
-	)
+	req, err := a.newRequest(http.MethodPut, "/internal/task", bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("create request failed: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("request failed: %w", err)
+		return fmt.Errorf("%w: %v", errTransport, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return errCancelled
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
@@ -0,0 +1,49 @@
+package expr
+
+const (
+	OpAdd = "+"
+	OpSub = "-"
+	OpMul = "*"
+	OpDiv = "/"
+	OpMod = "%"
+	OpPow = "^"
+)
+
+type Node interface {
+	Pos() Position
+}
+
+type Number struct {
+	Value    float64
+	Position Position
+}
+
+type Variable struct {
+	Name     string
+	Position Position
+}
+
+// Reference is the result of another task, written as $<id> or ans(<id>).
+type Reference struct {
+	TaskID   string
+	Position Position
+}
+
+type Unary struct {
+	Op       string
+	Operand  Node
+	Position Position
+}
+
+type Binary struct {
+	Op       string
+	Left     Node
+	Right    Node
+	Position Position
+}
+
+func (n *Number) Pos() Position    { return n.Position }
+func (n *Variable) Pos() Position  { return n.Position }
+func (n *Reference) Pos() Position { return n.Position }
+func (n *Unary) Pos() Position     { return n.Position }
+func (n *Binary) Pos() Position    { return n.Position }
@@ -0,0 +1,37 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error describes a syntax error together with the place in the source where
+// it was found.
+type Error struct {
+	Pos     Position
+	Message string
+	Snippet string
+}
+
+func newError(src string, pos Position, message string) *Error {
+	return &Error{
+		Pos:     pos,
+		Message: message,
+		Snippet: snippet(src, pos),
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s\n%s", e.Pos.Line, e.Pos.Column, e.Message, e.Snippet)
+}
+
+func snippet(src string, pos Position) string {
+	lines := strings.Split(src, "\n")
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return ""
+	}
+
+	line := strings.TrimRight(lines[pos.Line-1], "\r")
+	caret := strings.Repeat(" ", pos.Column-1) + "^"
+	return line + "\n" + caret
+}
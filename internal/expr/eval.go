@@ -0,0 +1,73 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrDivisionByZero      = errors.New("division by zero")
+	ErrUnsupportedOperator = errors.New("unsupported operator")
+)
+
+// Apply computes a single binary operation. Agents use it to evaluate the
+// operations the orchestrator hands out, so both sides share one set of
+// operator semantics.
+func Apply(op string, a, b float64) (float64, error) {
+	switch op {
+	case OpAdd:
+		return a + b, nil
+	case OpSub:
+		return a - b, nil
+	case OpMul:
+		return a * b, nil
+	case OpDiv:
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return a / b, nil
+	case OpMod:
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Mod(a, b), nil
+	case OpPow, "**":
+		return math.Pow(a, b), nil
+	default:
+		return 0, fmt.Errorf("%w %q", ErrUnsupportedOperator, op)
+	}
+}
+
+// Eval evaluates the whole tree locally.
+func Eval(node Node) (float64, error) {
+	switch n := node.(type) {
+	case *Number:
+		return n.Value, nil
+	case *Variable:
+		return 0, fmt.Errorf("variable %q has no value", n.Name)
+	case *Reference:
+		return 0, fmt.Errorf("reference to task %q has no value", n.TaskID)
+	case *Unary:
+		value, err := Eval(n.Operand)
+		if err != nil {
+			return 0, err
+		}
+		if n.Op == OpSub {
+			return -value, nil
+		}
+		return value, nil
+	case *Binary:
+		left, err := Eval(n.Left)
+		if err != nil {
+			return 0, err
+		}
+		right, err := Eval(n.Right)
+		if err != nil {
+			return 0, err
+		}
+		return Apply(n.Op, left, right)
+	default:
+		return 0, fmt.Errorf("unsupported node %T", node)
+	}
+}
@@ -0,0 +1,133 @@
+package expr
+
+import "fmt"
+
+var binaryPrecedence = map[string]int{
+	OpAdd: 1,
+	OpSub: 1,
+	OpMul: 2,
+	OpDiv: 2,
+	OpMod: 2,
+	OpPow: 4,
+}
+
+const prefixPrecedence = 3
+
+type parser struct {
+	src    string
+	tokens []Token
+	pos    int
+}
+
+// Parse builds the syntax tree of an arithmetic expression. Supported are
+// numbers, variables, references to the results of other tasks ($<id> or
+// ans(<id>)), parentheses, unary minus and plus, and the binary
+// operators + - * / % and ^ (also written as **).
+func Parse(src string) (Node, error) {
+	tokens, err := Tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{src: src, tokens: tokens}
+	if p.peek().Kind == TokenEOF {
+		return nil, p.errorf(p.peek(), "empty expression")
+	}
+
+	node, err := p.parseExpression(0)
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.Kind != TokenEOF {
+		return nil, p.errorf(token, "unexpected %s", describe(token))
+	}
+	return node, nil
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() Token {
+	token := p.tokens[p.pos]
+	if token.Kind != TokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *parser) parseExpression(minPrecedence int) (Node, error) {
+	left, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if token.Kind != TokenOperator {
+			return left, nil
+		}
+
+		precedence := binaryPrecedence[token.Text]
+		if precedence < minPrecedence {
+			return left, nil
+		}
+		p.next()
+
+		next := precedence + 1
+		if token.Text == OpPow {
+			next = precedence
+		}
+		right, err := p.parseExpression(next)
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: token.Text, Left: left, Right: right, Position: token.Pos}
+	}
+}
+
+func (p *parser) parsePrefix() (Node, error) {
+	token := p.next()
+
+	switch token.Kind {
+	case TokenNumber:
+		return &Number{Value: token.Value, Position: token.Pos}, nil
+	case TokenIdent:
+		return &Variable{Name: token.Text, Position: token.Pos}, nil
+	case TokenReference:
+		return &Reference{TaskID: token.Text, Position: token.Pos}, nil
+	case TokenOperator:
+		if token.Text != OpAdd && token.Text != OpSub {
+			return nil, p.errorf(token, "unexpected %s", describe(token))
+		}
+		operand, err := p.parseExpression(prefixPrecedence)
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: token.Text, Operand: operand, Position: token.Pos}, nil
+	case TokenLParen:
+		node, err := p.parseExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing.Kind != TokenRParen {
+			return nil, p.errorf(closing, "expected ')' to close '(' at line %d, column %d, found %s",
+				token.Pos.Line, token.Pos.Column, describe(closing))
+		}
+		p.next()
+		return node, nil
+	default:
+		return nil, p.errorf(token, "unexpected %s", describe(token))
+	}
+}
+
+func (p *parser) errorf(token Token, format string, args ...interface{}) error {
+	return newError(p.src, token.Pos, fmt.Sprintf(format, args...))
+}
+
+func describe(token Token) string {
+	if token.Kind == TokenEOF {
+		return token.Kind.String()
+	}
+	return fmt.Sprintf("%s %q", token.Kind, token.Text)
+}
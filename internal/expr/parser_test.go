@@ -0,0 +1,137 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAndEval(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{"2+2*2", 6},
+		{"(2+2)*2", 8},
+		{"-(3+4)*2", -14},
+		{"2^3^2", 512},
+		{"2**3", 8},
+		{"-2^2", -4},
+		{"7 % 4", 3},
+		{"1.5e2 / 3", 50},
+		{" 1 +\n 2 ", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			node, err := Parse(tt.expression)
+			require.NoError(t, err)
+
+			got, err := Eval(node)
+			require.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-9)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		line       int
+		column     int
+		snippet    string
+	}{
+		{"empty", "   ", 1, 4, "   \n   ^"},
+		{"trailing operator", "1 +", 1, 4, "1 +\n   ^"},
+		{"unclosed paren", "(1 + 2", 1, 7, "(1 + 2\n      ^"},
+		{"string literal", "1 + \"a\"", 1, 5, "1 + \"a\"\n    ^"},
+		{"boolean operator", "1 && 2", 1, 3, "1 && 2\n  ^"},
+		{"second line", "1 +\n2 )", 2, 3, "2 )\n  ^"},
+		{"empty reference", "$ * 2", 1, 1, "$ * 2\n^"},
+		{"unclosed ans", "ans(abc * 2", 1, 9, "ans(abc * 2\n        ^"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.expression)
+			require.Error(t, err)
+
+			var exprErr *Error
+			require.ErrorAs(t, err, &exprErr)
+			assert.Equal(t, tt.line, exprErr.Pos.Line)
+			assert.Equal(t, tt.column, exprErr.Pos.Column)
+			assert.Equal(t, tt.snippet, exprErr.Snippet)
+		})
+	}
+}
+
+func TestApplyDivisionByZero(t *testing.T) {
+	_, err := Apply(OpDiv, 1, 0)
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+
+	_, err = Apply(OpMod, 1, 0)
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+}
+
+func TestBindVariables(t *testing.T) {
+	src := "rate * (base + rate) - other"
+	node, err := Parse(src)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rate", "base", "other"}, Variables(node))
+
+	_, err = Bind(src, node, map[string]float64{"rate": 2, "base": 3})
+	var exprErr *Error
+	require.ErrorAs(t, err, &exprErr)
+	assert.Equal(t, `unknown variable "other"`, exprErr.Message)
+	assert.Equal(t, 24, exprErr.Pos.Column)
+
+	bound, err := Bind(src, node, map[string]float64{"rate": 2, "base": 3, "other": 1})
+	require.NoError(t, err)
+	assert.Empty(t, Variables(bound))
+	got, err := Eval(bound)
+	require.NoError(t, err)
+	assert.Equal(t, float64(9), got)
+
+	assert.True(t, IsIdentifier("_rate2"))
+	assert.False(t, IsIdentifier("2rate"))
+	assert.False(t, IsIdentifier("rate-2"))
+}
+
+func TestParseReferences(t *testing.T) {
+	id := "3f2a9c1e-7b44-4d0e-9a51-2c8e6f1d0b77"
+	node, err := Parse("$" + id + " * 2 + ans( q1 ) - ans(" + id + ")")
+	require.NoError(t, err)
+	assert.Equal(t, []string{id, "q1"}, References(node))
+
+	node, err = Parse("ans")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ans"}, Variables(node), "ans without parentheses is a variable")
+	assert.Empty(t, References(node))
+}
+
+func TestParseReferenceFollowedByMinus(t *testing.T) {
+	id := "3f2a9c1e-7b44-4d0e-9a51-2c8e6f1d0b77"
+	tests := []struct {
+		expression string
+		reference  string
+	}{
+		{"$" + id + "-1", id},
+		{"ans(" + id + ")-1", id},
+		{"$q1-1", "q1"},
+		{"$" + id + "-$q1", id},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			node, err := Parse(tt.expression)
+			require.NoError(t, err)
+
+			binary, ok := node.(*Binary)
+			require.True(t, ok, "expected a subtraction, got %T", node)
+			assert.Equal(t, OpSub, binary.Op)
+			assert.Equal(t, &Reference{TaskID: tt.reference, Position: Position{Offset: 0, Line: 1, Column: 1}}, binary.Left)
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenNumber
+	TokenOperator
+	TokenLParen
+	TokenRParen
+	TokenIdent
+	TokenReference
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenEOF:
+		return "end of expression"
+	case TokenNumber:
+		return "number"
+	case TokenOperator:
+		return "operator"
+	case TokenLParen:
+		return "'('"
+	case TokenRParen:
+		return "')'"
+	case TokenIdent:
+		return "identifier"
+	case TokenReference:
+		return "reference"
+	default:
+		return fmt.Sprintf("token(%d)", int(k))
+	}
+}
+
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+type Token struct {
+	Kind  TokenKind
+	Text  string
+	Value float64
+	Pos   Position
+}
+
+type lexer struct {
+	src    string
+	offset int
+	line   int
+	column int
+}
+
+// Tokenize splits src into tokens. The returned slice always ends with a
+// TokenEOF token.
+func Tokenize(src string) ([]Token, error) {
+	l := &lexer{src: src, line: 1, column: 1}
+
+	var tokens []Token
+	for {
+		token, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+		if token.Kind == TokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) pos() Position {
+	return Position{Offset: l.offset, Line: l.line, Column: l.column}
+}
+
+func (l *lexer) advance(n int) {
+	for i := 0; i < n; i++ {
+		if l.src[l.offset] == '\n' {
+			l.line++
+			l.column = 1
+		} else {
+			l.column++
+		}
+		l.offset++
+	}
+}
+
+func (l *lexer) next() (Token, error) {
+	l.skipSpaces()
+
+	start := l.pos()
+	if l.offset >= len(l.src) {
+		return Token{Kind: TokenEOF, Pos: start}, nil
+	}
+
+	c := l.src[l.offset]
+	switch {
+	case isDigit(c) || c == '.':
+		return l.number()
+	case isIdentStart(c):
+		end := l.offset
+		for end < len(l.src) && (isIdentStart(l.src[end]) || isDigit(l.src[end])) {
+			end++
+		}
+		text := l.src[l.offset:end]
+		l.advance(end - l.offset)
+		if text == "ans" && l.peekPastSpaces() == '(' {
+			return l.ansReference(start)
+		}
+		return Token{Kind: TokenIdent, Text: text, Pos: start}, nil
+	case c == '$':
+		l.advance(1)
+		id := l.referenceID()
+		if id == "" {
+			return Token{}, l.errorf(start, "expected a task ID after '$'")
+		}
+		return Token{Kind: TokenReference, Text: id, Pos: start}, nil
+	case c == '(':
+		l.advance(1)
+		return Token{Kind: TokenLParen, Text: "(", Pos: start}, nil
+	case c == ')':
+		l.advance(1)
+		return Token{Kind: TokenRParen, Text: ")", Pos: start}, nil
+	case c == '*' && l.peek(1) == '*':
+		l.advance(2)
+		return Token{Kind: TokenOperator, Text: OpPow, Pos: start}, nil
+	case c == '+' || c == '-' || c == '*' || c == '/' || c == '%' || c == '^':
+		l.advance(1)
+		return Token{Kind: TokenOperator, Text: string(c), Pos: start}, nil
+	case c == '"' || c == '\'':
+		return Token{}, l.errorf(start, "string literals are not supported")
+	}
+
+	return Token{}, l.errorf(start, "unexpected character %q", rune(c))
+}
+
+func (l *lexer) number() (Token, error) {
+	start := l.pos()
+	end := l.offset
+
+	digits := 0
+	for end < len(l.src) && isDigit(l.src[end]) {
+		end++
+		digits++
+	}
+	if end < len(l.src) && l.src[end] == '.' {
+		end++
+		for end < len(l.src) && isDigit(l.src[end]) {
+			end++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return Token{}, l.errorf(start, "malformed number")
+	}
+	if end < len(l.src) && (l.src[end] == 'e' || l.src[end] == 'E') {
+		exp := end + 1
+		if exp < len(l.src) && (l.src[exp] == '+' || l.src[exp] == '-') {
+			exp++
+		}
+		if exp < len(l.src) && isDigit(l.src[exp]) {
+			for exp < len(l.src) && isDigit(l.src[exp]) {
+				exp++
+			}
+			end = exp
+		}
+	}
+
+	text := l.src[l.offset:end]
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Token{}, l.errorf(start, "malformed number %q", text)
+	}
+
+	l.advance(end - l.offset)
+	return Token{Kind: TokenNumber, Text: text, Value: value, Pos: start}, nil
+}
+
+// ansReference lexes the "(<id>)" that follows ans.
+func (l *lexer) ansReference(start Position) (Token, error) {
+	l.skipSpaces()
+	l.advance(1)
+	l.skipSpaces()
+	id := l.referenceID()
+	if id == "" {
+		return Token{}, l.errorf(l.pos(), "expected a task ID in ans(...)")
+	}
+	l.skipSpaces()
+	if l.peek(0) != ')' {
+		return Token{}, l.errorf(l.pos(), "expected ')' to close ans(")
+	}
+	l.advance(1)
+	return Token{Kind: TokenReference, Text: id, Pos: start}, nil
+}
+
+// referenceID lexes the ID of a referenced task: a UUID or a batch label,
+// which is made of letters, digits and '_'. A '-' after the ID is an
+// operator, so $<id>-1 subtracts one.
+func (l *lexer) referenceID() string {
+	rest := l.src[l.offset:]
+	n := uuidLength(rest)
+	if n == 0 {
+		for n < len(rest) && (isIdentStart(rest[n]) || isDigit(rest[n])) {
+			n++
+		}
+	}
+	l.advance(n)
+	return rest[:n]
+}
+
+func (l *lexer) skipSpaces() {
+	for l.offset < len(l.src) && isSpace(l.src[l.offset]) {
+		l.advance(1)
+	}
+}
+
+func (l *lexer) peekPastSpaces() byte {
+	for i := l.offset; i < len(l.src); i++ {
+		if !isSpace(l.src[i]) {
+			return l.src[i]
+		}
+	}
+	return 0
+}
+
+func (l *lexer) peek(n int) byte {
+	if l.offset+n < len(l.src) {
+		return l.src[l.offset+n]
+	}
+	return 0
+}
+
+func (l *lexer) errorf(pos Position, format string, args ...interface{}) error {
+	return newError(l.src, pos, fmt.Sprintf(format, args...))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// uuidLength returns the length of the UUID in the 8-4-4-4-12 form that s
+// starts with, or 0 if it does not start with one.
+func uuidLength(s string) int {
+	const length = 36
+	if len(s) < length {
+		return 0
+	}
+	for i := 0; i < length; i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return 0
+			}
+		default:
+			if !isHexDigit(s[i]) {
+				return 0
+			}
+		}
+	}
+	return length
+}
+
+// IsIdentifier reports whether name can be used as a variable name.
+func IsIdentifier(name string) bool {
+	if name == "" || !isIdentStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isIdentStart(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
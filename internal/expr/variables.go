@@ -0,0 +1,85 @@
+package expr
+
+import "fmt"
+
+// Variables returns the names of the variables used in the tree, each once,
+// in the order they appear.
+func Variables(node Node) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	var walk func(Node)
+	walk = func(node Node) {
+		switch n := node.(type) {
+		case *Variable:
+			if !seen[n.Name] {
+				seen[n.Name] = true
+				names = append(names, n.Name)
+			}
+		case *Unary:
+			walk(n.Operand)
+		case *Binary:
+			walk(n.Left)
+			walk(n.Right)
+		}
+	}
+	walk(node)
+	return names
+}
+
+// References returns the IDs of the tasks the tree refers to, each once, in
+// the order they appear.
+func References(node Node) []string {
+	var ids []string
+	seen := make(map[string]bool)
+
+	var walk func(Node)
+	walk = func(node Node) {
+		switch n := node.(type) {
+		case *Reference:
+			if !seen[n.TaskID] {
+				seen[n.TaskID] = true
+				ids = append(ids, n.TaskID)
+			}
+		case *Unary:
+			walk(n.Operand)
+		case *Binary:
+			walk(n.Left)
+			walk(n.Right)
+		}
+	}
+	walk(node)
+	return ids
+}
+
+// Bind replaces every variable in the tree with its value. src is the
+// expression the tree was parsed from and is used to point at a variable
+// that has no value.
+func Bind(src string, node Node, values map[string]float64) (Node, error) {
+	switch n := node.(type) {
+	case *Variable:
+		value, ok := values[n.Name]
+		if !ok {
+			return nil, newError(src, n.Position, fmt.Sprintf("unknown variable %q", n.Name))
+		}
+		return &Number{Value: value, Position: n.Position}, nil
+	case *Unary:
+		operand, err := Bind(src, n.Operand, values)
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: n.Op, Operand: operand, Position: n.Position}, nil
+	case *Binary:
+		left, err := Bind(src, n.Left, values)
+		if err != nil {
+			return nil, err
+		}
+		right, err := Bind(src, n.Right, values)
+		if err != nil {
+			return nil, err
+		}
+		return &Binary{Op: n.Op, Left: left, Right: right, Position: n.Position}, nil
+	default:
+		return node, nil
+	}
+}
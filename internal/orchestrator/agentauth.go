@@ -0,0 +1,252 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrAgentCredentialNotFound = errors.New("agent credential not found")
+
+// AgentCredential is a token that agents present on the /internal endpoints.
+// The token itself is shown once when it is issued; only its hash is stored.
+type AgentCredential struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+}
+
+type AgentCredentialStore interface {
+	CreateAgentCredential(credential *AgentCredential, tokenHash string) error
+	ListAgentCredentials() ([]*AgentCredential, error)
+	// GetAgentCredentialByToken returns nil if no credential has the hash.
+	GetAgentCredentialByToken(tokenHash string) (*AgentCredential, error)
+	RevokeAgentCredential(id string, revokedAt string) error
+}
+
+const staticAgentCredential = "AGENT_TOKEN"
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// agentCredential authenticates the agent behind r. It accepts a verified
+// client certificate, the token shared through AGENT_TOKEN and issued tokens
+// that have not been revoked, and returns the name of the credential that
+// matched. For certificates the name is the certificate's common name.
+func (s *Server) agentCredential(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if commonName == "" {
+			return "", fmt.Errorf("agent certificate has no common name")
+		}
+		return commonName, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if header == "" || token == header {
+		return "", fmt.Errorf("agent token missing")
+	}
+
+	if s.config.AgentToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AgentToken)) == 1 {
+		return staticAgentCredential, nil
+	}
+
+	credential, err := s.agentCredentials.GetAgentCredentialByToken(hashToken(token))
+	if err != nil {
+		return "", err
+	}
+	if credential == nil || credential.RevokedAt != "" {
+		return "", fmt.Errorf("invalid agent token")
+	}
+	return credential.Name, nil
+}
+
+// agentIdentity is the authenticated agent behind a request to the internal
+// API.
+type agentIdentity struct {
+	// Credential is the name of the credential the agent authenticated with.
+	Credential string
+	// ID is what leases and heartbeats are recorded under. A certificate
+	// stands for exactly one agent, so its common name is the ID. Agents
+	// sharing a token are told apart by their X-Agent-ID within that
+	// credential, so no agent can act under another credential.
+	ID string
+	// Name is the ID the agent calls itself.
+	Name string
+}
+
+type agentContextKey struct{}
+
+// newAgentIdentity keeps "/" out of certificate names and X-Agent-ID, and
+// issued credential names cannot contain it either, so an ID always splits
+// back into one credential and one name.
+func newAgentIdentity(r *http.Request, credential string) (agentIdentity, error) {
+	name := r.Header.Get("X-Agent-ID")
+	if strings.Contains(name, "/") {
+		return agentIdentity{}, fmt.Errorf("agent ID %s cannot contain /", name)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if strings.Contains(credential, "/") {
+			return agentIdentity{}, fmt.Errorf("agent certificate name %s cannot contain /", credential)
+		}
+		if name != "" && name != credential {
+			return agentIdentity{}, fmt.Errorf("agent ID %s does not match the certificate of %s", name, credential)
+		}
+		return agentIdentity{Credential: credential, ID: credential, Name: credential}, nil
+	}
+	if name == "" {
+		return agentIdentity{}, fmt.Errorf("X-Agent-ID header is required")
+	}
+	return agentIdentity{Credential: credential, ID: credential + "/" + name, Name: name}, nil
+}
+
+// agentFromRequest returns the agent that agentMiddleware authenticated.
+func agentFromRequest(r *http.Request) agentIdentity {
+	identity, _ := r.Context().Value(agentContextKey{}).(agentIdentity)
+	return identity
+}
+
+func agentID(r *http.Request) string {
+	return agentFromRequest(r).ID
+}
+
+func (s *Server) agentMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credential, err := s.agentCredential(r)
+		if err != nil {
+			http.Error(w, "Invalid agent token", http.StatusUnauthorized)
+			return
+		}
+		identity, err := newAgentIdentity(r, credential)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), agentContextKey{}, identity)))
+	}
+}
+
+func (s *Server) handleAgentCredentials(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		credentials, err := s.agentCredentials.ListAgentCredentials()
+		if err != nil {
+			log.Printf("Failed to list agent credentials: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if credentials == nil {
+			credentials = []*AgentCredential{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*AgentCredential{"credentials": credentials})
+	case http.MethodPost:
+		s.issueAgentCredential(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) issueAgentCredential(w http.ResponseWriter, r *http.Request) {
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Credential name is required", http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(req.Name, "/") || req.Name == staticAgentCredential {
+		http.Error(w, fmt.Sprintf("Credential name cannot contain / or be %s", staticAgentCredential), http.StatusBadRequest)
+		return
+	}
+	existing, err := s.agentCredentials.ListAgentCredentials()
+	if err != nil {
+		log.Printf("Failed to list agent credentials: %v", err)
+		http.Error(w, "Failed to create credential", http.StatusInternalServerError)
+		return
+	}
+	for _, credential := range existing {
+		if credential.Name == req.Name && credential.RevokedAt == "" {
+			http.Error(w, fmt.Sprintf("Credential %s already exists", req.Name), http.StatusConflict)
+			return
+		}
+	}
+
+	token, err := generateSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	credential := &AgentCredential{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		CreatedBy: userLogin,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := s.agentCredentials.CreateAgentCredential(credential, hashToken(token)); err != nil {
+		log.Printf("Failed to create agent credential: %v", err)
+		http.Error(w, "Failed to create credential", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Agent credential %s (%s) issued by %s", credential.ID, credential.Name, userLogin)
+
+	response := struct {
+		*AgentCredential
+		Token string `json:"token"`
+	}{
+		AgentCredential: credential,
+		Token:           token,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleAgentCredential(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/agent-credentials/")
+	err := s.agentCredentials.RevokeAgentCredential(id, time.Now().UTC().Format(time.RFC3339))
+	if err == ErrAgentCredentialNotFound {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke agent credential %s: %v", id, err)
+		http.Error(w, "Failed to revoke credential", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Agent credential %s revoked", id)
+	w.WriteHeader(http.StatusNoContent)
+}
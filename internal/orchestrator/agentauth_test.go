@@ -0,0 +1,156 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withAgentToken(token string) func(*Config) {
+	return func(config *Config) {
+		config.AgentToken = token
+	}
+}
+
+func agentRequest(handler http.HandlerFunc, token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/internal/task", nil)
+	r.Header.Set("X-Agent-ID", "agent-1")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestInternalRoutesRequireAgentToken(t *testing.T) {
+	server := newServer(t, withAdmins("root"), withAgentToken("shared-token"))
+
+	admin := registerAndLogin(t, server, "root")
+	user := registerAndLogin(t, server, "alice")
+	handler := server.agentMiddleware(server.handleTask)
+
+	assert.Equal(t, http.StatusUnauthorized, agentRequest(handler, ""))
+	assert.Equal(t, http.StatusUnauthorized, agentRequest(handler, "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, agentRequest(handler, user), "user tokens are not agent tokens")
+	assert.Equal(t, http.StatusNotFound, agentRequest(handler, "shared-token"))
+
+	issue := server.requireRole(RoleAdmin, server.handleAgentCredentials)
+	w := authorizedRequest(t, issue, http.MethodPost, "/api/v1/admin/agent-credentials", user, map[string]string{"name": "rack-1"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = authorizedRequest(t, issue, http.MethodPost, "/api/v1/admin/agent-credentials", admin, map[string]string{"name": "rack-1"})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var issued struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&issued))
+	assert.Equal(t, "rack-1", issued.Name)
+	require.NotEmpty(t, issued.Token)
+	assert.Equal(t, http.StatusNotFound, agentRequest(handler, issued.Token))
+
+	for name, code := range map[string]int{"rack-1": http.StatusConflict, "rack/1": http.StatusBadRequest, staticAgentCredential: http.StatusBadRequest} {
+		w = authorizedRequest(t, issue, http.MethodPost, "/api/v1/admin/agent-credentials", admin, map[string]string{"name": name})
+		assert.Equal(t, code, w.Code, name)
+	}
+
+	w = authorizedRequest(t, issue, http.MethodGet, "/api/v1/admin/agent-credentials", admin, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), issued.Token)
+
+	revoke := server.requireRole(RoleAdmin, server.handleAgentCredential)
+	w = authorizedRequest(t, revoke, http.MethodDelete, "/api/v1/admin/agent-credentials/"+issued.ID, admin, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = authorizedRequest(t, revoke, http.MethodDelete, "/api/v1/admin/agent-credentials/missing", admin, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, agentRequest(handler, issued.Token))
+	assert.Equal(t, http.StatusNotFound, agentRequest(handler, "shared-token"))
+}
+
+func TestAgentIDIsScopedToCredential(t *testing.T) {
+	server := newServer(t, withAgentToken("shared-token"))
+
+	call := func(handler http.HandlerFunc, agent string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/internal/agents/register", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer shared-token")
+		if agent != "" {
+			r.Header.Set("X-Agent-ID", agent)
+		}
+		w := httptest.NewRecorder()
+		server.agentMiddleware(handler)(w, r)
+		return w
+	}
+
+	w := call(server.handleRegisterAgent, "", `{"id":"agent-1"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code, "token agents have to name themselves")
+	w = call(server.handleRegisterAgent, "rack-1/agent-1", `{"id":"rack-1/agent-1"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code, "a / would make the ID look like one of another credential")
+	w = call(server.handleRegisterAgent, "agent-2", `{"id":"agent-1"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = call(server.handleRegisterAgent, "agent-1", `{"id":"agent-1"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var registered struct {
+		AgentID string `json:"agent_id"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&registered))
+	assert.Equal(t, staticAgentCredential+"/agent-1", registered.AgentID)
+
+	agents := server.agents.List()
+	require.Len(t, agents, 1)
+	assert.Equal(t, staticAgentCredential+"/agent-1", agents[0].ID)
+	assert.Equal(t, staticAgentCredential, agents[0].Credential)
+
+	w = call(server.handleAgentHeartbeat, "agent-1", `{"id":"agent-2"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = call(server.handleAgentHeartbeat, "agent-1", `{"id":"agent-1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAgentsCannotReportOnLeasesOfOtherCredentials(t *testing.T) {
+	server := newServer(t, withAgentToken("shared-token"))
+
+	require.NoError(t, server.agentCredentials.CreateAgentCredential(&AgentCredential{
+		ID: "cred-1", Name: "rack-1", CreatedAt: "2025-01-01T00:00:00Z",
+	}, hashToken("rack-token")))
+	task, ops, err := CreateTask("1+2", "alice")
+	require.NoError(t, err)
+	require.NoError(t, server.storage.AddTaskWithOperations(&task, ops))
+
+	call := func(handler http.HandlerFunc, method string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/internal/task", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		server.agentMiddleware(handler)(w, r)
+		return w
+	}
+
+	w := call(server.handleTask, http.MethodGet, "rack-token", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var claimed struct {
+		Task Operation `json:"task"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&claimed))
+	assert.Equal(t, "rack-1/agent-1", claimed.Task.LeaseOwner)
+
+	complete := `{"id":"` + claimed.Task.ID + `","result":3}`
+	w = call(server.handleCompleteTask, http.MethodPost, "shared-token", complete)
+	assert.Equal(t, http.StatusNotFound, w.Code, "the same X-Agent-ID under another credential is another agent")
+	w = call(server.handleFailTask, http.MethodPost, "shared-token", `{"id":"`+claimed.Task.ID+`","error_code":"parse_error"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = call(server.handleCompleteTask, http.MethodPost, "rack-token", complete)
+	assert.Equal(t, http.StatusOK, w.Code)
+	got, err := server.storage.GetTask(task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCompleted, got.Status)
+}
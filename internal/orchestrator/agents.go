@@ -0,0 +1,138 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+func (s *Server) handleRegisterAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID       string `json:"id"`
+		Hostname string `json:"hostname"`
+		Workers  int    `json:"workers"`
+		Version  string `json:"version"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		http.Error(w, "Agent ID is required", http.StatusBadRequest)
+		return
+	}
+	identity := agentFromRequest(r)
+	if req.ID != identity.Name {
+		http.Error(w, "Agent ID does not match the credential", http.StatusForbidden)
+		return
+	}
+
+	s.agents.Register(AgentInfo{
+		ID:         identity.ID,
+		Hostname:   req.Hostname,
+		Workers:    req.Workers,
+		Version:    req.Version,
+		Credential: identity.Credential,
+	})
+	log.Printf("Agent %s registered from %s with %d workers (version %s, credential %s)",
+		identity.ID, req.Hostname, req.Workers, req.Version, identity.Credential)
+
+	response := struct {
+		AgentID           string `json:"agent_id"`
+		HeartbeatInterval int64  `json:"heartbeat_interval_ms"`
+	}{
+		AgentID:           identity.ID,
+		HeartbeatInterval: s.config.HeartbeatInterval.Milliseconds(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleAgentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	identity := agentFromRequest(r)
+	if req.ID != identity.Name {
+		http.Error(w, "Agent ID does not match the credential", http.StatusForbidden)
+		return
+	}
+
+	if !s.agents.Heartbeat(identity.ID) {
+		http.Error(w, "Agent not registered", http.StatusNotFound)
+		return
+	}
+
+	cancelled, err := s.storage.TakeCancelledOperations(identity.ID)
+	if err != nil {
+		log.Printf("Failed to load cancelled operations of agent %s: %v", identity.ID, err)
+	}
+
+	response := struct {
+		CancelledOperations []string `json:"cancelled_operations,omitempty"`
+	}{
+		CancelledOperations: cancelled,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := struct {
+		Agents []AgentInfo `json:"agents"`
+	}{
+		Agents: s.agents.List(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) monitorAgents() {
+	ticker := time.NewTicker(s.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	timeout := s.config.HeartbeatInterval * time.Duration(s.config.MissedHeartbeats)
+	for range ticker.C {
+		s.requeueDeadAgents(timeout)
+	}
+}
+
+// requeueDeadAgents marks the agents not seen within timeout dead and gives
+// the operations they were computing another attempt.
+func (s *Server) requeueDeadAgents(timeout time.Duration) {
+	for _, id := range s.agents.MarkDead(timeout) {
+		requeued, err := s.storage.RequeueAgentOperations(id)
+		if err != nil {
+			log.Printf("Failed to requeue operations of dead agent %s: %v", id, err)
+			continue
+		}
+		log.Printf("Agent %s missed %d heartbeats, requeued %d operations", id, s.config.MissedHeartbeats, len(requeued))
+	}
+}
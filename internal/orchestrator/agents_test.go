@@ -0,0 +1,97 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentRegistryTracksHeartbeats(t *testing.T) {
+	registry := NewAgentRegistry()
+	assert.False(t, registry.Heartbeat("agent-1"), "unknown agents have to register")
+
+	registry.Register(AgentInfo{ID: "agent-1", Hostname: "host-1", Workers: 2})
+	registry.Register(AgentInfo{ID: "agent-2", Hostname: "host-2", Workers: 4})
+	assert.True(t, registry.Heartbeat("agent-1"))
+	assert.Empty(t, registry.MarkDead(time.Minute))
+
+	registry.agents["agent-2"].LastSeen = time.Now().Add(-time.Hour)
+	assert.Equal(t, []string{"agent-2"}, registry.MarkDead(time.Minute))
+	assert.Empty(t, registry.MarkDead(time.Minute), "dead agents are reported once")
+
+	agents := registry.List()
+	require.Len(t, agents, 2)
+	assert.Equal(t, AgentAlive, agents[0].Status)
+	assert.Equal(t, AgentDead, agents[1].Status)
+	assert.Equal(t, 4, agents[1].Workers)
+
+	assert.True(t, registry.Heartbeat("agent-2"))
+	assert.Equal(t, AgentAlive, registry.List()[1].Status)
+}
+
+func TestDeadAgentOperationsReturnToPending(t *testing.T) {
+	server := newServer(t, withAdmins("root"), withAgentToken("shared-token"))
+	admin := registerAndLogin(t, server, "root")
+	user := registerAndLogin(t, server, "alice")
+	task, _ := addExpression(t, server.storage, "1+2", "alice")
+
+	call := func(handler http.HandlerFunc, method string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/internal/agents/register", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer shared-token")
+		r.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		server.agentMiddleware(handler)(w, r)
+		return w
+	}
+	w := call(server.handleRegisterAgent, http.MethodPost, `{"id":"agent-1","hostname":"host-1","workers":2,"version":"1.0"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = call(server.handleTask, http.MethodGet, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var claimed struct {
+		Task Operation `json:"task"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&claimed))
+
+	server.requeueDeadAgents(time.Minute)
+	op, err := server.storage.GetOperation(claimed.Task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusInProgress, op.Status, "the agent is still alive")
+
+	server.agents.agents[staticAgentCredential+"/agent-1"].LastSeen = time.Now().Add(-time.Hour)
+	server.requeueDeadAgents(time.Minute)
+
+	op, err = server.storage.GetOperation(claimed.Task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, op.Status)
+	assert.Empty(t, op.LeaseOwner)
+	assert.Equal(t, 1, op.Attempts)
+	got, err := server.storage.GetTask(task.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, got.Retries)
+
+	list := server.requireRole(RoleOperator, server.handleListAgents)
+	w = authorizedRequest(t, list, http.MethodGet, "/api/v1/admin/agents", user, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = authorizedRequest(t, list, http.MethodGet, "/api/v1/admin/agents", admin, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Agents []AgentInfo `json:"agents"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&listed))
+	require.Len(t, listed.Agents, 1)
+	assert.Equal(t, staticAgentCredential+"/agent-1", listed.Agents[0].ID)
+	assert.Equal(t, "host-1", listed.Agents[0].Hostname)
+	assert.Equal(t, 2, listed.Agents[0].Workers)
+	assert.Equal(t, "1.0", listed.Agents[0].Version)
+	assert.Equal(t, AgentDead, listed.Agents[0].Status)
+
+	w = call(server.handleAgentHeartbeat, http.MethodPost, `{"id":"agent-1"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, AgentAlive, server.agents.List()[0].Status)
+}
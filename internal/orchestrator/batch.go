@@ -0,0 +1,225 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Batch struct {
+	ID        string   `json:"id"`
+	UserLogin string   `json:"user_login"`
+	TaskIDs   []string `json:"task_ids,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// BatchItem is one task of a batch together with its operations.
+type BatchItem struct {
+	Task       *Task
+	Operations []*Operation
+}
+
+type batchItemResult struct {
+	Index int    `json:"index"`
+	Label string `json:"label,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (s *Server) handleCalculateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Expressions []struct {
+			Expression string `json:"expression"`
+			Label      string `json:"label"`
+		} `json:"expressions"`
+		Priority    int    `json:"priority"`
+		WorkspaceID string `json:"workspace_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Expressions) == 0 {
+		http.Error(w, "Batch is empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Expressions) > s.config.MaxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch is larger than %d expressions", s.config.MaxBatchSize), http.StatusBadRequest)
+		return
+	}
+	priority, err := s.taskPriority(s.getRoleFromRequest(r), req.Priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	variables, err := s.workspaceVariables(req.WorkspaceID, userLogin)
+	if err == ErrWorkspaceNotFound {
+		http.Error(w, "Workspace not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load workspace %s: %v", req.WorkspaceID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	batch := Batch{
+		ID:        uuid.New().String(),
+		UserLogin: userLogin,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	results := make([]batchItemResult, len(req.Expressions))
+	var parsed []BatchItem
+	var indexes []int
+	labels := make(map[string]string)
+	for i, item := range req.Expressions {
+		results[i] = batchItemResult{Index: i, Label: item.Label}
+
+		task, ops, err := CreateTaskWithVariables(item.Expression, userLogin, variables)
+		if err != nil {
+			results[i].Error = fmt.Sprintf("Invalid expression: %v", err)
+			continue
+		}
+		task.MaxAttempts = s.config.RetryPolicy.MaxAttempts
+		task.Priority = priority
+		task.BatchID = batch.ID
+		task.WorkspaceID = req.WorkspaceID
+		task.Label = item.Label
+
+		if item.Label != "" {
+			labels[item.Label] = task.ID
+		}
+		parsed = append(parsed, BatchItem{Task: &task, Operations: ops})
+		indexes = append(indexes, i)
+	}
+
+	// Expressions of the batch can refer to each other by label.
+	tasks := make([]*Task, len(parsed))
+	for n, item := range parsed {
+		for _, ref := range item.Task.References {
+			if id, ok := labels[ref]; ok {
+				renameReference(item.Task, item.Operations, ref, id)
+			}
+		}
+		tasks[n] = item.Task
+	}
+	errs, err := s.checkReferences(userLogin, tasks)
+	if err != nil {
+		log.Printf("Failed to check references of batch: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var items []BatchItem
+	for n, item := range parsed {
+		if errs[n] != nil {
+			results[indexes[n]].Error = fmt.Sprintf("Invalid reference: %v", errs[n])
+			continue
+		}
+		results[indexes[n]].ID = item.Task.ID
+		items = append(items, item)
+	}
+
+	response := struct {
+		ID    string            `json:"id,omitempty"`
+		Items []batchItemResult `json:"items"`
+	}{
+		Items: results,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(items) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if !s.admitExpressions(w, userLogin, len(items)) {
+		return
+	}
+	if err := s.storage.AddBatch(&batch, items); err != nil {
+		log.Printf("Failed to save batch: %v", err)
+		http.Error(w, "Failed to save batch", http.StatusInternalServerError)
+		return
+	}
+
+	response.ID = batch.ID
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/batches/")
+	batch, tasks, err := s.storage.GetBatch(id, userLogin)
+	if err != nil {
+		log.Printf("Failed to get batch %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if batch == nil {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+
+	statuses := make(map[string]int)
+	finished := 0
+	for _, task := range tasks {
+		statuses[task.Status]++
+		if isFinalStatus(task.Status) {
+			finished++
+		}
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	}
+
+	response := struct {
+		ID        string         `json:"id"`
+		CreatedAt string         `json:"created_at"`
+		Total     int            `json:"total"`
+		Finished  int            `json:"finished"`
+		Done      bool           `json:"done"`
+		Statuses  map[string]int `json:"statuses"`
+		Items     []*Task        `json:"items"`
+	}{
+		ID:        batch.ID,
+		CreatedAt: batch.CreatedAt,
+		Total:     len(tasks),
+		Finished:  finished,
+		Done:      finished == len(tasks),
+		Statuses:  statuses,
+		Items:     tasks,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,82 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type batchStatus struct {
+	Total    int            `json:"total"`
+	Finished int            `json:"finished"`
+	Done     bool           `json:"done"`
+	Statuses map[string]int `json:"statuses"`
+	Items    []*Task        `json:"items"`
+}
+
+func getBatch(t *testing.T, server *Server, token, id string) (int, batchStatus) {
+	t.Helper()
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleGetBatch), http.MethodGet, "/api/v1/batches/"+id, token, nil)
+	var status batchStatus
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	}
+	return w.Code, status
+}
+
+func TestCalculateBatch(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculateBatch), http.MethodPost, "/api/v1/calculate/batch", token,
+		map[string]interface{}{"expressions": []map[string]string{
+			{"expression": "1+2", "label": "a"},
+			{"expression": "2 *", "label": "broken"},
+			{"expression": "5"},
+		}})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var created struct {
+		ID    string            `json:"id"`
+		Items []batchItemResult `json:"items"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	require.Len(t, created.Items, 3)
+	assert.NotEmpty(t, created.Items[0].ID)
+	assert.Equal(t, "a", created.Items[0].Label)
+	assert.Empty(t, created.Items[1].ID)
+	assert.Contains(t, created.Items[1].Error, "Invalid expression")
+	assert.NotEmpty(t, created.Items[2].ID)
+
+	code, status := getBatch(t, server, token, created.ID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, status.Total)
+	assert.Equal(t, 1, status.Finished)
+	assert.False(t, status.Done)
+	assert.Equal(t, map[string]int{StatusPending: 1, StatusCompleted: 1}, status.Statuses)
+
+	finishTask(t, server)
+	_, status = getBatch(t, server, token, created.ID)
+	assert.True(t, status.Done)
+	assert.Equal(t, float64(3), status.Items[0].Result)
+	assert.Equal(t, "a", status.Items[0].Label)
+
+	other := registerAndLogin(t, server, "bob")
+	code, _ = getBatch(t, server, other, created.ID)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestCalculateBatchWithoutValidItems(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculateBatch), http.MethodPost, "/api/v1/calculate/batch", token,
+		map[string]interface{}{"expressions": []map[string]string{{"expression": "("}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleCalculateBatch), http.MethodPost, "/api/v1/calculate/batch", token,
+		map[string]interface{}{"expressions": []map[string]string{}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
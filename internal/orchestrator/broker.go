@@ -0,0 +1,187 @@
+package orchestrator
+
+import (
+	"sync"
+	"time"
+)
+
+// Broker is an in-process pub/sub of task changes. Subscribers are only told
+// that a task changed and read its current state themselves, so a slow
+// subscriber never blocks storage and several changes collapse into one
+// notification.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value whenever the task
+// changes. The returned function has to be called to unsubscribe.
+func (b *Broker) Subscribe(taskID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	if b.subscribers[taskID] == nil {
+		b.subscribers[taskID] = make(map[chan struct{}]struct{})
+	}
+	b.subscribers[taskID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[taskID], ch)
+		if len(b.subscribers[taskID]) == 0 {
+			delete(b.subscribers, taskID)
+		}
+	}
+}
+
+func (b *Broker) Publish(taskID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[taskID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Active reports whether anyone is subscribed at all, which lets publishers
+// skip extra lookups when nobody listens.
+func (b *Broker) Active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0
+}
+
+// publishingStore notifies the broker about every task change made through
+// the wrapped backend.
+type publishingStore struct {
+	Backend
+	broker *Broker
+}
+
+func (s *publishingStore) UpdateTask(task *Task) error {
+	if err := s.Backend.UpdateTask(task); err != nil {
+		return err
+	}
+	s.broker.Publish(task.ID)
+	return nil
+}
+
+func (s *publishingStore) DeleteTask(id string, userLogin string) error {
+	if err := s.Backend.DeleteTask(id, userLogin); err != nil {
+		return err
+	}
+	s.publish(id)
+	return nil
+}
+
+func (s *publishingStore) CancelTask(id string, userLogin string) error {
+	if err := s.Backend.CancelTask(id, userLogin); err != nil {
+		return err
+	}
+	s.publish(id)
+	return nil
+}
+
+func (s *publishingStore) ClaimOperation(owner string, lease time.Duration) (*Operation, error) {
+	op, err := s.Backend.ClaimOperation(owner, lease)
+	if err == nil && op != nil {
+		s.broker.Publish(op.TaskID)
+	}
+	return op, err
+}
+
+func (s *publishingStore) CompleteOperation(id string, owner string, result float64) error {
+	taskID := s.operationTask(id)
+	if err := s.Backend.CompleteOperation(id, owner, result); err != nil {
+		return err
+	}
+	s.publish(taskID)
+	return nil
+}
+
+func (s *publishingStore) FailOperation(id string, owner string, failure Failure) error {
+	taskID := s.operationTask(id)
+	if err := s.Backend.FailOperation(id, owner, failure); err != nil {
+		return err
+	}
+	s.publish(taskID)
+	return nil
+}
+
+func (s *publishingStore) ReleaseExpiredLeases() ([]string, error) {
+	taskIDs, err := s.Backend.ReleaseExpiredLeases()
+	s.publishAll(taskIDs)
+	return taskIDs, err
+}
+
+func (s *publishingStore) RequeueAgentOperations(owner string) ([]string, error) {
+	taskIDs, err := s.Backend.RequeueAgentOperations(owner)
+	s.publishAll(taskIDs)
+	return taskIDs, err
+}
+
+func (s *publishingStore) RequeueTask(id string) error {
+	if err := s.Backend.RequeueTask(id); err != nil {
+		return err
+	}
+	s.publish(id)
+	return nil
+}
+
+func (s *publishingStore) operationTask(id string) string {
+	if !s.broker.Active() {
+		return ""
+	}
+	op, err := s.Backend.GetOperation(id)
+	if err != nil || op == nil {
+		return ""
+	}
+	return op.TaskID
+}
+
+// publish notifies about taskID and about the tasks that refer to it, which
+// are started or failed together with it.
+func (s *publishingStore) publish(taskID string) {
+	if taskID == "" {
+		return
+	}
+	s.broker.Publish(taskID)
+	if !s.broker.Active() {
+		return
+	}
+
+	seen := map[string]bool{taskID: true}
+	queue := []string{taskID}
+	for len(queue) > 0 {
+		dependents, err := s.Backend.GetDependentTasks(queue[0])
+		queue = queue[1:]
+		if err != nil {
+			continue
+		}
+		for _, id := range dependents {
+			if !seen[id] {
+				seen[id] = true
+				s.broker.Publish(id)
+				queue = append(queue, id)
+			}
+		}
+	}
+}
+
+func (s *publishingStore) publishAll(taskIDs []string) {
+	seen := make(map[string]bool)
+	for _, id := range taskIDs {
+		if !seen[id] {
+			seen[id] = true
+			s.publish(id)
+		}
+	}
+}
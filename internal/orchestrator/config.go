@@ -0,0 +1,241 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/expr"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	StorageBackend      string
+	DatabasePath        string
+	StorageFile         string
+	OperationTimes      map[string]time.Duration
+	LeaseTimeout        time.Duration
+	ReaperInterval      time.Duration
+	HeartbeatInterval   time.Duration
+	MissedHeartbeats    int
+	AdminLogins         []string
+	RetryPolicy         RetryPolicy
+	UserMaxPriority     int
+	OperatorMaxPriority int
+	AdminMaxPriority    int
+	RateLimitRPS        int
+	RateLimitBurst      int
+	MaxInFlight         int
+	MaxBatchSize        int
+
+	IdempotencyRetention time.Duration
+
+	// JWTKeysFile lists the keys user tokens are signed and verified with;
+	// JWTSecret is a single HMAC key for simple deployments.
+	JWTKeysFile string
+	JWTSecret   string
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// AgentToken is accepted from every agent in addition to the tokens
+	// issued through the admin API.
+	AgentToken string
+
+	// With TLS configured the internal API is served on InternalAddress and
+	// agents authenticate with certificates signed by TLSClientCAFile.
+	InternalAddress string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	WebhookSecret      string
+	WebhookMaxAttempts int
+	WebhookRetryBase   time.Duration
+	WebhookTimeout     time.Duration
+	WebhookInterval    time.Duration
+	// WebhookAllowPrivate lets webhooks reach loopback and private
+	// addresses, which is only safe when users are trusted.
+	WebhookAllowPrivate bool
+}
+
+func LoadConfig() Config {
+	return loadConfig(os.Getenv)
+}
+
+// loadConfig reads the configuration through getenv; variables it returns
+// empty take their defaults.
+func loadConfig(getenv func(string) string) Config {
+	env := environment(getenv)
+	return Config{
+		StorageBackend: env.String("STORAGE_BACKEND", BackendSQLite),
+		DatabasePath:   env.String("DATABASE_PATH", "./tasks.db"),
+		StorageFile:    env.String("STORAGE_FILE", "./tasks.json"),
+		OperationTimes: map[string]time.Duration{
+			expr.OpAdd: env.Milliseconds("TIME_ADDITION_MS", 0),
+			expr.OpSub: env.Milliseconds("TIME_SUBTRACTION_MS", 0),
+			expr.OpMul: env.Milliseconds("TIME_MULTIPLICATIONS_MS", 0),
+			expr.OpDiv: env.Milliseconds("TIME_DIVISIONS_MS", 0),
+			expr.OpMod: env.Milliseconds("TIME_MODULO_MS", 0),
+			expr.OpPow: env.Milliseconds("TIME_POWER_MS", 0),
+		},
+		LeaseTimeout:      env.Milliseconds("LEASE_TIMEOUT_MS", 30*time.Second),
+		ReaperInterval:    env.Milliseconds("LEASE_REAPER_INTERVAL_MS", 5*time.Second),
+		HeartbeatInterval: env.Milliseconds("HEARTBEAT_INTERVAL_MS", 5*time.Second),
+		MissedHeartbeats:  env.Int("AGENT_MISSED_HEARTBEATS", 3),
+		AdminLogins:       env.List("ADMIN_LOGINS"),
+		RetryPolicy: RetryPolicy{
+			MaxAttempts: env.Int("MAX_ATTEMPTS", DefaultRetryPolicy.MaxAttempts),
+			BackoffBase: env.Milliseconds("RETRY_BACKOFF_BASE_MS", DefaultRetryPolicy.BackoffBase),
+			BackoffMax:  env.Milliseconds("RETRY_BACKOFF_MAX_MS", DefaultRetryPolicy.BackoffMax),
+		},
+		UserMaxPriority:     env.NonNegativeInt("MAX_PRIORITY_USER", 5),
+		OperatorMaxPriority: env.NonNegativeInt("MAX_PRIORITY_OPERATOR", 10),
+		AdminMaxPriority:    env.NonNegativeInt("MAX_PRIORITY_ADMIN", 10),
+		RateLimitRPS:        env.Int("RATE_LIMIT_RPS", 10),
+		RateLimitBurst:      env.Int("RATE_LIMIT_BURST", 20),
+		MaxInFlight:         env.Int("MAX_IN_FLIGHT", 100),
+		MaxBatchSize:        env.Int("MAX_BATCH_SIZE", 1000),
+
+		IdempotencyRetention: env.Milliseconds("IDEMPOTENCY_RETENTION_MS", 24*time.Hour),
+
+		JWTKeysFile: env("JWT_KEYS_FILE"),
+		JWTSecret:   env("JWT_SECRET"),
+
+		AccessTokenTTL:  env.Milliseconds("ACCESS_TOKEN_TTL_MS", 15*time.Minute),
+		RefreshTokenTTL: env.Milliseconds("REFRESH_TOKEN_TTL_MS", 30*24*time.Hour),
+
+		AgentToken: env("AGENT_TOKEN"),
+
+		InternalAddress: env.String("INTERNAL_ADDRESS", ":8443"),
+		TLSCertFile:     env("TLS_CERT_FILE"),
+		TLSKeyFile:      env("TLS_KEY_FILE"),
+		TLSClientCAFile: env("TLS_CLIENT_CA_FILE"),
+
+		WebhookSecret:      env("WEBHOOK_SECRET"),
+		WebhookMaxAttempts: env.Int("WEBHOOK_MAX_ATTEMPTS", 6),
+		WebhookRetryBase:   env.Milliseconds("WEBHOOK_RETRY_BASE_MS", time.Second),
+		WebhookTimeout:     env.Milliseconds("WEBHOOK_TIMEOUT_MS", 10*time.Second),
+		WebhookInterval:    env.Milliseconds("WEBHOOK_INTERVAL_MS", time.Second),
+
+		WebhookAllowPrivate: env.Bool("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false),
+	}
+}
+
+// IsAdmin reports whether login is listed in ADMIN_LOGINS, which makes the
+// user an admin.
+func (c Config) IsAdmin(login string) bool {
+	for _, admin := range c.AdminLogins {
+		if strings.EqualFold(admin, login) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxPriority is the highest task priority a user with the role may ask for.
+func (c Config) MaxPriority(role string) int {
+	switch role {
+	case RoleAdmin:
+		return c.AdminMaxPriority
+	case RoleOperator:
+		return c.OperatorMaxPriority
+	default:
+		return c.UserMaxPriority
+	}
+}
+
+func (c Config) OperationTime(operator string) time.Duration {
+	return c.OperationTimes[operator]
+}
+
+// LeaseDuration is how long an agent may hold an operation before it is
+// handed to someone else: the longest simulated computation time plus a
+// grace period.
+func (c Config) LeaseDuration() time.Duration {
+	var longest time.Duration
+	for _, d := range c.OperationTimes {
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest + c.LeaseTimeout
+}
+
+// environment looks up configuration variables by name.
+type environment func(string) string
+
+func (env environment) Milliseconds(name string, fallback time.Duration) time.Duration {
+	value := env(name)
+	if value == "" {
+		return fallback
+	}
+
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		log.Printf("Invalid value %q for %s, using %v", value, name, fallback)
+		return fallback
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (env environment) String(name string, fallback string) string {
+	if value := env(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (env environment) Int(name string, fallback int) int {
+	value := env(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid value %q for %s, using %d", value, name, fallback)
+		return fallback
+	}
+	return n
+}
+
+// NonNegativeInt is like Int but also accepts 0, for limits where 0 is a
+// meaningful setting rather than a mistake.
+func (env environment) NonNegativeInt(name string, fallback int) int {
+	value := env(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid value %q for %s, using %d", value, name, fallback)
+		return fallback
+	}
+	return n
+}
+
+func (env environment) Bool(name string, fallback bool) bool {
+	value := env(name)
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %v", value, name, fallback)
+		return fallback
+	}
+	return b
+}
+
+func (env environment) List(name string) []string {
+	var values []string
+	for _, value := range strings.Split(env(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,196 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func (s *Server) handleExpression(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/")
+	switch {
+	case strings.HasSuffix(path, "/events"):
+		s.handleExpressionEvents(w, r, strings.TrimSuffix(path, "/events"))
+	case strings.HasSuffix(path, "/ws"):
+		s.handleExpressionSocket(w, r, strings.TrimSuffix(path, "/ws"))
+	case strings.HasSuffix(path, "/cancel"):
+		s.handleCancelExpression(w, r, strings.TrimSuffix(path, "/cancel"))
+	default:
+		s.handleGetExpressionByID(w, r)
+	}
+}
+
+func isFinalStatus(status string) bool {
+	switch status {
+	case StatusCompleted, StatusFailed, StatusCancelled, StatusDeadLetter:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchTask sends the current state of a task and then every status change
+// until the task reaches a final status, disappears or ctx is done.
+func (s *Server) watchTask(ctx context.Context, id string, userLogin string, send func(*Task) error) error {
+	updates, unsubscribe := s.broker.Subscribe(id)
+	defer unsubscribe()
+
+	lastStatus := ""
+	for {
+		task, err := s.storage.GetTaskByID(id, userLogin)
+		if err != nil {
+			return err
+		}
+		if task == nil {
+			return nil
+		}
+
+		if task.Status != lastStatus {
+			if err := send(task); err != nil {
+				return err
+			}
+			lastStatus = task.Status
+		}
+		if isFinalStatus(task.Status) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-updates:
+		}
+	}
+}
+
+func (s *Server) lookupStreamTask(w http.ResponseWriter, r *http.Request, id string) (string, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	task, err := s.storage.GetTaskByID(id, userLogin)
+	if err != nil || task == nil {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return "", false
+	}
+	return userLogin, true
+}
+
+func (s *Server) handleExpressionEvents(w http.ResponseWriter, r *http.Request, id string) {
+	userLogin, ok := s.lookupStreamTask(w, r, id)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := s.watchTask(r.Context(), id, userLogin, func(task *Task) error {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Event stream for %s stopped: %v", id, err)
+	}
+}
+
+func (s *Server) handleExpressionSocket(w http.ResponseWriter, r *http.Request, id string) {
+	userLogin, ok := s.lookupStreamTask(w, r, id)
+	if !ok {
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("WebSocket upgrade failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		conn.readLoop()
+		cancel()
+	}()
+
+	err = s.watchTask(ctx, id, userLogin, func(task *Task) error {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(data)
+	})
+	if err != nil {
+		log.Printf("WebSocket stream for %s stopped: %v", id, err)
+	}
+}
+
+func (s *Server) handleCancelExpression(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = s.storage.CancelTask(id, userLogin)
+	if err == ErrTaskNotFound {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+	if err == ErrTaskFinished {
+		http.Error(w, "Expression already finished", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to cancel task %s: %v", id, err)
+		http.Error(w, "Failed to cancel expression", http.StatusInternalServerError)
+		return
+	}
+
+	task, err := s.storage.GetTaskByID(id, userLogin)
+	if err != nil || task == nil {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+
+	response := struct {
+		Expression *Task `json:"expression"`
+	}{
+		Expression: task,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
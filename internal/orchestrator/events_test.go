@@ -0,0 +1,290 @@
+package orchestrator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStreamingServer(t *testing.T) (*Server, *httptest.Server, string) {
+	t.Helper()
+
+	server := newServer(t)
+	token := registerAndLogin(t, server, "alice")
+	ts := httptest.NewServer(server.authMiddleware(server.handleExpression))
+	t.Cleanup(ts.Close)
+	return server, ts, token
+}
+
+func registerAndLogin(t *testing.T, server *Server, login string) string {
+	t.Helper()
+
+	require.Equal(t, http.StatusOK, postCredentials(t, server.handleRegister, login, "secret").Code)
+	w := postCredentials(t, server.handleLogin, login, "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	return result.Token
+}
+
+// finishTask claims and completes every operation of a "1+2" task.
+func finishTask(t *testing.T, server *Server) {
+	t.Helper()
+
+	op, err := server.storage.ClaimOperation("agent-1", time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, op)
+	require.NoError(t, server.storage.CompleteOperation(op.ID, "agent-1", 3))
+}
+
+func TestExpressionEventsStreamStatusChanges(t *testing.T) {
+	server, ts, token := newStreamingServer(t)
+	task, _ := addExpression(t, server.storage, "1+2", "alice")
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/expressions/%s/events?access_token=%s", ts.URL, task.ID, token))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan Task)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var event Task
+			if json.Unmarshal([]byte(data), &event) == nil {
+				events <- event
+			}
+		}
+	}()
+
+	assert.Equal(t, StatusPending, (<-events).Status)
+	finishTask(t, server)
+
+	var statuses []string
+	for event := range events {
+		statuses = append(statuses, event.Status)
+		if event.Status == StatusCompleted {
+			assert.Equal(t, float64(3), event.Result)
+		}
+	}
+	require.NotEmpty(t, statuses)
+	assert.Equal(t, StatusCompleted, statuses[len(statuses)-1])
+}
+
+func TestExpressionEventsRequireOwnTask(t *testing.T) {
+	server, ts, token := newStreamingServer(t)
+	task, _ := addExpression(t, server.storage, "1+2", "bob")
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/expressions/%s/events?access_token=%s", ts.URL, task.ID, token))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(fmt.Sprintf("%s/api/v1/expressions/%s/events", ts.URL, task.ID))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAccessTokenQueryParameterIsOnlyForStreams(t *testing.T) {
+	server, ts, token := newStreamingServer(t)
+	task, _ := addExpression(t, server.storage, "1+2", "alice")
+
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/expressions/%s?access_token=%s", ts.URL, task.ID, token))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Post(fmt.Sprintf("%s/api/v1/expressions/%s/cancel?access_token=%s", ts.URL, task.ID, token), "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	w := httptest.NewRecorder()
+	server.authMiddleware(server.handleCalculate)(w, httptest.NewRequest(http.MethodPost, "/api/v1/calculate?access_token="+token, strings.NewReader(`{"expression":"1+2"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	resp, err = http.Get(fmt.Sprintf("%s/api/v1/expressions/%s/events?access_token=%s", ts.URL, task.ID, token))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// dialWebSocket opens the event socket of the task and returns the
+// connection with a reader positioned after the handshake.
+func dialWebSocket(t *testing.T, ts *httptest.Server, id, token string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "GET /api/v1/expressions/%s/ws?access_token=%s HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", id, token)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	return conn, reader
+}
+
+// readServerFrame reads one unmasked frame sent by the server.
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	var head [2]byte
+	_, err := io.ReadFull(reader, head[:])
+	require.NoError(t, err)
+	require.Zero(t, head[1]&0x80, "server frames are not masked")
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		_, err := io.ReadFull(reader, ext[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	require.NoError(t, err)
+	return head[0] & 0x0F, payload
+}
+
+func TestExpressionWebSocketStreamsResult(t *testing.T) {
+	server, ts, token := newStreamingServer(t)
+	task, _ := addExpression(t, server.storage, "1+2", "alice")
+	_, reader := dialWebSocket(t, ts, task.ID, token)
+
+	readTask := func() (byte, Task) {
+		opcode, payload := readServerFrame(t, reader)
+		var event Task
+		if opcode == wsOpText {
+			require.NoError(t, json.Unmarshal(payload, &event))
+		}
+		return opcode, event
+	}
+
+	_, event := readTask()
+	assert.Equal(t, StatusPending, event.Status)
+
+	finishTask(t, server)
+	for {
+		opcode, event := readTask()
+		if opcode == wsOpClose {
+			break
+		}
+		if event.Status == StatusCompleted {
+			assert.Equal(t, float64(3), event.Result)
+		}
+	}
+}
+
+func TestWebSocketClosesOnUnmaskedFrame(t *testing.T) {
+	server, ts, token := newStreamingServer(t)
+	task, _ := addExpression(t, server.storage, "1+2", "alice")
+	conn, reader := dialWebSocket(t, ts, task.ID, token)
+
+	opcode, _ := readServerFrame(t, reader)
+	require.Equal(t, byte(wsOpText), opcode)
+
+	_, err := conn.Write([]byte{0x80 | wsOpText, 2, 'h', 'i'})
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	opcode, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(wsOpClose), opcode)
+	require.Len(t, payload, 2)
+	assert.Equal(t, uint16(wsCloseProtocolError), binary.BigEndian.Uint16(payload))
+}
+
+func TestCancelExpression(t *testing.T) {
+	server, ts, token := newStreamingServer(t)
+	task, _ := addExpression(t, server.storage, "1+2", "alice")
+
+	cancel := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v1/expressions/%s/cancel", ts.URL, task.ID), nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := cancel()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Expression Task `json:"expression"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, StatusCancelled, body.Expression.Status)
+
+	again := cancel()
+	again.Body.Close()
+	assert.Equal(t, http.StatusConflict, again.StatusCode)
+}
+
+func TestLeaseReleaseAndRequeuesPublishTaskChanges(t *testing.T) {
+	server, _, _ := newStreamingServer(t)
+	task, ops, err := CreateTask("1+2", "alice")
+	require.NoError(t, err)
+	task.MaxAttempts = 1
+	require.NoError(t, server.storage.AddTaskWithOperations(&task, ops))
+
+	changes, unsubscribe := server.broker.Subscribe(task.ID)
+	defer unsubscribe()
+	expectStatus := func(status string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatalf("no change published before %s", status)
+		}
+		got, err := server.storage.GetTask(task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, status, got.Status)
+	}
+
+	_, err = server.storage.ClaimOperation("agent-1", -time.Minute)
+	require.NoError(t, err)
+	expectStatus(StatusInProgress)
+	released, err := server.storage.ReleaseExpiredLeases()
+	require.NoError(t, err)
+	assert.Equal(t, []string{task.ID}, released)
+	expectStatus(StatusDeadLetter)
+
+	require.NoError(t, server.storage.RequeueTask(task.ID))
+	expectStatus(StatusPending)
+
+	_, err = server.storage.ClaimOperation("agent-1", time.Minute)
+	require.NoError(t, err)
+	expectStatus(StatusInProgress)
+	requeued, err := server.storage.RequeueAgentOperations("agent-1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{task.ID}, requeued)
+	expectStatus(StatusDeadLetter)
+}
@@ -0,0 +1,160 @@
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength keeps keys to the size of a typical UUID or hash.
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyRecord remembers a request made with an Idempotency-Key and,
+// once the request finished, the response that was sent for it. StatusCode
+// is zero while the first request is still being handled.
+type IdempotencyRecord struct {
+	UserLogin   string `json:"user_login"`
+	Key         string `json:"key"`
+	RequestHash string `json:"request_hash"`
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type"`
+	Response    string `json:"response"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey stores record unless the user already has a record
+	// for the key created after notBefore, in which case that record is
+	// returned instead.
+	ReserveIdempotencyKey(record *IdempotencyRecord, notBefore time.Time) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(record *IdempotencyRecord) error
+	ReleaseIdempotencyKey(userLogin string, key string) error
+	PurgeIdempotencyKeys(before time.Time) (int64, error)
+}
+
+// responseCapture passes a response through while keeping a copy of it.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(data []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(data)
+	return c.ResponseWriter.Write(data)
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	io.WriteString(sum, r.Method+" "+r.URL.Path+"\n")
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// idempotent replays the stored response when a user repeats a request with
+// the same Idempotency-Key, so a client retrying after a network error does
+// not create a second task.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		userLogin, err := s.getUserFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		record := &IdempotencyRecord{
+			UserLogin:   userLogin,
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			CreatedAt:   now.Format(time.RFC3339),
+		}
+		existing, err := s.idempotency.ReserveIdempotencyKey(record, now.Add(-s.config.IdempotencyRetention))
+		if err != nil {
+			log.Printf("Failed to reserve idempotency key: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			case existing.StatusCode == 0:
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				if existing.ContentType != "" {
+					w.Header().Set("Content-Type", existing.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.StatusCode)
+				io.WriteString(w, existing.Response)
+			}
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		next(capture, r)
+
+		// Server errors and throttling are not the final answer to the
+		// request, so the client may retry them with the same key.
+		if capture.status == 0 || capture.status >= http.StatusInternalServerError || capture.status == http.StatusTooManyRequests {
+			err = s.idempotency.ReleaseIdempotencyKey(userLogin, key)
+		} else {
+			record.StatusCode = capture.status
+			record.ContentType = capture.Header().Get("Content-Type")
+			record.Response = capture.body.String()
+			err = s.idempotency.CompleteIdempotencyKey(record)
+		}
+		if err != nil {
+			log.Printf("Failed to store idempotent response: %v", err)
+		}
+	}
+}
+
+func (s *Server) purgeIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := s.idempotency.PurgeIdempotencyKeys(time.Now().UTC().Add(-s.config.IdempotencyRetention))
+		if err != nil {
+			log.Printf("Failed to purge idempotency keys: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired idempotency keys", purged)
+		}
+	}
+}
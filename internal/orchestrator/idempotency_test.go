@@ -0,0 +1,88 @@
+package orchestrator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func idempotentCalculate(t *testing.T, server *Server, token, key, expression string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"`+expression+`"}`))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	server.authMiddleware(server.idempotent(server.handleCalculate))(w, r)
+	return w
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+
+	first := idempotentCalculate(t, server, token, "key-1", "1+2")
+	require.Equal(t, http.StatusCreated, first.Code)
+	firstBody := first.Body.String()
+
+	again := idempotentCalculate(t, server, token, "key-1", "1+2")
+	assert.Equal(t, http.StatusCreated, again.Code)
+	assert.Equal(t, "true", again.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, firstBody, again.Body.String())
+
+	active, err := server.storage.CountActiveTasks("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, active)
+
+	different := idempotentCalculate(t, server, token, "key-1", "3+4")
+	assert.Equal(t, http.StatusUnprocessableEntity, different.Code)
+
+	bob := registerAndLogin(t, server, "bob")
+	other := idempotentCalculate(t, server, bob, "key-1", "1+2")
+	assert.Equal(t, http.StatusCreated, other.Code)
+	assert.NotEqual(t, firstBody, other.Body.String())
+}
+
+func TestIdempotencyKeyIsReleasedOnThrottling(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+	server.config.MaxInFlight = 1
+	calculate(t, server, token, map[string]string{"expression": "1+2"})
+
+	throttled := idempotentCalculate(t, server, token, "key-1", "3+4")
+	require.Equal(t, http.StatusTooManyRequests, throttled.Code)
+
+	finishTask(t, server)
+	retried := idempotentCalculate(t, server, token, "key-1", "3+4")
+	assert.Equal(t, http.StatusCreated, retried.Code)
+	assert.Empty(t, retried.Header().Get("Idempotent-Replayed"))
+}
+
+func TestIdempotentReplayIsNotRateLimited(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+	server.limiter = NewRateLimiter(0.001, 1)
+	handler := server.authMiddleware(server.idempotent(server.rateLimit(server.handleCalculate)))
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set(idempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	first := send("key-1")
+	require.Equal(t, http.StatusCreated, first.Code)
+	for i := 0; i < 3; i++ {
+		replay := send("key-1")
+		assert.Equal(t, http.StatusCreated, replay.Code)
+		assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first.Body.String(), replay.Body.String())
+	}
+
+	throttled := send("key-2")
+	assert.Equal(t, http.StatusTooManyRequests, throttled.Code, "new requests are still charged")
+}
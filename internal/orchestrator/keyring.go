@@ -0,0 +1,280 @@
+package orchestrator
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is a key that verifies user tokens and, when it has a signing half,
+// can issue them.
+type jwtKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Signing is the HMAC secret or private key; nil for keys that only
+	// verify tokens issued before a rotation.
+	Signing interface{}
+	// Verification is the HMAC secret or public key.
+	Verification interface{}
+}
+
+// Keyring holds every key user tokens are accepted with and the single key
+// new tokens are signed with. Tokens carry the ID of their key in the kid
+// header, so old keys can stay in the keyring while tokens signed with them
+// expire.
+type Keyring struct {
+	active *jwtKey
+	keys   map[string]*jwtKey
+}
+
+func newKeyring(active *jwtKey, others ...*jwtKey) (*Keyring, error) {
+	if active.Signing == nil {
+		return nil, fmt.Errorf("active key %q cannot sign tokens", active.ID)
+	}
+	keyring := &Keyring{active: active, keys: make(map[string]*jwtKey)}
+	for _, key := range append([]*jwtKey{active}, others...) {
+		if _, ok := keyring.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		keyring.keys[key.ID] = key
+	}
+	return keyring, nil
+}
+
+// hmacKey derives the key ID from the secret so that tokens stay valid
+// across restarts with the same JWT_SECRET.
+func hmacKey(secret []byte) *jwtKey {
+	sum := sha256.Sum256(secret)
+	return &jwtKey{
+		ID:           "hs-" + hex.EncodeToString(sum[:4]),
+		Method:       jwt.SigningMethodHS256,
+		Signing:      secret,
+		Verification: secret,
+	}
+}
+
+// loadKeyring builds the keyring from JWT_KEYS_FILE or JWT_SECRET. Without
+// either, tokens are signed with a random secret and do not survive a
+// restart.
+func loadKeyring(config Config) (*Keyring, error) {
+	if config.JWTKeysFile != "" {
+		return loadKeyringFile(config.JWTKeysFile)
+	}
+	if config.JWTSecret != "" {
+		return newKeyring(hmacKey([]byte(config.JWTSecret)))
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate JWT secret: %v", err)
+	}
+	log.Println("Neither JWT_SECRET nor JWT_KEYS_FILE is set, tokens will be invalid after a restart")
+	return newKeyring(hmacKey(secret))
+}
+
+// keyringFile is the format of JWT_KEYS_FILE. Paths are relative to the
+// file itself.
+type keyringFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID             string `json:"kid"`
+		Algorithm      string `json:"alg"`
+		Secret         string `json:"secret"`
+		PrivateKeyFile string `json:"private_key_file"`
+		PublicKeyFile  string `json:"public_key_file"`
+	} `json:"keys"`
+}
+
+func loadKeyringFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT keys: %v", err)
+	}
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	readPEM := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		return os.ReadFile(name)
+	}
+
+	var active *jwtKey
+	var others []*jwtKey
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("key without kid in %s", path)
+		}
+		key := &jwtKey{ID: entry.ID}
+
+		switch entry.Algorithm {
+		case "HS256":
+			if entry.Secret == "" {
+				return nil, fmt.Errorf("key %s: secret is required for HS256", entry.ID)
+			}
+			key.Method = jwt.SigningMethodHS256
+			key.Signing = []byte(entry.Secret)
+			key.Verification = []byte(entry.Secret)
+		case "RS256", "EdDSA":
+			if entry.PrivateKeyFile == "" && entry.PublicKeyFile == "" {
+				return nil, fmt.Errorf("key %s: private_key_file or public_key_file is required", entry.ID)
+			}
+			if entry.PrivateKeyFile != "" {
+				pemData, err := readPEM(entry.PrivateKeyFile)
+				if err != nil {
+					return nil, fmt.Errorf("key %s: %v", entry.ID, err)
+				}
+				if err := key.setPrivateKey(entry.Algorithm, pemData); err != nil {
+					return nil, fmt.Errorf("key %s: %v", entry.ID, err)
+				}
+			} else {
+				pemData, err := readPEM(entry.PublicKeyFile)
+				if err != nil {
+					return nil, fmt.Errorf("key %s: %v", entry.ID, err)
+				}
+				if err := key.setPublicKey(entry.Algorithm, pemData); err != nil {
+					return nil, fmt.Errorf("key %s: %v", entry.ID, err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("key %s: unsupported algorithm %q, expected HS256, RS256 or EdDSA", entry.ID, entry.Algorithm)
+		}
+
+		if entry.ID == file.Active && active == nil {
+			active = key
+		} else {
+			others = append(others, key)
+		}
+	}
+	if active == nil {
+		return nil, fmt.Errorf("active key %q not found in %s", file.Active, path)
+	}
+	return newKeyring(active, others...)
+}
+
+func (k *jwtKey) setPrivateKey(algorithm string, pemData []byte) error {
+	switch algorithm {
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+		if err != nil {
+			return err
+		}
+		k.Method, k.Signing, k.Verification = jwt.SigningMethodRS256, private, &private.PublicKey
+	case "EdDSA":
+		private, err := jwt.ParseEdPrivateKeyFromPEM(pemData)
+		if err != nil {
+			return err
+		}
+		k.Method, k.Signing, k.Verification = jwt.SigningMethodEdDSA, private, private.(crypto.Signer).Public()
+	}
+	return nil
+}
+
+func (k *jwtKey) setPublicKey(algorithm string, pemData []byte) error {
+	switch algorithm {
+	case "RS256":
+		public, err := jwt.ParseRSAPublicKeyFromPEM(pemData)
+		if err != nil {
+			return err
+		}
+		k.Method, k.Verification = jwt.SigningMethodRS256, public
+	case "EdDSA":
+		public, err := jwt.ParseEdPublicKeyFromPEM(pemData)
+		if err != nil {
+			return err
+		}
+		k.Method, k.Verification = jwt.SigningMethodEdDSA, public
+	}
+	return nil
+}
+
+// Sign issues a token with the active key.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.Signing)
+}
+
+// Parse verifies a token with the key named in its kid header. The token's
+// algorithm must be the one of that key.
+func (k *Keyring) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.Verification, nil
+	})
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the keyring. HMAC secrets are never
+// published.
+func (k *Keyring) JWKS() []jsonWebKey {
+	keys := []jsonWebKey{}
+	for _, key := range k.keys {
+		switch public := key.Verification.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, jsonWebKey{
+				KeyType:   "RSA",
+				ID:        key.ID,
+				Algorithm: key.Method.Alg(),
+				Use:       "sig",
+				N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, jsonWebKey{
+				KeyType:   "OKP",
+				ID:        key.ID,
+				Algorithm: key.Method.Alg(),
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": s.keys.JWKS()})
+}
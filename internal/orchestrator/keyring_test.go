@@ -0,0 +1,180 @@
+package orchestrator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyringFile(t *testing.T, dir string, file string) string {
+	t.Helper()
+	path := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(file), 0o600))
+	return path
+}
+
+func writePrivateKey(t *testing.T, dir, name string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+}
+
+func userClaims(login string) jwt.MapClaims {
+	return jwt.MapClaims{"sub": login, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	dir := t.TempDir()
+	old, err := loadKeyringFile(writeKeyringFile(t, dir, `{
+		"active": "2026-01",
+		"keys": [{"kid": "2026-01", "alg": "HS256", "secret": "old-secret"}]
+	}`))
+	require.NoError(t, err)
+	oldToken, err := old.Sign(userClaims("alice"))
+	require.NoError(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writePrivateKey(t, dir, "2026-02.pem", edKey)
+	rotated, err := loadKeyringFile(writeKeyringFile(t, dir, `{
+		"active": "2026-02",
+		"keys": [
+			{"kid": "2026-02", "alg": "EdDSA", "private_key_file": "2026-02.pem"},
+			{"kid": "2026-01", "alg": "HS256", "secret": "old-secret"}
+		]
+	}`))
+	require.NoError(t, err)
+
+	newToken, err := rotated.Sign(userClaims("alice"))
+	require.NoError(t, err)
+	token, err := rotated.Parse(newToken)
+	require.NoError(t, err)
+	assert.Equal(t, "2026-02", token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Header["alg"])
+
+	_, err = rotated.Parse(oldToken)
+	assert.NoError(t, err, "tokens of the previous key stay valid during rotation")
+	_, err = old.Parse(newToken)
+	assert.ErrorContains(t, err, "unknown key ID")
+
+	withoutKid, err := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims("alice")).SignedString([]byte("old-secret"))
+	require.NoError(t, err)
+	_, err = rotated.Parse(withoutKid)
+	assert.Error(t, err)
+}
+
+func TestKeyringRejectsAlgorithmOfOtherKey(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePrivateKey(t, dir, "rsa.pem", rsaKey)
+	keyring, err := loadKeyringFile(writeKeyringFile(t, dir, `{
+		"active": "rsa",
+		"keys": [{"kid": "rsa", "alg": "RS256", "private_key_file": "rsa.pem"}]
+	}`))
+	require.NoError(t, err)
+
+	// An HMAC token keyed with the published public key must not verify.
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, userClaims("admin"))
+	forged.Header["kid"] = "rsa"
+	forgedString, err := forged.SignedString(publicDER)
+	require.NoError(t, err)
+	_, err = keyring.Parse(forgedString)
+	assert.Error(t, err)
+}
+
+func TestLoadKeyringFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, file := range map[string]string{
+		"no active key":     `{"active": "b", "keys": [{"kid": "a", "alg": "HS256", "secret": "s"}]}`,
+		"unknown algorithm": `{"active": "a", "keys": [{"kid": "a", "alg": "none"}]}`,
+		"missing secret":    `{"active": "a", "keys": [{"kid": "a", "alg": "HS256"}]}`,
+		"duplicate kid":     `{"active": "a", "keys": [{"kid": "a", "alg": "HS256", "secret": "s"}, {"kid": "a", "alg": "HS256", "secret": "t"}]}`,
+		"missing key file":  `{"active": "a", "keys": [{"kid": "a", "alg": "RS256", "private_key_file": "missing.pem"}]}`,
+	} {
+		_, err := loadKeyringFile(writeKeyringFile(t, dir, file))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePrivateKey(t, dir, "rsa.pem", rsaKey)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writePrivateKey(t, dir, "ed.pem", edKey)
+	edPublicDER, err := x509.MarshalPKIXPublicKey(edPublic)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ed.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: edPublicDER}), 0o600))
+
+	keysFile := writeKeyringFile(t, dir, `{
+		"active": "rsa-1",
+		"keys": [
+			{"kid": "rsa-1", "alg": "RS256", "private_key_file": "rsa.pem"},
+			{"kid": "ed-0", "alg": "EdDSA", "public_key_file": "ed.pub"},
+			{"kid": "hs-0", "alg": "HS256", "secret": "never-published"}
+		]
+	}`)
+	server := newServer(t, func(config *Config) { config.JWTKeysFile = keysFile })
+
+	token := registerAndLogin(t, server, "alice")
+	header, _, _ := strings.Cut(token, ".")
+	headerJSON, err := base64.RawURLEncoding.DecodeString(header)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"alg": "RS256", "kid": "rsa-1", "typ": "JWT"}`, string(headerJSON))
+
+	w := httptest.NewRecorder()
+	server.handleJWKS(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "never-published")
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&jwks))
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, jsonWebKey{KeyType: "OKP", ID: "ed-0", Algorithm: "EdDSA", Use: "sig", Curve: "Ed25519",
+		X: base64.RawURLEncoding.EncodeToString(edPublic)}, jwks.Keys[0])
+	assert.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()), jwks.Keys[1].N)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+}
+
+func TestJWTSecretIsSharedAcrossServers(t *testing.T) {
+	withSecret := func(config *Config) { config.JWTSecret = "deployment-secret" }
+	first := newServer(t, withSecret)
+	second := newServer(t, withSecret)
+
+	token, err := first.keys.Sign(userClaims("alice"))
+	require.NoError(t, err)
+	parsed, err := second.keys.Parse(token)
+	require.NoError(t, err)
+	login, err := parsed.Claims.GetSubject()
+	require.NoError(t, err)
+	assert.Equal(t, "alice", login)
+
+	third := newServer(t)
+	_, err = third.keys.Parse(token)
+	assert.Error(t, err, "without a configured secret every server has its own")
+}
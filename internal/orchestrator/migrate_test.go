@@ -0,0 +1,128 @@
+package orchestrator
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "tasks.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	applied, err := MigrateUp(db)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations))
+
+	applied, err = MigrateUp(db)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	latest := migrations[len(migrations)-1]
+	rolledBack, err := MigrateDown(db)
+	require.NoError(t, err)
+	require.NotNil(t, rolledBack)
+	assert.Equal(t, latest.Version, rolledBack.Version)
+
+	statuses, err := MigrationStatuses(db)
+	require.NoError(t, err)
+	assert.Empty(t, statuses[len(statuses)-1].AppliedAt)
+
+	applied, err = MigrateUp(db)
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+	assert.Equal(t, latest.Version, applied[0].Version)
+
+	for range migrations {
+		_, err := MigrateDown(db)
+		require.NoError(t, err)
+	}
+	assert.False(t, tableExists(db, "tasks"))
+
+	rolledBack, err = MigrateDown(db)
+	require.NoError(t, err)
+	assert.Nil(t, rolledBack)
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+
+	db, err := openDatabase(path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE tasks (
+			id TEXT PRIMARY KEY,
+			expression TEXT NOT NULL,
+			status TEXT NOT NULL,
+			result REAL,
+			user_login TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		);
+		INSERT INTO tasks VALUES ('old', '1+1', 'Completed', 2, 'alice', '2025-01-01T00:00:00Z', '2025-01-01T00:00:00Z');
+		CREATE TABLE operations (
+			id TEXT PRIMARY KEY,
+			task_id TEXT NOT NULL,
+			operand1 REAL NOT NULL DEFAULT 0,
+			operand2 REAL NOT NULL DEFAULT 0,
+			operator TEXT NOT NULL,
+			left_dependency TEXT,
+			right_dependency TEXT,
+			is_root INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			result REAL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL
+		);`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	storage, err := OpenSQLiteStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	task, err := storage.GetTaskByID("old", "alice")
+	require.NoError(t, err)
+	require.NotNil(t, task)
+	assert.Equal(t, float64(2), task.Result)
+
+	addExpression(t, storage, "1+2", "alice")
+	assert.Len(t, claimAll(t, storage, "agent-1"), 1)
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "tasks.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = MigrateUp(db)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'future', '2030-01-01T00:00:00Z')`)
+	require.NoError(t, err)
+
+	_, err = MigrateUp(db)
+	assert.ErrorContains(t, err, "newer than this binary supports")
+}
+
+func TestMigrateCommandStatus(t *testing.T) {
+	config := testConfig()
+	config.DatabasePath = filepath.Join(t.TempDir(), "tasks.db")
+
+	var out bytes.Buffer
+	require.NoError(t, MigrateCommand(config, []string{"status"}, &out))
+	assert.Regexp(t, `0001\s+initial_schema\s+pending`, out.String())
+
+	out.Reset()
+	require.NoError(t, MigrateCommand(config, []string{"up"}, &out))
+	assert.Contains(t, out.String(), "applied 0001_initial_schema")
+
+	assert.Error(t, MigrateCommand(config, []string{"sideways"}, &out))
+}
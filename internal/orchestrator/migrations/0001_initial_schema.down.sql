@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS operations;
+DROP INDEX IF EXISTS idx_users_login_nocase;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS tasks;
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS tasks (
+	id TEXT PRIMARY KEY,
+	expression TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result REAL,
+	user_login TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT UNIQUE NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_login_nocase ON users (login COLLATE NOCASE);
+
+CREATE TABLE IF NOT EXISTS operations (
+	id TEXT PRIMARY KEY,
+	task_id TEXT NOT NULL,
+	operand1 REAL NOT NULL DEFAULT 0,
+	operand2 REAL NOT NULL DEFAULT 0,
+	operator TEXT NOT NULL,
+	left_dependency TEXT,
+	right_dependency TEXT,
+	is_root INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL,
+	result REAL,
+	lease_owner TEXT,
+	lease_expires_at TEXT,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
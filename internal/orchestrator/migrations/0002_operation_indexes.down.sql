@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_operations_right_dependency;
+DROP INDEX IF EXISTS idx_operations_left_dependency;
+DROP INDEX IF EXISTS idx_operations_task;
+DROP INDEX IF EXISTS idx_operations_status_created;
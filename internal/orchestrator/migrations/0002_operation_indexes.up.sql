@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS idx_operations_status_created ON operations (status, created_at);
+CREATE INDEX IF NOT EXISTS idx_operations_task ON operations (task_id);
+CREATE INDEX IF NOT EXISTS idx_operations_left_dependency ON operations (left_dependency);
+CREATE INDEX IF NOT EXISTS idx_operations_right_dependency ON operations (right_dependency);
@@ -0,0 +1,5 @@
+ALTER TABLE tasks DROP COLUMN failed_at;
+ALTER TABLE tasks DROP COLUMN failed_operation;
+ALTER TABLE tasks DROP COLUMN failed_by;
+ALTER TABLE tasks DROP COLUMN error_message;
+ALTER TABLE tasks DROP COLUMN error_code;
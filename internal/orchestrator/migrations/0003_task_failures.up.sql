@@ -0,0 +1,5 @@
+ALTER TABLE tasks ADD COLUMN error_code TEXT;
+ALTER TABLE tasks ADD COLUMN error_message TEXT;
+ALTER TABLE tasks ADD COLUMN failed_by TEXT;
+ALTER TABLE tasks ADD COLUMN failed_operation TEXT;
+ALTER TABLE tasks ADD COLUMN failed_at TEXT;
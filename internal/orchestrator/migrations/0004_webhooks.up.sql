@@ -0,0 +1,35 @@
+ALTER TABLE tasks ADD COLUMN callback_url TEXT;
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id TEXT PRIMARY KEY,
+	user_login TEXT NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_user ON webhooks (user_login);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id TEXT PRIMARY KEY,
+	task_id TEXT NOT NULL,
+	webhook_id TEXT,
+	user_login TEXT NOT NULL,
+	url TEXT NOT NULL,
+	event TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TEXT,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_user ON webhook_deliveries (user_login, created_at);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+	delivery_id TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER,
+	error TEXT,
+	attempted_at TEXT NOT NULL,
+	PRIMARY KEY (delivery_id, attempt)
+);
@@ -0,0 +1,6 @@
+ALTER TABLE operations DROP COLUMN last_error;
+ALTER TABLE operations DROP COLUMN next_attempt_at;
+ALTER TABLE operations DROP COLUMN attempts;
+
+ALTER TABLE tasks DROP COLUMN max_attempts;
+ALTER TABLE tasks DROP COLUMN retries;
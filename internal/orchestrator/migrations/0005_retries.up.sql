@@ -0,0 +1,6 @@
+ALTER TABLE tasks ADD COLUMN retries INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN max_attempts INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE operations ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE operations ADD COLUMN next_attempt_at TEXT;
+ALTER TABLE operations ADD COLUMN last_error TEXT;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_dispatch;
+
+ALTER TABLE tasks DROP COLUMN priority;
@@ -0,0 +1,6 @@
+ALTER TABLE tasks ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_dispatch (
+	user_login TEXT PRIMARY KEY,
+	last_dispatch INTEGER NOT NULL
+);
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_tasks_user_status ON tasks (user_login, status);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_tasks_batch;
+
+ALTER TABLE tasks DROP COLUMN label;
+ALTER TABLE tasks DROP COLUMN batch_index;
+ALTER TABLE tasks DROP COLUMN batch_id;
+
+DROP TABLE IF EXISTS batches;
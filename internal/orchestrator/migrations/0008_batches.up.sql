@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS batches (
+	id TEXT PRIMARY KEY,
+	user_login TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+ALTER TABLE tasks ADD COLUMN batch_id TEXT;
+ALTER TABLE tasks ADD COLUMN batch_index INTEGER;
+ALTER TABLE tasks ADD COLUMN label TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_batch ON tasks (batch_id, batch_index);
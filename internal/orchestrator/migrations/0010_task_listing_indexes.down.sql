@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_tasks_user_status_created;
+DROP INDEX IF EXISTS idx_tasks_user_updated;
+DROP INDEX IF EXISTS idx_tasks_user_created;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_user_status ON tasks (user_login, status);
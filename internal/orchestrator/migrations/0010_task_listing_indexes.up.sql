@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_tasks_user_status;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_user_created ON tasks (user_login, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_tasks_user_updated ON tasks (user_login, updated_at, id);
+CREATE INDEX IF NOT EXISTS idx_tasks_user_status_created ON tasks (user_login, status, created_at, id);
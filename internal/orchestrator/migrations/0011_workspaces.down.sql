@@ -0,0 +1,6 @@
+ALTER TABLE tasks DROP COLUMN variables;
+ALTER TABLE tasks DROP COLUMN workspace_id;
+
+DROP TABLE IF EXISTS workspace_variables;
+DROP INDEX IF EXISTS idx_workspaces_user_name;
+DROP TABLE IF EXISTS workspaces;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS workspaces (
+	id TEXT PRIMARY KEY,
+	user_login TEXT NOT NULL,
+	name TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_workspaces_user_name ON workspaces (user_login, name);
+
+CREATE TABLE IF NOT EXISTS workspace_variables (
+	workspace_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value REAL NOT NULL,
+	updated_at TEXT NOT NULL,
+	PRIMARY KEY (workspace_id, name)
+);
+
+ALTER TABLE tasks ADD COLUMN workspace_id TEXT;
+ALTER TABLE tasks ADD COLUMN variables TEXT;
@@ -0,0 +1,4 @@
+ALTER TABLE tasks DROP COLUMN referenced_tasks;
+
+DROP INDEX IF EXISTS idx_task_references_referenced;
+DROP TABLE IF EXISTS task_references;
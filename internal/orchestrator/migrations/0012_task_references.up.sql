@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS task_references (
+	task_id TEXT NOT NULL,
+	referenced_task_id TEXT NOT NULL,
+	PRIMARY KEY (task_id, referenced_task_id)
+);
+CREATE INDEX IF NOT EXISTS idx_task_references_referenced ON task_references (referenced_task_id);
+
+ALTER TABLE tasks ADD COLUMN referenced_tasks TEXT;
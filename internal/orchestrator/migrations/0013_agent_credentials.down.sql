@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_agent_credentials_token;
+DROP TABLE IF EXISTS agent_credentials;
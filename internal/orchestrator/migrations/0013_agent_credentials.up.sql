@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS agent_credentials (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	created_by TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	revoked_at TEXT
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_agent_credentials_token ON agent_credentials (token_hash);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_refresh_tokens_user;
+ALTER TABLE users DROP COLUMN disabled;
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,260 @@
+package orchestrator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	caCertFile     = "ca.crt"
+	caKeyFile      = "ca.key"
+	serverCertName = "server"
+
+	caValidity          = 10 * 365 * 24 * time.Hour
+	certificateValidity = 365 * 24 * time.Hour
+)
+
+// internalTLSConfig builds the TLS configuration of the internal API from
+// the orchestrator certificate and the CA bundle agent certificates are
+// verified against. It returns nil when TLS is not configured.
+func internalTLSConfig(config Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" && config.TLSClientCAFile == "" {
+		return nil, nil
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" || config.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE, TLS_KEY_FILE and TLS_CLIENT_CA_FILE must be set together")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load orchestrator certificate: %v", err)
+	}
+	clientCAs, err := loadCertPool(config.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// CACommand manages the local certificate authority that signs the
+// orchestrator and agent certificates for mutual TLS.
+func CACommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: orchestrator ca init|issue")
+	}
+
+	flags := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	dir := flags.String("dir", "./pki", "directory with the CA files")
+
+	switch args[0] {
+	case "init":
+		hosts := flags.String("hosts", "localhost,127.0.0.1", "comma-separated names and addresses of the orchestrator")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return initCA(*dir, strings.Split(*hosts, ","), out)
+	case "issue":
+		force := flags.Bool("force", false, "replace an existing certificate and key of the agent")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: orchestrator ca issue [-dir DIR] [-force] AGENT_NAME")
+		}
+		return issueAgentCertificate(*dir, flags.Arg(0), *force, out)
+	default:
+		return fmt.Errorf("unknown ca command %q, expected init or issue", args[0])
+	}
+}
+
+func initCA(dir string, hosts []string, out io.Writer) error {
+	if _, err := os.Stat(filepath.Join(dir, caKeyFile)); err == nil {
+		return fmt.Errorf("CA already exists in %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %v", err)
+	}
+	template, err := certificateTemplate("distributed-calculator CA", caValidity)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %v", err)
+	}
+	if err := writeKeyPair(dir, "ca", der, key, false); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "created %s\n", filepath.Join(dir, caCertFile))
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+	template, err = certificateTemplate(serverCertName, certificateValidity)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if err := signCertificate(dir, serverCertName, template, ca, key, false); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "created %s\n", filepath.Join(dir, serverCertName+".crt"))
+	return nil
+}
+
+func issueAgentCertificate(dir string, name string, force bool, out io.Writer) error {
+	if name == "" || name == serverCertName || name == "ca" || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid agent name %q", name)
+	}
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+	if !force {
+		for _, file := range []string{name + ".crt", name + ".key"} {
+			if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+				return fmt.Errorf("certificate for %s already exists in %s, use -force to replace it", name, dir)
+			}
+		}
+	}
+
+	template, err := certificateTemplate(name, certificateValidity)
+	if err != nil {
+		return err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if err := signCertificate(dir, name, template, ca, caKey, force); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "created %s\n", filepath.Join(dir, name+".crt"))
+	return nil
+}
+
+func certificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+func signCertificate(dir, name string, template, ca *x509.Certificate, caKey crypto.Signer, overwrite bool) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %v", err)
+	}
+	return writeKeyPair(dir, name, der, key, overwrite)
+}
+
+// writeKeyPair refuses to replace existing files unless overwrite is set.
+func writeKeyPair(dir, name string, der []byte, key *ecdsa.PrivateKey, overwrite bool) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	if err := writeFile(filepath.Join(dir, name+".crt"), certPEM, flags, 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate: %v", err)
+	}
+	if err := writeFile(filepath.Join(dir, name+".key"), keyPEM, flags, 0o600); err != nil {
+		return fmt.Errorf("failed to write key: %v", err)
+	}
+	return nil
+}
+
+func writeFile(path string, data []byte, flags int, perm os.FileMode) error {
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA from %s: %v", dir, err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA key cannot sign certificates")
+	}
+	return ca, signer, nil
+}
@@ -0,0 +1,131 @@
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCACommand(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+
+	require.NoError(t, CACommand([]string{"init", "-dir", dir}, &out))
+	assert.Contains(t, out.String(), filepath.Join(dir, "ca.crt"))
+	assert.Error(t, CACommand([]string{"init", "-dir", dir}, &out), "an existing CA is not overwritten")
+
+	require.NoError(t, CACommand([]string{"issue", "-dir", dir, "rack-1"}, &out))
+	for _, name := range []string{"ca.crt", "ca.key", "server.crt", "server.key", "rack-1.crt", "rack-1.key"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+	info, err := os.Stat(filepath.Join(dir, "rack-1.key"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	issued, err := os.ReadFile(filepath.Join(dir, "rack-1.key"))
+	require.NoError(t, err)
+	assert.Error(t, CACommand([]string{"issue", "-dir", dir, "rack-1"}, &out), "an issued certificate is not overwritten")
+	kept, err := os.ReadFile(filepath.Join(dir, "rack-1.key"))
+	require.NoError(t, err)
+	assert.Equal(t, issued, kept)
+	require.NoError(t, CACommand([]string{"issue", "-dir", dir, "-force", "rack-1"}, &out))
+	replaced, err := os.ReadFile(filepath.Join(dir, "rack-1.key"))
+	require.NoError(t, err)
+	assert.NotEqual(t, issued, replaced)
+
+	assert.Error(t, CACommand([]string{"issue", "-dir", dir}, &out))
+	assert.Error(t, CACommand([]string{"issue", "-dir", dir, "../escape"}, &out))
+	assert.Error(t, CACommand([]string{"issue", "-dir", t.TempDir(), "rack-2"}, &out), "issuing needs a CA")
+	assert.Error(t, CACommand([]string{"revoke"}, &out))
+}
+
+func mutualTLSClient(t *testing.T, dir, name string) *http.Client {
+	roots, err := loadCertPool(filepath.Join(dir, "ca.crt"))
+	require.NoError(t, err)
+	config := &tls.Config{RootCAs: roots}
+	if name != "" {
+		certificate, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		require.NoError(t, err)
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestInternalAPIOverMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	require.NoError(t, CACommand([]string{"init", "-dir", dir}, &out))
+	require.NoError(t, CACommand([]string{"issue", "-dir", dir, "rack-1"}, &out))
+
+	foreign := t.TempDir()
+	require.NoError(t, CACommand([]string{"init", "-dir", foreign}, &out))
+	require.NoError(t, CACommand([]string{"issue", "-dir", foreign, "rack-1"}, &out))
+	// Trust the orchestrator certificate but present an agent certificate
+	// signed by another CA.
+	require.NoError(t, os.Rename(filepath.Join(foreign, "rack-1.crt"), filepath.Join(dir, "impostor.crt")))
+	require.NoError(t, os.Rename(filepath.Join(foreign, "rack-1.key"), filepath.Join(dir, "impostor.key")))
+
+	server := newServer(t, func(config *Config) {
+		config.TLSCertFile = filepath.Join(dir, "server.crt")
+		config.TLSKeyFile = filepath.Join(dir, "server.key")
+		config.TLSClientCAFile = filepath.Join(dir, "ca.crt")
+	})
+
+	mux := http.NewServeMux()
+	server.registerInternalRoutes(mux)
+	internal := httptest.NewUnstartedServer(mux)
+	internal.TLS = server.internalTLS
+	internal.StartTLS()
+	t.Cleanup(internal.Close)
+	url := strings.Replace(internal.URL, "127.0.0.1", "localhost", 1)
+
+	register := func(client *http.Client, id string) (*http.Response, error) {
+		return client.Post(url+"/internal/agents/register", "application/json", strings.NewReader(`{"id":"`+id+`","workers":2}`))
+	}
+
+	resp, err := register(mutualTLSClient(t, dir, "rack-1"), "rack-1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	agents := server.agents.List()
+	require.Len(t, agents, 1)
+	assert.Equal(t, "rack-1", agents[0].ID)
+	assert.Equal(t, "rack-1", agents[0].Credential)
+
+	resp, err = register(mutualTLSClient(t, dir, "rack-1"), "rack-2")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "a certificate names exactly one agent")
+
+	req, err := http.NewRequest(http.MethodGet, url+"/internal/task", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Agent-ID", "rack-2")
+	resp, err = mutualTLSClient(t, dir, "rack-1").Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	_, err = register(mutualTLSClient(t, dir, ""), "rack-1")
+	assert.Error(t, err, "a client certificate is required")
+	_, err = register(mutualTLSClient(t, dir, "impostor"), "rack-1")
+	assert.Error(t, err, "certificates of other CAs are rejected")
+}
+
+func TestInternalTLSConfigNeedsAllFiles(t *testing.T) {
+	config := testConfig()
+	tlsConfig, err := internalTLSConfig(config)
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	config.TLSCertFile = "server.crt"
+	_, err = internalTLSConfig(config)
+	assert.ErrorContains(t, err, "must be set together")
+}
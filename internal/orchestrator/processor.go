@@ -1,48 +1,227 @@
 package orchestrator
 
 import (
+	"distributed-calculator/internal/expr"
 	"fmt"
 	"strings"
 	"time"
 )
 
 type Task struct {
-	ID         string  `json:"id"`
-	Expression string  `json:"expression"`
-	Status     string  `json:"status"`
-	Result     float64 `json:"result"`
-	UserLogin  string  `json:"user_login"`
-	CreatedAt  string  `json:"created_at"`
-	UpdatedAt  string  `json:"updated_at"`
+	ID          string             `json:"id"`
+	Expression  string             `json:"expression"`
+	Status      string             `json:"status"`
+	Result      float64            `json:"result"`
+	UserLogin   string             `json:"user_login"`
+	Failure     *Failure           `json:"failure,omitempty"`
+	CallbackURL string             `json:"callback_url,omitempty"`
+	Retries     int                `json:"retries"`
+	MaxAttempts int                `json:"max_attempts"`
+	Priority    int                `json:"priority"`
+	BatchID     string             `json:"batch_id,omitempty"`
+	Label       string             `json:"label,omitempty"`
+	WorkspaceID string             `json:"workspace_id,omitempty"`
+	Variables   map[string]float64 `json:"variables,omitempty"`
+	References  []string           `json:"references,omitempty"`
+	CreatedAt   string             `json:"created_at"`
+	UpdatedAt   string             `json:"updated_at"`
+}
+
+type Failure struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	AgentID     string `json:"agent_id,omitempty"`
+	OperationID string `json:"operation_id,omitempty"`
+	FailedAt    string `json:"failed_at"`
+}
+
+type Operation struct {
+	ID              string  `json:"id"`
+	TaskID          string  `json:"task_id"`
+	Operand1        float64 `json:"operand1"`
+	Operand2        float64 `json:"operand2"`
+	Operator        string  `json:"operator"`
+	LeftDependency  string  `json:"left_dependency,omitempty"`
+	RightDependency string  `json:"right_dependency,omitempty"`
+	IsRoot          bool    `json:"is_root,omitempty"`
+	OperationTime   int64   `json:"operation_time"`
+	Status          string  `json:"status"`
+	Result          float64 `json:"result"`
+	LeaseOwner      string  `json:"lease_owner,omitempty"`
+	LeaseExpiresAt  string  `json:"lease_expires_at,omitempty"`
+	Attempts        int     `json:"attempts,omitempty"`
+	NextAttemptAt   string  `json:"next_attempt_at,omitempty"`
+	LastError       string  `json:"last_error,omitempty"`
+	CreatedAt       string  `json:"created_at"`
+	UpdatedAt       string  `json:"updated_at"`
 }
 
+const (
+	ErrorCodeDivisionByZero   = "division_by_zero"
+	ErrorCodeParse            = "parse_error"
+	ErrorCodeTimeout          = "timeout"
+	ErrorCodeAgentLost        = "agent_lost"
+	ErrorCodeInvalidOp        = "invalid_operation"
+	ErrorCodeDependencyFailed = "dependency_failed"
+	ErrorCodeUnknown          = "unknown"
+)
+
 const (
 	StatusPending    = "Pending"
 	StatusNew        = "New"
+	StatusWaiting    = "Waiting"
 	StatusInProgress = "In Progress"
 	StatusCompleted  = "Completed"
 	StatusFailed     = "Failed"
+	StatusCancelled  = "Cancelled"
+	StatusDeadLetter = "DeadLetter"
 )
 
-func CreateTask(expression string, userLogin string) (Task, error) {
-	expression = strings.ReplaceAll(expression, " ", "")
+func CreateTask(expression string, userLogin string) (Task, []*Operation, error) {
+	return CreateTaskWithVariables(expression, userLogin, nil)
+}
+
+// CreateTaskWithVariables resolves the variables of the expression from
+// values. The values that were used are recorded on the task, so it can be
+// reproduced after the variables change.
+func CreateTaskWithVariables(expression string, userLogin string, values map[string]float64) (Task, []*Operation, error) {
+	if strings.TrimSpace(expression) == "" {
+		return Task{}, nil, fmt.Errorf("expression cannot be empty")
+	}
+
+	root, err := expr.Parse(expression)
+	if err != nil {
+		return Task{}, nil, err
+	}
 
-	if expression == "" {
-		return Task{}, fmt.Errorf("expression cannot be empty")
+	var used map[string]float64
+	for _, name := range expr.Variables(root) {
+		if value, ok := values[name]; ok {
+			if used == nil {
+				used = make(map[string]float64)
+			}
+			used[name] = value
+		}
+	}
+	if root, err = expr.Bind(expression, root, values); err != nil {
+		return Task{}, nil, err
 	}
 
 	now := time.Now().UTC()
 	timestamp := now.Format(time.RFC3339)
 
 	task := Task{
-		ID:         GenerateTaskID(),
-		Expression: expression,
-		Status:     StatusPending,
-		Result:     0,
-		UserLogin:  userLogin,
-		CreatedAt:  timestamp,
-		UpdatedAt:  timestamp,
+		ID:          GenerateTaskID(),
+		Expression:  expression,
+		Status:      StatusPending,
+		Result:      0,
+		UserLogin:   userLogin,
+		MaxAttempts: DefaultRetryPolicy.MaxAttempts,
+		Variables:   used,
+		CreatedAt:   timestamp,
+		UpdatedAt:   timestamp,
+	}
+
+	b := &operationBuilder{taskID: task.ID, timestamp: timestamp}
+	value, dependency := b.build(root)
+	if dependency == "" {
+		task.Status = StatusCompleted
+		task.Result = value
+		return task, nil, nil
+	}
+	if len(b.ops) == 0 || b.ops[len(b.ops)-1].ID != dependency {
+		// The whole expression is a reference, which still needs an
+		// operation to carry the referenced result into this task.
+		b.add(expr.OpAdd, 0, dependency, 0, "")
 	}
+	b.ops[len(b.ops)-1].IsRoot = true
 
-	return task, nil
+	// A task that refers to other tasks waits until all of them have
+	// completed before any of its operations is handed out.
+	task.References = expr.References(root)
+	if len(task.References) > 0 {
+		task.Status = StatusWaiting
+		for _, op := range b.ops {
+			op.Status = StatusWaiting
+		}
+	}
+
+	return task, b.ops, nil
+}
+
+// renameReference makes the references of task to name point at the task
+// with the given ID instead. Items of a batch use it to refer to each other
+// by label.
+func renameReference(task *Task, ops []*Operation, name string, id string) {
+	references := task.References[:0]
+	for _, ref := range task.References {
+		if ref == name {
+			ref = id
+		}
+		if !containsString(references, ref) {
+			references = append(references, ref)
+		}
+	}
+	task.References = references
+	for _, op := range ops {
+		if op.LeftDependency == name {
+			op.LeftDependency = id
+		}
+		if op.RightDependency == name {
+			op.RightDependency = id
+		}
+	}
+}
+
+type operationBuilder struct {
+	taskID    string
+	timestamp string
+	ops       []*Operation
+}
+
+// build returns either a literal value or the ID of the operation (or of the
+// referenced task) that will produce the value of node.
+func (b *operationBuilder) build(node expr.Node) (float64, string) {
+	switch n := node.(type) {
+	case *expr.Number:
+		return n.Value, ""
+	case *expr.Reference:
+		return 0, n.TaskID
+	case *expr.Unary:
+		value, dependency := b.build(n.Operand)
+		if n.Op == expr.OpAdd {
+			return value, dependency
+		}
+		if dependency == "" {
+			return -value, ""
+		}
+		return 0, b.add(expr.OpSub, 0, "", value, dependency)
+	case *expr.Binary:
+		left, leftDependency := b.build(n.Left)
+		right, rightDependency := b.build(n.Right)
+		return 0, b.add(n.Op, left, leftDependency, right, rightDependency)
+	}
+	return 0, ""
+}
+
+func (b *operationBuilder) add(operator string, left float64, leftDependency string, right float64, rightDependency string) string {
+	status := StatusPending
+	if leftDependency != "" || rightDependency != "" {
+		status = StatusWaiting
+	}
+
+	op := &Operation{
+		ID:              GenerateTaskID(),
+		TaskID:          b.taskID,
+		Operand1:        left,
+		Operand2:        right,
+		Operator:        operator,
+		LeftDependency:  leftDependency,
+		RightDependency: rightDependency,
+		Status:          status,
+		CreatedAt:       b.timestamp,
+		UpdatedAt:       b.timestamp,
+	}
+	b.ops = append(b.ops, op)
+	return op.ID
 }
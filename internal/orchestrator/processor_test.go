@@ -0,0 +1,166 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/expr"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTaskBuildsOperationGraph(t *testing.T) {
+	// Dependencies refer to other operations of the task by index, -1 is a
+	// literal operand.
+	type operation struct {
+		operator    string
+		left, right int
+		status      string
+	}
+	tests := []struct {
+		expression string
+		status     string
+		result     float64
+		operations []operation
+	}{
+		{"7", StatusCompleted, 7, nil},
+		{"-(2*3)+6", StatusPending, 0, []operation{
+			{expr.OpMul, -1, -1, StatusPending},
+			{expr.OpSub, -1, 0, StatusWaiting},
+			{expr.OpAdd, 1, -1, StatusWaiting},
+		}},
+		{"1+2", StatusPending, 0, []operation{
+			{expr.OpAdd, -1, -1, StatusPending},
+		}},
+		{"2+3*4", StatusPending, 0, []operation{
+			{expr.OpMul, -1, -1, StatusPending},
+			{expr.OpAdd, -1, 0, StatusWaiting},
+		}},
+		{"(1+2)*(3+4)", StatusPending, 0, []operation{
+			{expr.OpAdd, -1, -1, StatusPending},
+			{expr.OpAdd, -1, -1, StatusPending},
+			{expr.OpMul, 0, 1, StatusWaiting},
+		}},
+		{"1-2-3", StatusPending, 0, []operation{
+			{expr.OpSub, -1, -1, StatusPending},
+			{expr.OpSub, 0, -1, StatusWaiting},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			task, ops, err := CreateTask(tt.expression, "alice")
+			require.NoError(t, err)
+			assert.Equal(t, tt.status, task.Status)
+			assert.Equal(t, tt.result, task.Result)
+			require.Len(t, ops, len(tt.operations))
+
+			dependency := func(index int) string {
+				if index < 0 {
+					return ""
+				}
+				return ops[index].ID
+			}
+			for i, want := range tt.operations {
+				op := ops[i]
+				assert.Equal(t, task.ID, op.TaskID)
+				assert.Equal(t, want.operator, op.Operator, "operation %d", i)
+				assert.Equal(t, dependency(want.left), op.LeftDependency, "operation %d", i)
+				assert.Equal(t, dependency(want.right), op.RightDependency, "operation %d", i)
+				assert.Equal(t, want.status, op.Status, "operation %d", i)
+				assert.Equal(t, i == len(ops)-1, op.IsRoot, "operation %d", i)
+			}
+		})
+	}
+}
+
+func TestCreateTaskWaitsForReferences(t *testing.T) {
+	const referenced = "3f2a9c1e-0b4d-4e8f-9a6b-2c7d1e5f8a90"
+
+	task, ops, err := CreateTask("$"+referenced, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, StatusWaiting, task.Status)
+	assert.Equal(t, []string{referenced}, task.References)
+	require.Len(t, ops, 1)
+	assert.Equal(t, referenced, ops[0].LeftDependency)
+	assert.True(t, ops[0].IsRoot)
+	assert.Equal(t, StatusWaiting, ops[0].Status)
+
+	_, ops, err = CreateTask("ans("+referenced+")*2", "alice")
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	assert.Equal(t, referenced, ops[0].LeftDependency)
+	assert.Equal(t, 2.0, ops[0].Operand2)
+	assert.True(t, ops[0].IsRoot)
+}
+
+func TestAgentsComputeTaskThroughOperationGraph(t *testing.T) {
+	server := newServer(t, withAgentToken("shared-token"))
+	token := registerAndLogin(t, server, "alice")
+	id := calculate(t, server, token, map[string]string{"expression": "(1+2)*(3+4)-5"})
+
+	call := func(handler http.HandlerFunc, method string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/internal/task", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer shared-token")
+		r.Header.Set("X-Agent-ID", "agent-1")
+		w := httptest.NewRecorder()
+		server.agentMiddleware(handler)(w, r)
+		return w
+	}
+	apply := func(op Operation) float64 {
+		switch op.Operator {
+		case expr.OpAdd:
+			return op.Operand1 + op.Operand2
+		case expr.OpSub:
+			return op.Operand1 - op.Operand2
+		case expr.OpMul:
+			return op.Operand1 * op.Operand2
+		}
+		return op.Operand1 / op.Operand2
+	}
+
+	var rounds []int
+	for {
+		var claimed []Operation
+		for {
+			w := call(server.handleTask, http.MethodGet, "")
+			if w.Code == http.StatusNotFound {
+				break
+			}
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			var response struct {
+				Task Operation `json:"task"`
+			}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			claimed = append(claimed, response.Task)
+		}
+		if len(claimed) == 0 {
+			break
+		}
+		rounds = append(rounds, len(claimed))
+
+		for _, op := range claimed {
+			task, err := server.storage.GetTask(id)
+			require.NoError(t, err)
+			assert.NotEqual(t, StatusCompleted, task.Status, "the task finishes with its root operation")
+
+			body, err := json.Marshal(map[string]interface{}{"id": op.ID, "result": apply(op)})
+			require.NoError(t, err)
+			w := call(server.handleCompleteTask, http.MethodPost, string(body))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	assert.Equal(t, []int{2, 1, 1}, rounds, "operations are released once their dependencies complete")
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleGetExpressionByID), http.MethodGet, "/api/v1/expressions/"+id, token, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Expression Task `json:"expression"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, StatusCompleted, response.Expression.Status)
+	assert.Equal(t, 16.0, response.Expression.Result)
+}
@@ -0,0 +1,139 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// inFlightRetryAfter is suggested to users who hit the in-flight limit; unlike
+// the request rate it is not known when one of their expressions finishes.
+const inFlightRetryAfter = 5 * time.Second
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is a token bucket per key: every key may make burst requests at
+// once and then rate requests per second.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// bucket returns the bucket of key refilled up to now. The caller holds mu.
+func (l *RateLimiter) bucket(key string) *tokenBucket {
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+		return b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	return b
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// reports how long to wait for the next token.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Remaining is the number of requests key may make right now.
+func (l *RateLimiter) Remaining(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.bucket(key).tokens)
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+func (s *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userLogin, err := s.getUserFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if ok, retryAfter := s.limiter.Allow(userLogin); !ok {
+			tooManyRequests(w, retryAfter, "Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	inFlight, err := s.storage.CountActiveTasks(userLogin)
+	if err != nil {
+		log.Printf("Failed to count active tasks of %s: %v", userLogin, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		RequestsPerSecond int `json:"requests_per_second"`
+		Burst             int `json:"burst"`
+		RemainingRequests int `json:"remaining_requests"`
+		MaxInFlight       int `json:"max_in_flight"`
+		InFlight          int `json:"in_flight"`
+	}{
+		RequestsPerSecond: s.config.RateLimitRPS,
+		Burst:             s.config.RateLimitBurst,
+		RemainingRequests: s.limiter.Remaining(userLogin),
+		MaxInFlight:       s.config.MaxInFlight,
+		InFlight:          inFlight,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,73 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("alice")
+		require.True(t, ok)
+	}
+	ok, retryAfter := limiter.Allow("alice")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	ok, _ = limiter.Allow("bob")
+	assert.True(t, ok, "buckets are per user")
+
+	now = now.Add(time.Second)
+	assert.Equal(t, 2, limiter.Remaining("alice"))
+	now = now.Add(time.Hour)
+	assert.Equal(t, 3, limiter.Remaining("alice"), "bucket is capped at burst")
+}
+
+func TestRateLimitAnswersTooManyRequests(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+	server.limiter = NewRateLimiter(1, 2)
+	handler := server.authMiddleware(server.rateLimit(server.handleCalculate))
+
+	for i := 0; i < 2; i++ {
+		w := authorizedRequest(t, handler, http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": "1+2"})
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+	w := authorizedRequest(t, handler, http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": "1+2"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestMaxInFlightExpressions(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+	server.config.MaxInFlight = 2
+
+	calculate(t, server, token, map[string]string{"expression": "1+2"})
+	calculate(t, server, token, map[string]string{"expression": "3"})
+	calculate(t, server, token, map[string]string{"expression": "3+4"})
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": "5+6"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleQuota), http.MethodGet, "/api/v1/me/quota", token, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var quota struct {
+		MaxInFlight int `json:"max_in_flight"`
+		InFlight    int `json:"in_flight"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&quota))
+	assert.Equal(t, 2, quota.MaxInFlight)
+	assert.Equal(t, 2, quota.InFlight)
+
+	finishTask(t, server)
+	calculate(t, server, token, map[string]string{"expression": "5+6"})
+}
@@ -0,0 +1,143 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// referenceFailure is recorded on a task whose referenced task ended with
+// status instead of a result. An empty status means the task is gone.
+func referenceFailure(taskID string, status string) Failure {
+	reason := "does not exist"
+	switch status {
+	case StatusFailed:
+		reason = "failed"
+	case StatusCancelled:
+		reason = "was cancelled"
+	case StatusDeadLetter:
+		reason = "ran out of attempts"
+	}
+	return Failure{
+		Code:    ErrorCodeDependencyFailed,
+		Message: fmt.Sprintf("referenced task %s %s", taskID, reason),
+	}
+}
+
+// checkReferences validates the references of tasks that are about to be
+// stored together and returns an error for each task that cannot be
+// accepted. A task may refer to another one of tasks as long as the
+// references do not form a cycle; any other reference has to name a task of
+// the user that can still produce a result. A task that refers to a rejected
+// one is rejected as well.
+func (s *Server) checkReferences(userLogin string, tasks []*Task) ([]error, error) {
+	errs := make([]error, len(tasks))
+	index := make(map[string]int, len(tasks))
+	for i, task := range tasks {
+		index[task.ID] = i
+	}
+
+	existing := make(map[string]*Task)
+	for i, task := range tasks {
+		for _, ref := range task.References {
+			if _, ok := index[ref]; ok {
+				continue
+			}
+			referenced, ok := existing[ref]
+			if !ok {
+				var err error
+				if referenced, err = s.storage.GetTaskByID(ref, userLogin); err != nil {
+					return nil, err
+				}
+				existing[ref] = referenced
+			}
+			if referenced == nil {
+				errs[i] = fmt.Errorf("referenced task %s not found", ref)
+				break
+			}
+			if referenced.Status != StatusCompleted && isFinalStatus(referenced.Status) {
+				errs[i] = fmt.Errorf("referenced task %s has status %s", ref, referenced.Status)
+				break
+			}
+		}
+	}
+
+	// Stored tasks can only refer to tasks older than themselves, so a cycle
+	// has to run through the new tasks alone.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(tasks))
+	var path []int
+	var visit func(i int)
+	visit = func(i int) {
+		state[i] = visiting
+		path = append(path, i)
+		for _, ref := range tasks[i].References {
+			j, ok := index[ref]
+			if !ok {
+				continue
+			}
+			switch state[j] {
+			case unvisited:
+				visit(j)
+			case visiting:
+				var start int
+				for start = len(path) - 1; path[start] != j; start-- {
+				}
+				cycle := path[start:]
+				names := make([]string, 0, len(cycle)+1)
+				for _, k := range cycle {
+					names = append(names, taskName(tasks[k]))
+				}
+				names = append(names, taskName(tasks[j]))
+				for _, k := range cycle {
+					if errs[k] == nil {
+						errs[k] = fmt.Errorf("circular reference: %s", strings.Join(names, " -> "))
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+	}
+	for i := range tasks {
+		if state[i] == unvisited {
+			visit(i)
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i, task := range tasks {
+			if errs[i] != nil {
+				continue
+			}
+			for _, ref := range task.References {
+				if j, ok := index[ref]; ok && errs[j] != nil {
+					errs[i] = fmt.Errorf("referenced expression %s is invalid", taskName(tasks[j]))
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return errs, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func taskName(task *Task) string {
+	if task.Label != "" {
+		return task.Label
+	}
+	return task.ID
+}
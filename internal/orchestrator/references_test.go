@@ -0,0 +1,66 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateRejectsInvalidReferences(t *testing.T) {
+	server, token := newWebhookServer(t, 1)
+	bob := registerAndLogin(t, server, "bob")
+	bobsTask := calculate(t, server, bob, map[string]string{"expression": "1+2"})
+
+	for _, expression := range []string{"$missing * 2", "ans(" + bobsTask + ") + 1"} {
+		w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": expression})
+		assert.Equal(t, http.StatusBadRequest, w.Code, expression)
+		assert.Contains(t, w.Body.String(), "not found")
+	}
+
+	failed := calculate(t, server, token, map[string]string{"expression": "1+2"})
+	require.NoError(t, server.storage.CancelTask(failed, "alice"))
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": "$" + failed + " * 2"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "has status Cancelled")
+
+	id := calculate(t, server, token, map[string]string{"expression": "1+2"})
+	chained := calculate(t, server, token, map[string]string{"expression": "$" + id + " * 2"})
+	task, err := server.storage.GetTaskByID(chained, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, StatusWaiting, task.Status)
+	assert.Equal(t, []string{id}, task.References)
+}
+
+func TestBatchReferencesByLabelAndDetectsCycles(t *testing.T) {
+	server, token := newWebhookServer(t, 1)
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculateBatch), http.MethodPost, "/api/v1/calculate/batch", token, map[string]interface{}{
+		"expressions": []map[string]string{
+			{"expression": "$b + 1", "label": "a"},
+			{"expression": "$a * 2", "label": "b"},
+			{"expression": "2+2", "label": "c"},
+			{"expression": "$c * $a", "label": "d"},
+			{"expression": "ans(c) - 1", "label": "e"},
+		},
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var response struct {
+		Items []batchItemResult `json:"items"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Len(t, response.Items, 5)
+	assert.Equal(t, "Invalid reference: circular reference: a -> b -> a", response.Items[0].Error)
+	assert.Equal(t, "Invalid reference: circular reference: a -> b -> a", response.Items[1].Error)
+	assert.Empty(t, response.Items[2].Error)
+	assert.Equal(t, "Invalid reference: referenced expression a is invalid", response.Items[3].Error)
+	assert.Empty(t, response.Items[4].Error)
+
+	task, err := server.storage.GetTaskByID(response.Items[4].ID, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{response.Items[2].ID}, task.References)
+	assert.Equal(t, StatusWaiting, task.Status)
+}
@@ -0,0 +1,92 @@
+package orchestrator
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AgentAlive = "alive"
+	AgentDead  = "dead"
+)
+
+type AgentInfo struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname"`
+	Workers      int       `json:"workers"`
+	Version      string    `json:"version"`
+	Credential   string    `json:"credential,omitempty"`
+	Status       string    `json:"status"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+type AgentRegistry struct {
+	agents map[string]*AgentInfo
+	mu     sync.RWMutex
+}
+
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{
+		agents: make(map[string]*AgentInfo),
+	}
+}
+
+func (r *AgentRegistry) Register(info AgentInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	info.Status = AgentAlive
+	info.RegisteredAt = now
+	info.LastSeen = now
+	r.agents[info.ID] = &info
+}
+
+// Heartbeat records that the agent is alive. It returns false for agents the
+// registry does not know about, e.g. after an orchestrator restart, so they
+// can register again.
+func (r *AgentRegistry) Heartbeat(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, ok := r.agents[id]
+	if !ok {
+		return false
+	}
+	agent.Status = AgentAlive
+	agent.LastSeen = time.Now().UTC()
+	return true
+}
+
+func (r *AgentRegistry) List() []AgentInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	agents := make([]AgentInfo, 0, len(r.agents))
+	for _, agent := range r.agents {
+		agents = append(agents, *agent)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].RegisteredAt.Before(agents[j].RegisteredAt)
+	})
+	return agents
+}
+
+// MarkDead flags every live agent that has not been seen within timeout and
+// returns their IDs.
+func (r *AgentRegistry) MarkDead(timeout time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deadline := time.Now().UTC().Add(-timeout)
+	var dead []string
+	for _, agent := range r.agents {
+		if agent.Status == AgentAlive && agent.LastSeen.Before(deadline) {
+			agent.Status = AgentDead
+			dead = append(dead, agent.ID)
+		}
+	}
+	return dead
+}
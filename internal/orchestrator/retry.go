@@ -0,0 +1,150 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrTaskNotDeadLetter = errors.New("task is not in the dead-letter state")
+
+// RetryPolicy decides what happens to an operation that failed for a
+// transient reason: it goes back to the queue after a growing delay until the
+// task runs out of attempts.
+type RetryPolicy struct {
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BackoffBase: time.Second,
+	BackoffMax:  time.Minute,
+}
+
+// Backoff is the delay before the next attempt after attempts failed ones.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	delay := exponentialBackoff(p.BackoffBase, attempts)
+	if p.BackoffMax > 0 && delay > p.BackoffMax {
+		return p.BackoffMax
+	}
+	return delay
+}
+
+// exponentialBackoff returns base, 2*base, 4*base and so on for the first,
+// second and third failed attempt.
+func exponentialBackoff(base time.Duration, attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 20 {
+		attempts = 20
+	}
+	return base << (attempts - 1)
+}
+
+// IsRetryable reports whether an operation that failed with code may succeed
+// when computed again. Errors that follow from the operands themselves, such
+// as division by zero, never are.
+func IsRetryable(code string) bool {
+	switch code {
+	case ErrorCodeDivisionByZero, ErrorCodeInvalidOp, ErrorCodeParse:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasks, err := s.storage.ListTasksByStatus(StatusDeadLetter)
+	if err != nil {
+		log.Printf("Failed to list dead-letter tasks: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*Task{"tasks": tasks})
+}
+
+func (s *Server) handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/dead-letter/")
+	if id, ok := strings.CutSuffix(path, "/requeue"); ok {
+		s.handleRequeueDeadLetter(w, r, id)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, err := s.storage.GetTask(path)
+	if err != nil {
+		log.Printf("Failed to get task %s: %v", path, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if task == nil || task.Status != StatusDeadLetter {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	ops, err := s.storage.GetTaskOperations(task.ID)
+	if err != nil {
+		log.Printf("Failed to get operations of task %s: %v", task.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Task       *Task        `json:"task"`
+		Operations []*Operation `json:"operations"`
+	}{
+		Task:       task,
+		Operations: ops,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleRequeueDeadLetter(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := s.storage.RequeueTask(id)
+	if err == ErrTaskNotFound {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err == ErrTaskNotDeadLetter {
+		http.Error(w, "Task is not in the dead-letter state", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to requeue task %s: %v", id, err)
+		http.Error(w, "Failed to requeue task", http.StatusInternalServerError)
+		return
+	}
+
+	task, err := s.storage.GetTask(id)
+	if err != nil || task == nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]*Task{"task": task})
+}
@@ -0,0 +1,247 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Roles are ordered: an operator can do everything a user can and an admin
+// everything an operator can.
+const (
+	RoleUser     = "user"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{RoleUser: 0, RoleOperator: 1, RoleAdmin: 2}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// hasRole reports whether role grants the permissions of required.
+func hasRole(role string, required string) bool {
+	return validRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+func claimsRole(claims jwt.MapClaims) string {
+	if role, _ := claims["role"].(string); validRole(role) {
+		return role
+	}
+	return RoleUser
+}
+
+// bootstrapAdmins gives the admin role to the users listed in ADMIN_LOGINS
+// that already exist. Users registering later under these logins become
+// admins on registration.
+func bootstrapAdmins(users UserStorage, logins []string) error {
+	for _, login := range logins {
+		user, err := users.GetUser(login)
+		if err == ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if user.Role == RoleAdmin {
+			continue
+		}
+		user.Role = RoleAdmin
+		if err := users.UpdateUser(user); err != nil {
+			return err
+		}
+		log.Printf("User %s is an admin from ADMIN_LOGINS", user.Login)
+	}
+	return nil
+}
+
+// requireRole lets only users with at least the given role through to next.
+// The role is taken from the access token, so a changed role applies once
+// the user gets a new token.
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if !hasRole(s.getRoleFromRequest(r), role) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// getRoleFromRequest returns the role authMiddleware read from the access
+// token, or an empty role for requests that did not pass it.
+func (s *Server) getRoleFromRequest(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey{}).(authenticatedUser)
+	return user.Role
+}
+
+type userView struct {
+	Login     string `json:"login"`
+	Role      string `json:"role"`
+	Disabled  bool   `json:"disabled"`
+	CreatedAt string `json:"created_at"`
+}
+
+func newUserView(user *User) userView {
+	return userView{
+		Login:     user.Login,
+		Role:      user.Role,
+		Disabled:  user.Disabled,
+		CreatedAt: user.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	users, err := s.userStorage.ListUsers()
+	if err != nil {
+		log.Printf("Failed to list users: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	views := make([]userView, 0, len(users))
+	for _, user := range users {
+		views = append(views, newUserView(user))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]userView{"users": views})
+}
+
+// handleUpdateUser changes the role of a user or disables the account.
+// Disabling also ends every session of the user.
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Role != nil && !validRole(*req.Role) {
+		http.Error(w, fmt.Sprintf("Unknown role %q, expected user, operator or admin", *req.Role), http.StatusBadRequest)
+		return
+	}
+
+	login := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/users/")
+	user, err := s.userStorage.GetUser(login)
+	if err == ErrUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", login, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if strings.EqualFold(user.Login, adminLogin) {
+		http.Error(w, "Admins cannot change their own account", http.StatusBadRequest)
+		return
+	}
+
+	if req.Role != nil {
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if err := s.userStorage.UpdateUser(user); err != nil {
+		log.Printf("Failed to update user %s: %v", user.Login, err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	if user.Disabled {
+		if err := s.sessions.RevokeUserRefreshTokens(user.Login, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			log.Printf("Failed to revoke sessions of %s: %v", user.Login, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("User %s updated by %s: role %s, disabled %v", user.Login, adminLogin, user.Role, user.Disabled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newUserView(user))
+}
+
+// handleListAllExpressions lists the expressions of every user, or of the
+// one given by the user parameter, with the filters of GET
+// /api/v1/expressions.
+func (s *Server) handleListAllExpressions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parseTaskQuery(r.URL.Query().Get("user"), r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	s.writeTaskPage(ctx, w, query)
+}
+
+// handleGetAnyExpression returns any user's expression together with its
+// operations.
+func (s *Server) handleGetAnyExpression(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/expressions/")
+	task, err := s.storage.GetTask(id)
+	if err != nil {
+		log.Printf("Failed to get task %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if task == nil {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+
+	ops, err := s.storage.GetTaskOperations(task.ID)
+	if err != nil {
+		log.Printf("Failed to get operations of task %s: %v", task.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Task       *Task        `json:"task"`
+		Operations []*Operation `json:"operations"`
+	}{
+		Task:       task,
+		Operations: ops,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
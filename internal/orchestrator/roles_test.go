@@ -0,0 +1,128 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRolesGuardAdminEndpoints(t *testing.T) {
+	server := newServer(t, withAdmins("root"))
+	admin := registerAndLogin(t, server, "root")
+	alice := registerAndLogin(t, server, "alice")
+	bob := login(t, server, "bob")
+	aliceTask := calculate(t, server, alice, map[string]string{"expression": "1+2"})
+
+	listAll := server.requireRole(RoleOperator, server.handleListAllExpressions)
+	getAny := server.requireRole(RoleAdmin, server.handleGetAnyExpression)
+	updateUser := server.requireRole(RoleAdmin, server.handleUpdateUser)
+
+	assert.Equal(t, http.StatusForbidden, authorizedRequest(t, listAll, http.MethodGet, "/api/v1/admin/expressions", bob.Token, nil).Code)
+
+	w := authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/bob", admin, map[string]string{"role": RoleOperator})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `"operator"`, mustField(t, w.Body.Bytes(), "role"))
+
+	// The new role arrives with the next token.
+	code, operator := refresh(t, server, bob.RefreshToken)
+	require.Equal(t, http.StatusOK, code)
+
+	w = authorizedRequest(t, listAll, http.MethodGet, "/api/v1/admin/expressions?user=alice", operator.Token, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), aliceTask)
+	assert.Equal(t, http.StatusForbidden, authorizedRequest(t, getAny, http.MethodGet, "/api/v1/admin/expressions/"+aliceTask, operator.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/alice", operator.Token, map[string]bool{"disabled": true}).Code)
+
+	w = authorizedRequest(t, getAny, http.MethodGet, "/api/v1/admin/expressions/"+aliceTask, admin, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"user_login":"alice"`)
+	assert.Equal(t, http.StatusNotFound, authorizedRequest(t, getAny, http.MethodGet, "/api/v1/admin/expressions/missing", admin, nil).Code)
+
+	w = authorizedRequest(t, server.requireRole(RoleAdmin, server.handleListUsers), http.MethodGet, "/api/v1/admin/users", admin, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var users struct {
+		Users []userView `json:"users"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&users))
+	roles := make(map[string]string)
+	for _, user := range users.Users {
+		roles[user.Login] = user.Role
+	}
+	assert.Equal(t, map[string]string{"alice": RoleUser, "bob": RoleOperator, "root": RoleAdmin}, roles)
+	assert.NotContains(t, w.Body.String(), "password")
+}
+
+func TestDisabledUserIsLockedOut(t *testing.T) {
+	server := newServer(t, withAdmins("root"))
+	admin := registerAndLogin(t, server, "root")
+	alice := login(t, server, "alice")
+	protected := server.authMiddleware(server.handleQuota)
+	updateUser := server.requireRole(RoleAdmin, server.handleUpdateUser)
+
+	w := authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/alice", admin, map[string]bool{"disabled": true})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, protected, http.MethodGet, "/api/v1/me/quota", alice.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, postCredentials(t, server.handleLogin, "alice", "secret").Code)
+	code, _ := refresh(t, server, alice.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	w = authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/alice", admin, map[string]bool{"disabled": false})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusOK, postCredentials(t, server.handleLogin, "alice", "secret").Code)
+}
+
+func TestUpdateUserValidation(t *testing.T) {
+	server := newServer(t, withAdmins("root"))
+	admin := registerAndLogin(t, server, "root")
+	registerAndLogin(t, server, "alice")
+	updateUser := server.requireRole(RoleAdmin, server.handleUpdateUser)
+
+	w := authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/alice", admin, map[string]string{"role": "superuser"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/root", admin, map[string]bool{"disabled": true})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "admins cannot lock themselves out")
+	w = authorizedRequest(t, updateUser, http.MethodPatch, "/api/v1/admin/users/nobody", admin, map[string]string{"role": RoleUser})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminLoginsPromoteExistingUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+	server := newServer(t, withDatabase(path))
+	require.Equal(t, http.StatusOK, postCredentials(t, server.handleRegister, "Carol", "secret").Code)
+	require.NoError(t, server.Close())
+
+	server = newServer(t, withDatabase(path), withAdmins("carol"))
+
+	user, err := server.userStorage.GetUser("carol")
+	require.NoError(t, err)
+	assert.Equal(t, RoleAdmin, user.Role)
+}
+
+func TestHandlersTakeUserFromAuthMiddleware(t *testing.T) {
+	server := newServer(t, withAdmins("root"))
+	admin := registerAndLogin(t, server, "root")
+
+	w := authorizedRequest(t, server.handleCalculate, http.MethodPost, "/api/v1/calculate", admin, map[string]string{"expression": "1+2"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the token is only read by authMiddleware")
+	w = authorizedRequest(t, server.requireRole(RoleAdmin, server.handleListUsers), http.MethodGet, "/api/v1/admin/users", admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	user, err := server.userStorage.GetUser("root")
+	require.NoError(t, err)
+	user.Role = RoleUser
+	require.NoError(t, server.userStorage.UpdateUser(user))
+	w = authorizedRequest(t, server.requireRole(RoleAdmin, server.handleListUsers), http.MethodGet, "/api/v1/admin/users", admin, nil)
+	assert.Equal(t, http.StatusOK, w.Code, "the role of the token applies until it is renewed")
+}
+
+func mustField(t *testing.T, data []byte, name string) string {
+	t.Helper()
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &fields))
+	return string(fields[name])
+}
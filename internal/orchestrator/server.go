@@ -2,60 +2,165 @@ package orchestrator
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/Knetic/govaluate"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Server struct {
-	storage     *SQLiteStorage
-	secretKey   []byte
+	config      Config
+	storage     TaskStore
+	keys        *Keyring
 	userStorage UserStorage
+	agents      *AgentRegistry
+	broker      *Broker
+	limiter     *RateLimiter
+
+	webhooks      WebhookStore
+	webhookClient *http.Client
+	idempotency   IdempotencyStore
+	workspaces    WorkspaceStore
+
+	agentCredentials AgentCredentialStore
+	internalTLS      *tls.Config
+	sessions         SessionStore
 }
 
 func NewServer() (*Server, error) {
-	storage, err := NewSQLiteStorage()
+	return NewServerWithConfig(LoadConfig())
+}
+
+func NewServerWithConfig(config Config) (*Server, error) {
+	internalTLS, err := internalTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadKeyring(config)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := OpenBackend(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create storage: %v", err)
 	}
+	if err := bootstrapAdmins(storage, config.AdminLogins); err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to bootstrap admins: %v", err)
+	}
 
+	broker := NewBroker()
 	return &Server{
-		storage:     storage,
-		secretKey:   []byte("your-secret-key"),
-		userStorage: NewUserStorage(),
+		config:      config,
+		storage:     &publishingStore{Backend: storage, broker: broker},
+		keys:        keys,
+		userStorage: storage,
+		agents:      NewAgentRegistry(),
+		broker:      broker,
+		limiter:     NewRateLimiter(float64(config.RateLimitRPS), config.RateLimitBurst),
+
+		webhooks:    storage,
+		idempotency: storage,
+		workspaces:  storage,
+
+		agentCredentials: storage,
+		internalTLS:      internalTLS,
+		sessions:         storage,
+		webhookClient:    newWebhookClient(config),
 	}, nil
 }
 
+func (s *Server) Close() error {
+	return s.storage.Close()
+}
+
 func (s *Server) Start() {
 	http.HandleFunc("/api/v1/register", s.handleRegister)
 	http.HandleFunc("/api/v1/login", s.handleLogin)
+	http.HandleFunc("/api/v1/token/refresh", s.handleRefreshToken)
+	http.HandleFunc("/api/v1/logout", s.handleLogout)
+	http.HandleFunc("/.well-known/jwks.json", s.handleJWKS)
+
+	// Replays of a finished request are answered before the rate limit, so
+	// retrying with the same Idempotency-Key does not use up the quota.
+	http.HandleFunc("/api/v1/calculate", s.authMiddleware(s.idempotent(s.rateLimit(s.handleCalculate))))
+	http.HandleFunc("/api/v1/calculate/batch", s.authMiddleware(s.idempotent(s.rateLimit(s.handleCalculateBatch))))
+	http.HandleFunc("/api/v1/batches/", s.authMiddleware(s.rateLimit(s.handleGetBatch)))
+	http.HandleFunc("/api/v1/expressions", s.authMiddleware(s.rateLimit(s.handleGetExpressions)))
+	http.HandleFunc("/api/v1/expressions/", s.authMiddleware(s.rateLimit(s.handleExpression)))
+
+	http.HandleFunc("/api/v1/webhooks", s.authMiddleware(s.rateLimit(s.handleWebhooks)))
+	http.HandleFunc("/api/v1/webhooks/", s.authMiddleware(s.rateLimit(s.handleWebhook)))
 
-	http.HandleFunc("/api/v1/calculate", s.authMiddleware(s.handleCalculate))
-	http.HandleFunc("/api/v1/expressions", s.authMiddleware(s.handleGetExpressions))
-	http.HandleFunc("/api/v1/expressions/", s.authMiddleware(s.handleGetExpressionByID))
+	http.HandleFunc("/api/v1/workspaces", s.authMiddleware(s.rateLimit(s.handleWorkspaces)))
+	http.HandleFunc("/api/v1/workspaces/", s.authMiddleware(s.rateLimit(s.handleWorkspace)))
 
-	http.HandleFunc("/internal/task", s.handleGetTask)
-	http.HandleFunc("/internal/task/", s.handleUpdateTask)
-	http.HandleFunc("/internal/task/result", s.handlePostTaskResult)
-	http.HandleFunc("/internal/task/status", s.handlePostTaskStatus)
-	http.HandleFunc("/internal/task/complete", s.handleCompleteTask)
-	http.HandleFunc("/internal/task/fail", s.handleFailTask)
+	http.HandleFunc("/api/v1/me/quota", s.authMiddleware(s.handleQuota))
+
+	http.HandleFunc("/api/v1/admin/agents", s.requireRole(RoleOperator, s.handleListAgents))
+	http.HandleFunc("/api/v1/admin/expressions", s.requireRole(RoleOperator, s.handleListAllExpressions))
+	http.HandleFunc("/api/v1/admin/expressions/", s.requireRole(RoleAdmin, s.handleGetAnyExpression))
+	http.HandleFunc("/api/v1/admin/users", s.requireRole(RoleAdmin, s.handleListUsers))
+	http.HandleFunc("/api/v1/admin/users/", s.requireRole(RoleAdmin, s.handleUpdateUser))
+	http.HandleFunc("/api/v1/admin/dead-letter", s.requireRole(RoleAdmin, s.handleListDeadLetters))
+	http.HandleFunc("/api/v1/admin/dead-letter/", s.requireRole(RoleAdmin, s.handleDeadLetter))
+
+	http.HandleFunc("/api/v1/admin/agent-credentials", s.requireRole(RoleAdmin, s.handleAgentCredentials))
+	http.HandleFunc("/api/v1/admin/agent-credentials/", s.requireRole(RoleAdmin, s.handleAgentCredential))
+
+	if s.internalTLS == nil {
+		s.registerInternalRoutes(http.DefaultServeMux)
+	} else {
+		go s.serveInternalTLS()
+	}
+
+	go s.reapExpiredLeases()
+	go s.monitorAgents()
+	go s.deliverWebhooks()
+	go s.purgeIdempotencyKeys()
+	go s.purgeExpiredTokens()
 
 	log.Println("Server started on port 8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
+func (s *Server) registerInternalRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/internal/agents/register", s.agentMiddleware(s.handleRegisterAgent))
+	mux.HandleFunc("/internal/agents/heartbeat", s.agentMiddleware(s.handleAgentHeartbeat))
+	mux.HandleFunc("/internal/task", s.agentMiddleware(s.handleTask))
+	mux.HandleFunc("/internal/task/", s.agentMiddleware(s.handleUpdateTask))
+	mux.HandleFunc("/internal/task/result", s.agentMiddleware(s.handlePostTaskResult))
+	mux.HandleFunc("/internal/task/status", s.agentMiddleware(s.handlePostTaskStatus))
+	mux.HandleFunc("/internal/task/complete", s.agentMiddleware(s.handleCompleteTask))
+	mux.HandleFunc("/internal/task/fail", s.agentMiddleware(s.handleFailTask))
+}
+
+// serveInternalTLS serves the internal API to agents with verified client
+// certificates.
+func (s *Server) serveInternalTLS() {
+	mux := http.NewServeMux()
+	s.registerInternalRoutes(mux)
+
+	server := &http.Server{
+		Addr:      s.config.InternalAddress,
+		Handler:   mux,
+		TLSConfig: s.internalTLS,
+	}
+	log.Printf("Internal API started with mutual TLS on %s", s.config.InternalAddress)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
 func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
+		authHeader := authorizationHeader(r)
 		if authHeader == "" {
 			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
 			return
@@ -67,19 +172,15 @@ func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return s.secretKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := s.accessClaims(tokenString)
+		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		next(w, r)
+		login, _ := claims["sub"].(string)
+		user := authenticatedUser{Login: login, Role: claimsRole(claims)}
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
 	}
 }
 
@@ -102,6 +203,10 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if _, err := s.userStorage.GetUser(req.Login); err == nil {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
+	} else if err != ErrUserNotFound {
+		log.Printf("Failed to look up user %s: %v", req.Login, err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
@@ -113,10 +218,18 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	user := &User{
 		Login:        req.Login,
 		PasswordHash: string(hashedPassword),
+		Role:         RoleUser,
 		CreatedAt:    time.Now(),
 	}
+	if s.config.IsAdmin(req.Login) {
+		user.Role = RoleAdmin
+	}
 
-	if err := s.userStorage.CreateUser(user); err != nil {
+	if err := s.userStorage.CreateUser(user); err == ErrUserExists {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to create user %s: %v", req.Login, err)
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
@@ -151,26 +264,31 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if user.Disabled {
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.Login,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	tokenString, err := token.SignedString(s.secretKey)
+	refreshToken, secret, err := s.newRefreshToken(user.Login, uuid.New().String())
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
-
-	response := struct {
-		Token string `json:"token"`
-	}{
-		Token: tokenString,
+	if err := s.sessions.CreateRefreshToken(refreshToken, hashToken(secret)); err != nil {
+		log.Printf("Failed to save refresh token of %s: %v", user.Login, err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	s.issueSession(w, user, refreshToken.FamilyID, secret)
+}
+
+func (s *Server) handleTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.handleGetTask(w, r)
+		return
+	}
+	s.handleUpdateTask(w, r)
 }
 
 func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
@@ -180,10 +298,11 @@ func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result,omitempty"`
-		Status string  `json:"status,omitempty"`
-		Error  string  `json:"error,omitempty"`
+		ID        string  `json:"id"`
+		Result    float64 `json:"result,omitempty"`
+		Status    string  `json:"status,omitempty"`
+		Error     string  `json:"error,omitempty"`
+		ErrorCode string  `json:"error_code,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -191,29 +310,56 @@ func (s *Server) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := s.storage.GetTaskByID(req.ID, "")
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	switch req.Status {
+	case StatusCompleted:
+		s.completeOperation(w, r, req.ID, req.Result)
+	case StatusFailed:
+		s.failOperation(w, r, req.ID, req.ErrorCode, req.Error)
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported status: %s", req.Status), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) completeOperation(w http.ResponseWriter, r *http.Request, id string, result float64) {
+	err := s.storage.CompleteOperation(id, agentID(r), result)
+	if err == ErrOperationCancelled {
+		http.Error(w, "Task cancelled", http.StatusConflict)
 		return
 	}
-	if task == nil {
+	if err == ErrOperationNotFound {
 		http.Error(w, "Task not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		log.Printf("Failed to complete operation %s: %v", id, err)
+		http.Error(w, "Failed to update task", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
 
-	if req.Result != 0 {
-		task.Result = req.Result
+func (s *Server) failOperation(w http.ResponseWriter, r *http.Request, id string, code string, reason string) {
+	if code == "" {
+		code = ErrorCodeUnknown
 	}
-	if req.Status != "" {
-		task.Status = req.Status
+	failure := Failure{Code: code, Message: reason}
+	err := s.storage.FailOperation(id, agentID(r), failure)
+	if err == ErrOperationCancelled {
+		http.Error(w, "Task cancelled", http.StatusConflict)
+		return
 	}
-	task.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-
-	if err := s.storage.UpdateTask(task); err != nil {
+	if err == ErrOperationNotFound {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fail operation %s: %v", id, err)
 		http.Error(w, "Failed to update task", http.StatusInternalServerError)
 		return
 	}
 
+	log.Printf("Operation %s failed (%s): %s", id, code, reason)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -230,30 +376,68 @@ func (s *Server) handleCalculate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Expression string `json:"expression"`
+		Expression  string `json:"expression"`
+		CallbackURL string `json:"callback_url"`
+		Priority    int    `json:"priority"`
+		WorkspaceID string `json:"workspace_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
+	priority, err := s.taskPriority(s.getRoleFromRequest(r), req.Priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.CallbackURL != "" {
+		if s.config.WebhookSecret == "" {
+			http.Error(w, "callback_url is not supported: WEBHOOK_SECRET is not configured", http.StatusBadRequest)
+			return
+		}
+		if err := s.validateWebhookURL(req.CallbackURL); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid callback_url: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.admitExpressions(w, userLogin, 1) {
+		return
+	}
+
+	variables, err := s.workspaceVariables(req.WorkspaceID, userLogin)
+	if err == ErrWorkspaceNotFound {
+		http.Error(w, "Workspace not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load workspace %s: %v", req.WorkspaceID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-	result, err := evaluateExpression(req.Expression)
+	task, ops, err := CreateTaskWithVariables(req.Expression, userLogin, variables)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Calculation error: %v", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid expression: %v", err), http.StatusBadRequest)
 		return
 	}
+	task.WorkspaceID = req.WorkspaceID
+	task.CallbackURL = req.CallbackURL
+	task.MaxAttempts = s.config.RetryPolicy.MaxAttempts
+	task.Priority = priority
 
-	task := Task{
-		ID:         GenerateTaskID(),
-		Expression: req.Expression,
-		Status:     StatusCompleted,
-		Result:     result,
-		UserLogin:  userLogin,
-		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
-		UpdatedAt:  time.Now().UTC().Format(time.RFC3339),
+	errs, err := s.checkReferences(userLogin, []*Task{&task})
+	if err != nil {
+		log.Printf("Failed to check references of %q: %v", req.Expression, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if errs[0] != nil {
+		http.Error(w, fmt.Sprintf("Invalid reference: %v", errs[0]), http.StatusBadRequest)
+		return
 	}
 
-	if err := s.storage.AddTask(&task); err != nil {
+	if err := s.storage.AddTaskWithOperations(&task, ops); err != nil {
 		http.Error(w, "Failed to save task", http.StatusInternalServerError)
 		return
 	}
@@ -267,49 +451,77 @@ func (s *Server) handleCalculate(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func evaluateExpression(expr string) (float64, error) {
-	expr = strings.ReplaceAll(expr, " ", "")
-
-	if len(expr) == 0 {
-		return 0, fmt.Errorf("empty expression")
+// taskPriority validates the requested priority and lowers it to the maximum
+// allowed for the role.
+func (s *Server) taskPriority(role string, requested int) (int, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("Priority cannot be negative")
 	}
+	if limit := s.config.MaxPriority(role); requested > limit {
+		return limit, nil
+	}
+	return requested, nil
+}
 
-	expression, err := govaluate.NewEvaluableExpression(expr)
+// admitExpressions answers 429 and returns false when n more expressions
+// would take userLogin over the in-flight limit.
+func (s *Server) admitExpressions(w http.ResponseWriter, userLogin string, n int) bool {
+	inFlight, err := s.storage.CountActiveTasks(userLogin)
 	if err != nil {
-		return 0, fmt.Errorf("invalid expression: %v", err)
+		log.Printf("Failed to count active tasks of %s: %v", userLogin, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
 	}
+	if inFlight+n > s.config.MaxInFlight {
+		tooManyRequests(w, inFlightRetryAfter, "Too many expressions in progress")
+		return false
+	}
+	return true
+}
 
-	result, err := expression.Evaluate(nil)
-	if err != nil {
-		return 0, fmt.Errorf("calculation error: %v", err)
+// authorizationHeader returns the Authorization header. Browsers cannot set
+// headers on EventSource and WebSocket requests, so for those streams the
+// access_token query parameter is accepted in its place. Anywhere else a
+// token in the URL would only end up in logs.
+func authorizationHeader(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return header
+	}
+	if !isStreamRequest(r) {
+		return ""
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return "Bearer " + token
 	}
+	return ""
+}
 
-	switch v := result.(type) {
-	case float64:
-		return v, nil
-	case int:
-		return float64(v), nil
-	default:
-		return 0, fmt.Errorf("unexpected result type")
+func isStreamRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/api/v1/expressions/") {
+		return false
 	}
+	return strings.HasSuffix(r.URL.Path, "/events") || strings.HasSuffix(r.URL.Path, "/ws")
 }
 
-func (s *Server) getUserFromRequest(r *http.Request) (string, error) {
-	authHeader := r.Header.Get("Authorization")
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(authorizationHeader(r), "Bearer ")
+}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return s.secretKey, nil
-	})
-	if err != nil {
-		return "", err
-	}
+// authenticatedUser is the user of a request that passed authMiddleware, as
+// named by the access token.
+type authenticatedUser struct {
+	Login string
+	Role  string
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims["sub"].(string), nil
-	}
+type userContextKey struct{}
 
-	return "", fmt.Errorf("invalid token")
+func (s *Server) getUserFromRequest(r *http.Request) (string, error) {
+	user, ok := r.Context().Value(userContextKey{}).(authenticatedUser)
+	if !ok || user.Login == "" {
+		return "", fmt.Errorf("request is not authenticated")
+	}
+	return user.Login, nil
 }
 
 func (s *Server) handleGetExpressions(w http.ResponseWriter, r *http.Request) {
@@ -324,10 +536,23 @@ func (s *Server) handleGetExpressions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	query, err := parseTaskQuery(userLogin, r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
+	s.writeTaskPage(ctx, w, query)
+}
 
-	tasks, err := s.storage.GetUserTasks(ctx, userLogin)
+// writeTaskPage responds with one page of the tasks selected by query.
+func (s *Server) writeTaskPage(ctx context.Context, w http.ResponseWriter, query TaskQuery) {
+	// One extra task tells whether there is a next page.
+	limit := query.Limit
+	query.Limit++
+	tasks, err := s.storage.QueryTasks(ctx, query)
 	if err != nil {
 		log.Printf("Failed to get user tasks: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -336,9 +561,17 @@ func (s *Server) handleGetExpressions(w http.ResponseWriter, r *http.Request) {
 
 	response := struct {
 		Expressions []*Task `json:"expressions"`
+		NextCursor  string  `json:"next_cursor,omitempty"`
 	}{
 		Expressions: tasks,
 	}
+	if len(tasks) > limit {
+		response.Expressions = tasks[:limit]
+		response.NextCursor = query.cursorFor(tasks[limit-1]).Encode()
+	}
+	if response.Expressions == nil {
+		response.Expressions = []*Task{}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -360,14 +593,8 @@ func (s *Server) handleGetExpressionByID(w http.ResponseWriter, r *http.Request)
 
 	expressionID := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/")
 
-	user_login, err := s.getUserFromRequest(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	task, err := s.storage.GetTaskByID(expressionID, user_login)
-	if err != nil {
+	task, err := s.storage.GetTaskByID(expressionID, userLogin)
+	if err != nil || task == nil {
 		http.Error(w, "Expression not found", http.StatusNotFound)
 		return
 	}
@@ -393,22 +620,23 @@ func (s *Server) handleGetTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, erro := s.storage.GetPendingTask()
-	if erro != nil {
-		http.Error(w, "No tasks available", http.StatusNotFound)
-		return
-	}
+	owner := agentID(r)
+	s.agents.Heartbeat(owner)
 
-	task.Status = StatusInProgress
-	err := s.storage.UpdateTask(task)
+	op, err := s.storage.ClaimOperation(owner, s.config.LeaseDuration())
 	if err != nil {
-		log.Printf("Failed to update task status to 'In Progress' for task %s: %v", task.ID, err)
-		http.Error(w, "Failed to update task status", http.StatusInternalServerError)
+		log.Printf("Failed to claim operation: %v", err)
+		http.Error(w, "Failed to get task", http.StatusInternalServerError)
 		return
 	}
+	if op == nil {
+		http.Error(w, "No tasks available", http.StatusNotFound)
+		return
+	}
+	op.OperationTime = s.config.OperationTime(op.Operator).Milliseconds()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]*Task{"task": task})
+	json.NewEncoder(w).Encode(map[string]*Operation{"task": op})
 }
 
 func (s *Server) handleCompleteTask(w http.ResponseWriter, r *http.Request) {
@@ -422,32 +650,14 @@ func (s *Server) handleCompleteTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := s.storage.GetTaskByID(req.ID, "")
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	if task == nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		return
-	}
-
-	task.Result = req.Result
-	task.Status = StatusCompleted
-	task.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-
-	if err := s.storage.UpdateTask(task); err != nil {
-		http.Error(w, "Failed to update task", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
+	s.completeOperation(w, r, req.ID, req.Result)
 }
 
 func (s *Server) handleFailTask(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ID    string `json:"id"`
-		Error string `json:"error"`
+		ID        string `json:"id"`
+		Error     string `json:"error"`
+		ErrorCode string `json:"error_code"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -455,25 +665,7 @@ func (s *Server) handleFailTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := s.storage.GetTaskByID(req.ID, "")
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	if task == nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		return
-	}
-
-	task.Status = StatusFailed
-	task.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-
-	if err := s.storage.UpdateTask(task); err != nil {
-		http.Error(w, "Failed to update task", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
+	s.failOperation(w, r, req.ID, req.ErrorCode, req.Error)
 }
 
 func (s *Server) handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
@@ -491,25 +683,8 @@ func (s *Server) handlePostTaskResult(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
-	user_login, _ := s.getUserFromRequest(r)
 
-	task, _ := s.storage.GetTaskByID(req.ID, user_login)
-	if task == nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		return
-	}
-
-	task.Result = req.Result
-	task.Status = StatusCompleted
-
-	err := s.storage.UpdateTask(task)
-	if err != nil {
-		log.Printf("Failed to update task %s with result: %v", task.ID, err)
-		http.Error(w, "Failed to update task", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
+	s.completeOperation(w, r, req.ID, req.Result)
 }
 
 func (s *Server) handlePostTaskStatus(w http.ResponseWriter, r *http.Request) {
@@ -519,66 +694,60 @@ func (s *Server) handlePostTaskStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		ID     string `json:"id"`
-		Status string `json:"status"`
+		ID        string `json:"id"`
+		Status    string `json:"status"`
+		Error     string `json:"error"`
+		ErrorCode string `json:"error_code"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
 		return
 	}
-	user_login, _ := s.getUserFromRequest(r)
 
-	task, _ := s.storage.GetTaskByID(req.ID, user_login)
-	if task == nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
+	if req.Status != StatusFailed {
+		http.Error(w, fmt.Sprintf("Unsupported status: %s", req.Status), http.StatusBadRequest)
 		return
 	}
 
-	task.Status = req.Status
+	s.failOperation(w, r, req.ID, req.ErrorCode, req.Error)
+}
 
-	err := s.storage.UpdateTask(task)
-	if err != nil {
-		log.Printf("Failed to update task %s with status %s: %v", task.ID, req.Status, err)
-		http.Error(w, "Failed to update task", http.StatusInternalServerError)
-		return
-	}
+func (s *Server) reapExpiredLeases() {
+	ticker := time.NewTicker(s.config.ReaperInterval)
+	defer ticker.Stop()
 
-	w.WriteHeader(http.StatusOK)
+	for range ticker.C {
+		released, err := s.storage.ReleaseExpiredLeases()
+		if err != nil {
+			log.Printf("Failed to release expired leases: %v", err)
+			continue
+		}
+		if len(released) > 0 {
+			log.Printf("Returned %d operations with expired leases to the queue", len(released))
+		}
+	}
 }
 
 type User struct {
 	Login        string
 	PasswordHash string
+	Role         string
+	Disabled     bool
 	CreatedAt    time.Time
 }
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
 type UserStorage interface {
 	CreateUser(user *User) error
 	GetUser(login string) (*User, error)
-}
-
-type InMemoryUserStorage struct {
-	users map[string]*User
-}
-
-func NewUserStorage() UserStorage {
-	return &InMemoryUserStorage{
-		users: make(map[string]*User),
-	}
-}
-
-func (s *InMemoryUserStorage) CreateUser(user *User) error {
-	s.users[user.Login] = user
-	return nil
-}
-
-func (s *InMemoryUserStorage) GetUser(login string) (*User, error) {
-	user, exists := s.users[login]
-	if !exists {
-		return nil, fmt.Errorf("user not found")
-	}
-	return user, nil
+	ListUsers() ([]*User, error)
+	// UpdateUser saves the role and the disabled flag of the user.
+	UpdateUser(user *User) error
 }
 
 func GenerateTaskID() string {
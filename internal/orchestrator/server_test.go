@@ -0,0 +1,114 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig is the default configuration on the memory backend. It ignores
+// the environment, so variables like ADMIN_LOGINS or JWT_KEYS_FILE set in
+// the developer's shell do not change the tests.
+func testConfig() Config {
+	config := loadConfig(func(string) string { return "" })
+	config.StorageBackend = BackendMemory
+	return config
+}
+
+// newServer creates a server from testConfig changed by options and closes
+// it when the test ends.
+func newServer(t *testing.T, options ...func(*Config)) *Server {
+	t.Helper()
+
+	config := testConfig()
+	for _, option := range options {
+		option(&config)
+	}
+	server, err := NewServerWithConfig(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func withDatabase(path string) func(*Config) {
+	return func(config *Config) {
+		config.StorageBackend = BackendSQLite
+		config.DatabasePath = path
+	}
+}
+
+func withAdmins(logins ...string) func(*Config) {
+	return func(config *Config) {
+		config.AdminLogins = logins
+	}
+}
+
+func TestCalculateCapsPriorityByRole(t *testing.T) {
+	server, _, userToken := newStreamingServer(t)
+	server.config.UserMaxPriority = 2
+	server.config.OperatorMaxPriority = 6
+	server.config.AdminMaxPriority = 9
+	server.config.AdminLogins = []string{"root"}
+	adminToken := registerAndLogin(t, server, "root")
+	registerAndLogin(t, server, "olga")
+	w := authorizedRequest(t, server.authMiddleware(server.handleUpdateUser), http.MethodPatch, "/api/v1/admin/users/olga", adminToken, map[string]string{"role": RoleOperator})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = postCredentials(t, server.handleLogin, "olga", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	var operator sessionTokens
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&operator))
+
+	priorityOf := func(token string, priority int) int {
+		w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token,
+			map[string]interface{}{"expression": "1+2", "priority": priority})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var created struct {
+			ID string `json:"id"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+		task, err := server.storage.GetTask(created.ID)
+		require.NoError(t, err)
+		return task.Priority
+	}
+
+	assert.Equal(t, 1, priorityOf(userToken, 1))
+	assert.Equal(t, 2, priorityOf(userToken, 7))
+	assert.Equal(t, 7, priorityOf(adminToken, 7))
+	assert.Equal(t, 9, priorityOf(adminToken, 50))
+	assert.Equal(t, 6, priorityOf(operator.Token, 50))
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", userToken,
+		map[string]interface{}{"expression": "1+2", "priority": -1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPriorityCapsCanBeZero(t *testing.T) {
+	config := loadConfig(func(name string) string {
+		return map[string]string{
+			"MAX_PRIORITY_USER":     "0",
+			"MAX_PRIORITY_OPERATOR": "-1",
+			"MAX_PRIORITY_ADMIN":    "many",
+		}[name]
+	})
+	assert.Equal(t, 0, config.UserMaxPriority)
+	assert.Equal(t, 10, config.OperatorMaxPriority)
+	assert.Equal(t, 10, config.AdminMaxPriority)
+
+	server := newServer(t, func(c *Config) { c.UserMaxPriority = config.UserMaxPriority })
+	token := registerAndLogin(t, server, "alice")
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token,
+		map[string]interface{}{"expression": "1+2", "priority": 3})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	task, err := server.storage.GetTask(created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, task.Priority)
+}
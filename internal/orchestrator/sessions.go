@@ -0,0 +1,233 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenRevoked  = errors.New("refresh token revoked")
+	ErrRefreshTokenReused   = errors.New("refresh token reused")
+)
+
+// RefreshToken is one link of a session: every refresh replaces the token
+// with a new one of the same family. Only the hash of the token is stored.
+type RefreshToken struct {
+	ID        string `json:"id"`
+	FamilyID  string `json:"family_id"`
+	UserLogin string `json:"user_login"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	RotatedAt string `json:"rotated_at,omitempty"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+}
+
+type SessionStore interface {
+	CreateRefreshToken(token *RefreshToken, tokenHash string) error
+	// RotateRefreshToken marks the token with tokenHash as rotated and stores
+	// next in its family for the same user. A token that was already rotated
+	// has been used twice, so the whole family is revoked and
+	// ErrRefreshTokenReused returned. It returns the token with tokenHash,
+	// also together with ErrRefreshTokenReused.
+	RotateRefreshToken(tokenHash string, next *RefreshToken, nextHash string, now string) (*RefreshToken, error)
+	RevokeRefreshTokenFamily(familyID string, revokedAt string) error
+	RevokeUserRefreshTokens(userLogin string, revokedAt string) error
+	// DenyAccessToken rejects the access token with the jti until it expires.
+	DenyAccessToken(jti string, expiresAt string) error
+	IsAccessTokenDenied(jti string) (bool, error)
+	PurgeExpiredTokens(now time.Time) (int64, error)
+}
+
+// accessClaims verifies an access token and checks that it was not revoked
+// by logging out and that the account of its user is not disabled.
+func (s *Server) accessClaims(tokenString string) (jwt.MapClaims, error) {
+	token, err := s.keys.Parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, fmt.Errorf("token has no jti")
+	}
+	denied, err := s.sessions.IsAccessTokenDenied(jti)
+	if err != nil {
+		return nil, err
+	}
+	if denied {
+		return nil, fmt.Errorf("token was revoked")
+	}
+
+	login, _ := claims["sub"].(string)
+	user, err := s.userStorage.GetUser(login)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("account %s is disabled", user.Login)
+	}
+	return claims, nil
+}
+
+// issueSession responds with a new access token and the refresh token that
+// continues the session.
+func (s *Server) issueSession(w http.ResponseWriter, user *User, familyID string, refreshToken string) {
+	now := time.Now()
+	accessToken, err := s.keys.Sign(jwt.MapClaims{
+		"sub":  user.Login,
+		"role": user.Role,
+		"sid":  familyID,
+		"jti":  uuid.New().String(),
+		"iat":  now.Unix(),
+		"exp":  now.Add(s.config.AccessTokenTTL).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(s.config.AccessTokenTTL.Seconds()),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) newRefreshToken(userLogin string, familyID string) (*RefreshToken, string, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now().UTC()
+	return &RefreshToken{
+		ID:        uuid.New().String(),
+		FamilyID:  familyID,
+		UserLogin: userLogin,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(s.config.RefreshTokenTTL).Format(time.RFC3339),
+	}, secret, nil
+}
+
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	next, secret, err := s.newRefreshToken("", "")
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	rotated, err := s.sessions.RotateRefreshToken(hashToken(req.RefreshToken), next, hashToken(secret), time.Now().UTC().Format(time.RFC3339))
+	switch err {
+	case nil:
+	case ErrRefreshTokenNotFound, ErrRefreshTokenExpired, ErrRefreshTokenRevoked:
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case ErrRefreshTokenReused:
+		log.Printf("Refresh token of session %s was reused, session of %s revoked", rotated.FamilyID, rotated.UserLogin)
+		http.Error(w, "Refresh token was already used, session revoked", http.StatusUnauthorized)
+		return
+	default:
+		log.Printf("Failed to rotate refresh token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The role is read again so that a refresh picks up role changes.
+	user, err := s.userStorage.GetUser(rotated.UserLogin)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", rotated.UserLogin, err)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if user.Disabled {
+		http.Error(w, "Account is disabled", http.StatusForbidden)
+		return
+	}
+	s.issueSession(w, user, rotated.FamilyID, secret)
+}
+
+// handleLogout revokes the access token of the request and every refresh
+// token of its session.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := s.accessClaims(bearerToken(r))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now().UTC()
+	jti, _ := claims["jti"].(string)
+	expiresAt := now.Add(s.config.AccessTokenTTL)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.Time
+	}
+	if err := s.sessions.DenyAccessToken(jti, expiresAt.UTC().Format(time.RFC3339)); err != nil {
+		log.Printf("Failed to revoke access token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if sid, _ := claims["sid"].(string); sid != "" {
+		if err := s.sessions.RevokeRefreshTokenFamily(sid, now.Format(time.RFC3339)); err != nil {
+			log.Printf("Failed to revoke session %s: %v", sid, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) purgeExpiredTokens() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := s.sessions.PurgeExpiredTokens(time.Now().UTC())
+		if err != nil {
+			log.Printf("Failed to purge expired tokens: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired tokens", purged)
+		}
+	}
+}
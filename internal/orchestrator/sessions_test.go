@@ -0,0 +1,106 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sessionTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+func login(t *testing.T, server *Server, login string) sessionTokens {
+	t.Helper()
+
+	require.Equal(t, http.StatusOK, postCredentials(t, server.handleRegister, login, "secret").Code)
+	w := postCredentials(t, server.handleLogin, login, "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tokens sessionTokens
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tokens))
+	return tokens
+}
+
+func refresh(t *testing.T, server *Server, refreshToken string) (int, sessionTokens) {
+	t.Helper()
+
+	w := authorizedRequest(t, server.handleRefreshToken, http.MethodPost, "/api/v1/token/refresh", "", map[string]string{"refresh_token": refreshToken})
+	var tokens sessionTokens
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&tokens))
+	}
+	return w.Code, tokens
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	server := newServer(t)
+	protected := server.authMiddleware(server.handleQuota)
+
+	tokens := login(t, server, "alice")
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, int64(server.config.AccessTokenTTL.Seconds()), tokens.ExpiresIn)
+
+	code, rotated := refresh(t, server, tokens.RefreshToken)
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, tokens.RefreshToken, rotated.RefreshToken)
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, protected, http.MethodGet, "/api/v1/me/quota", rotated.Token, nil).Code)
+
+	code, again := refresh(t, server, rotated.RefreshToken)
+	require.Equal(t, http.StatusOK, code)
+
+	// Presenting a rotated token again means it leaked: the whole session
+	// ends, including the token issued last.
+	code, _ = refresh(t, server, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = refresh(t, server, again.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	other := login(t, server, "bob")
+	code, _ = refresh(t, server, other.RefreshToken)
+	assert.Equal(t, http.StatusOK, code, "other sessions are not affected")
+
+	code, _ = refresh(t, server, "made-up")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestLogoutRevokesAccessAndRefreshTokens(t *testing.T) {
+	server := newServer(t)
+	protected := server.authMiddleware(server.handleQuota)
+
+	tokens := login(t, server, "alice")
+	second := postCredentials(t, server.handleLogin, "alice", "secret")
+	var otherDevice sessionTokens
+	require.NoError(t, json.NewDecoder(second.Body).Decode(&otherDevice))
+
+	w := authorizedRequest(t, server.handleLogout, http.MethodPost, "/api/v1/logout", tokens.Token, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, protected, http.MethodGet, "/api/v1/me/quota", tokens.Token, nil).Code)
+	code, _ := refresh(t, server, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	w = authorizedRequest(t, server.handleLogout, http.MethodPost, "/api/v1/logout", tokens.Token, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Equal(t, http.StatusOK, authorizedRequest(t, protected, http.MethodGet, "/api/v1/me/quota", otherDevice.Token, nil).Code,
+		"logging out ends only the current session")
+	code, _ = refresh(t, server, otherDevice.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestAccessTokensNeedJTI(t *testing.T) {
+	server := newServer(t)
+	protected := server.authMiddleware(server.handleQuota)
+	login(t, server, "alice")
+
+	token, err := server.keys.Sign(jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(t, protected, http.MethodGet, "/api/v1/me/quota", token, nil).Code)
+}
@@ -1,112 +1,1262 @@
 package orchestrator
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-type Storage struct {
-	tasks map[string]*Task
-	mu    sync.RWMutex
+type memoryState struct {
+	Tasks      map[string]*Task      `json:"tasks"`
+	Operations map[string]*Operation `json:"operations"`
+	Order      []string              `json:"order"`
+	Users      map[string]*User      `json:"users"`
+	Webhooks   map[string]*Webhook   `json:"webhooks"`
+	Deliveries map[string]*Delivery  `json:"deliveries"`
+	Batches    map[string]*Batch     `json:"batches"`
+	Workspaces map[string]*Workspace `json:"workspaces"`
+
+	AgentCredentials map[string]*AgentCredential `json:"agent_credentials"`
+	// AgentTokens maps token hashes to credential IDs.
+	AgentTokens map[string]string `json:"agent_tokens"`
+
+	RefreshTokens map[string]*RefreshToken `json:"refresh_tokens"`
+	// RefreshTokenHashes maps token hashes to refresh token IDs.
+	RefreshTokenHashes map[string]string `json:"refresh_token_hashes"`
+	// DeniedAccessTokens maps the jti of revoked access tokens to their
+	// expiry.
+	DeniedAccessTokens map[string]string `json:"denied_access_tokens"`
+
+	// Idempotency is keyed by idempotencyKey(user, key).
+	Idempotency map[string]*IdempotencyRecord `json:"idempotency"`
+
+	// Dispatch records, per user, the sequence number of the last operation
+	// handed to an agent.
+	Dispatch    map[string]int64 `json:"dispatch"`
+	DispatchSeq int64            `json:"dispatch_seq"`
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		Tasks:      make(map[string]*Task),
+		Operations: make(map[string]*Operation),
+		Users:      make(map[string]*User),
+		Webhooks:   make(map[string]*Webhook),
+		Deliveries: make(map[string]*Delivery),
+		Batches:    make(map[string]*Batch),
+		Workspaces: make(map[string]*Workspace),
+
+		AgentCredentials: make(map[string]*AgentCredential),
+		AgentTokens:      make(map[string]string),
+
+		RefreshTokens:      make(map[string]*RefreshToken),
+		RefreshTokenHashes: make(map[string]string),
+		DeniedAccessTokens: make(map[string]string),
+
+		Idempotency: make(map[string]*IdempotencyRecord),
+		Dispatch:    make(map[string]int64),
+	}
+}
+
+// MemoryStore keeps everything in process memory. It is lost on restart
+// unless wrapped by FileStore.
+type MemoryStore struct {
+	state   *memoryState
+	mu      sync.RWMutex
+	persist func(*memoryState) error
+	retry   RetryPolicy
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		state: newMemoryState(),
+		retry: DefaultRetryPolicy,
+	}
 }
 
-func NewStorage() *Storage {
-	return &Storage{
-		tasks: make(map[string]*Task),
+func (s *MemoryStore) SetRetryPolicy(policy RetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retry = policy
+}
+
+func (s *MemoryStore) changed() error {
+	if s.persist == nil {
+		return nil
 	}
+	return s.persist(s.state)
 }
 
-func (s *Storage) GetAllTasks() []*Task {
+func (s *MemoryStore) AddTaskWithOperations(task *Task, ops []*Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.insertTask(task, ops); err != nil {
+		return err
+	}
+	s.attachReferences(task.ID)
+	return s.changed()
+}
+
+func (s *MemoryStore) AddBatch(batch *Batch, items []BatchItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.state.Batches[batch.ID]; exists {
+		return fmt.Errorf("batch with ID %s already exists", batch.ID)
+	}
+	for _, item := range items {
+		if _, exists := s.state.Tasks[item.Task.ID]; exists {
+			return fmt.Errorf("task with ID %s already exists", item.Task.ID)
+		}
+	}
+
+	copyBatch := *batch
+	copyBatch.TaskIDs = nil
+	for _, item := range items {
+		if err := s.insertTask(item.Task, item.Operations); err != nil {
+			return err
+		}
+		copyBatch.TaskIDs = append(copyBatch.TaskIDs, item.Task.ID)
+	}
+	for _, item := range items {
+		s.attachReferences(item.Task.ID)
+	}
+	s.state.Batches[batch.ID] = &copyBatch
+	return s.changed()
+}
+
+func (s *MemoryStore) insertTask(task *Task, ops []*Operation) error {
+	if _, exists := s.state.Tasks[task.ID]; exists {
+		return fmt.Errorf("task with ID %s already exists", task.ID)
+	}
+
+	copyTask := *task
+	s.state.Tasks[task.ID] = &copyTask
+	for _, op := range ops {
+		copyOp := *op
+		s.state.Operations[op.ID] = &copyOp
+		s.state.Order = append(s.state.Order, op.ID)
+	}
+	if isFinalStatus(task.Status) {
+		s.enqueueDeliveries(&copyTask, task.UpdatedAt)
+	}
+	return nil
+}
+
+// attachReferences resolves the references of a new task to tasks that have
+// already completed and fails it when one of them can no longer complete.
+func (s *MemoryStore) attachReferences(taskID string) {
+	task := s.state.Tasks[taskID]
+	if task.Status != StatusWaiting {
+		return
+	}
+	for _, ref := range task.References {
+		status := ""
+		referenced := s.state.Tasks[ref]
+		if referenced != nil {
+			status = referenced.Status
+		}
+
+		if status == StatusCompleted {
+			s.resolveReferences(ref, referenced.Result, task.CreatedAt)
+		} else if status == "" || isFinalStatus(status) {
+			s.stopTask(taskID, "", StatusFailed, referenceFailure(ref, status), task.CreatedAt)
+			return
+		}
+	}
+}
+
+// resolveReferences feeds the result of a completed task into the tasks
+// that refer to it and releases those that no longer wait for anything.
+func (s *MemoryStore) resolveReferences(taskID string, result float64, now string) {
+	for _, op := range s.state.Operations {
+		if op.LeftDependency == taskID {
+			op.Operand1 = result
+			op.LeftDependency = ""
+			op.UpdatedAt = now
+		}
+		if op.RightDependency == taskID {
+			op.Operand2 = result
+			op.RightDependency = ""
+			op.UpdatedAt = now
+		}
+	}
+
+	for _, dependent := range s.waitingDependents(taskID) {
+		references := make(map[string]bool)
+		for _, ref := range dependent.References {
+			references[ref] = true
+		}
+		var ops []*Operation
+		unresolved := false
+		for _, op := range s.state.Operations {
+			if op.TaskID == dependent.ID {
+				ops = append(ops, op)
+				unresolved = unresolved || references[op.LeftDependency] || references[op.RightDependency]
+			}
+		}
+		if unresolved {
+			continue
+		}
+
+		dependent.Status = StatusPending
+		dependent.UpdatedAt = now
+		for _, op := range ops {
+			if op.Status == StatusWaiting && op.LeftDependency == "" && op.RightDependency == "" {
+				op.Status = StatusPending
+			}
+		}
+	}
+}
+
+// failDependents fails the tasks that are still waiting for taskID, which
+// has ended with status without a result (or was deleted, when status is
+// empty).
+func (s *MemoryStore) failDependents(taskID string, status string, now string) {
+	for _, dependent := range s.waitingDependents(taskID) {
+		s.stopTask(dependent.ID, "", StatusFailed, referenceFailure(taskID, status), now)
+	}
+}
+
+func (s *MemoryStore) waitingDependents(taskID string) []*Task {
+	var dependents []*Task
+	for _, task := range s.state.Tasks {
+		if task.Status == StatusWaiting && containsString(task.References, taskID) {
+			dependents = append(dependents, task)
+		}
+	}
+	return dependents
+}
+
+func (s *MemoryStore) GetDependentTasks(taskID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for _, task := range s.state.Tasks {
+		if containsString(task.References, taskID) {
+			ids = append(ids, task.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) GetBatch(id string, userLogin string) (*Batch, []*Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	batch, ok := s.state.Batches[id]
+	if !ok || batch.UserLogin != userLogin {
+		return nil, nil, nil
+	}
+
+	var tasks []*Task
+	for _, taskID := range batch.TaskIDs {
+		if task, ok := s.state.Tasks[taskID]; ok {
+			copyTask := *task
+			tasks = append(tasks, &copyTask)
+		}
+	}
+	copyBatch := *batch
+	return &copyBatch, tasks, nil
+}
+
+func (s *MemoryStore) GetTaskByID(id string, userLogin string) (*Task, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var allTasks []*Task
-	for _, task := range s.tasks {
-		copyTask := *task
-		allTasks = append(allTasks, &copyTask)
+	task, ok := s.state.Tasks[id]
+	if !ok || task.UserLogin != userLogin {
+		return nil, nil
 	}
-	return allTasks
+
+	copyTask := *task
+	return &copyTask, nil
+}
+
+func (s *MemoryStore) GetUserTasks(ctx context.Context, userLogin string) ([]*Task, error) {
+	return s.QueryTasks(ctx, TaskQuery{UserLogin: userLogin, SortBy: SortCreatedAt, Descending: true})
 }
 
-func (s *Storage) GetTasksByExpressionID(expressionID string) []*Task {
+func (s *MemoryStore) GetTasksByStatus(userLogin string, status string) ([]*Task, error) {
+	return s.QueryTasks(context.Background(), TaskQuery{
+		UserLogin: userLogin, Status: status, SortBy: SortCreatedAt, Descending: true,
+	})
+}
+
+func (s *MemoryStore) QueryTasks(ctx context.Context, query TaskQuery) ([]*Task, error) {
+	tasks := s.findTasks(func(task *Task) bool {
+		return (query.UserLogin == "" || task.UserLogin == query.UserLogin) &&
+			(query.Status == "" || task.Status == query.Status) &&
+			(query.CreatedAfter == "" || task.CreatedAt >= query.CreatedAfter) &&
+			(query.CreatedBefore == "" || task.CreatedAt < query.CreatedBefore) &&
+			strings.Contains(task.Expression, query.Contains)
+	})
+
+	// before reports whether a comes before b in the requested order.
+	before := func(a, b *TaskCursor) bool {
+		if a.Value != b.Value {
+			return (a.Value < b.Value) != query.Descending
+		}
+		if a.ID == b.ID {
+			return false
+		}
+		return (a.ID < b.ID) != query.Descending
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return before(query.cursorFor(tasks[i]), query.cursorFor(tasks[j]))
+	})
+
+	page := tasks[:0]
+	for _, task := range tasks {
+		if query.After != nil && !before(query.After, query.cursorFor(task)) {
+			continue
+		}
+		if query.Limit > 0 && len(page) == query.Limit {
+			break
+		}
+		page = append(page, task)
+	}
+	if len(page) == 0 {
+		return nil, nil
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) findTasks(match func(*Task) bool) []*Task {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var tasksForExpression []*Task
-	for _, task := range s.tasks {
-		if task.ID == expressionID {
+	var tasks []*Task
+	for _, task := range s.state.Tasks {
+		if match(task) {
 			copyTask := *task
-			tasksForExpression = append(tasksForExpression, &copyTask)
+			tasks = append(tasks, &copyTask)
+		}
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].CreatedAt > tasks[j].CreatedAt
+	})
+	return tasks
+}
+
+func (s *MemoryStore) UpdateTask(task *Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.state.Tasks[task.ID]
+	if !exists || existing.UserLogin != task.UserLogin {
+		return fmt.Errorf("task not found")
+	}
+
+	copyTask := *task
+	copyTask.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	s.state.Tasks[task.ID] = &copyTask
+	return s.changed()
+}
+
+func (s *MemoryStore) DeleteTask(id string, userLogin string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, exists := s.state.Tasks[id]
+	if !exists || task.UserLogin != userLogin {
+		return nil
+	}
+
+	delete(s.state.Tasks, id)
+	s.failDependents(id, "", time.Now().UTC().Format(time.RFC3339))
+	order := s.state.Order[:0]
+	for _, opID := range s.state.Order {
+		if s.state.Operations[opID].TaskID == id {
+			delete(s.state.Operations, opID)
+			continue
 		}
+		order = append(order, opID)
 	}
-	return tasksForExpression
+	s.state.Order = order
+	return s.changed()
 }
-func (s *Storage) GetPendingTask() *Task {
+
+func (s *MemoryStore) ClaimOperation(owner string, lease time.Duration) (*Operation, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var oldestTask *Task
-	var oldestTime time.Time
+	now := time.Now().UTC()
+	timestamp := now.Format(time.RFC3339)
 
-	for _, task := range s.tasks {
-		taskTime, err := time.Parse(time.RFC3339, task.CreatedAt)
-		if err != nil {
+	var next *Operation
+	var nextTask *Task
+	for _, id := range s.state.Order {
+		op := s.state.Operations[id]
+		if op.Status != StatusPending || (op.NextAttemptAt != "" && op.NextAttemptAt > timestamp) {
 			continue
 		}
+		task := s.state.Tasks[op.TaskID]
+		if task == nil {
+			continue
+		}
+		if next == nil || s.claimsBefore(task, op, nextTask, next) {
+			next, nextTask = op, task
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+
+	next.Status = StatusInProgress
+	next.LeaseOwner = owner
+	next.LeaseExpiresAt = now.Add(lease).Format(time.RFC3339)
+	next.UpdatedAt = now.Format(time.RFC3339)
+
+	if nextTask.Status == StatusPending {
+		nextTask.Status = StatusInProgress
+		nextTask.UpdatedAt = next.UpdatedAt
+	}
+
+	s.state.DispatchSeq++
+	s.state.Dispatch[nextTask.UserLogin] = s.state.DispatchSeq
+
+	copyOp := *next
+	return &copyOp, s.changed()
+}
+
+// claimsBefore orders pending operations the same way SQLiteStorage does:
+// by task priority, then by how long ago the user was last served, then by age.
+func (s *MemoryStore) claimsBefore(task *Task, op *Operation, otherTask *Task, other *Operation) bool {
+	if task.Priority != otherTask.Priority {
+		return task.Priority > otherTask.Priority
+	}
+	last, otherLast := s.state.Dispatch[task.UserLogin], s.state.Dispatch[otherTask.UserLogin]
+	if last != otherLast {
+		return last < otherLast
+	}
+	return op.CreatedAt < other.CreatedAt
+}
+
+func (s *MemoryStore) GetOperation(id string) (*Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		if task.Status == StatusPending &&
-			(oldestTask == nil || taskTime.Before(oldestTime)) {
-			oldestTask = task
-			oldestTime = taskTime
+	op, ok := s.state.Operations[id]
+	if !ok {
+		return nil, nil
+	}
+
+	copyOp := *op
+	return &copyOp, nil
+}
+
+func (s *MemoryStore) leasedOperation(id string, owner string) (*Operation, error) {
+	op, ok := s.state.Operations[id]
+	if ok && op.Status == StatusCancelled {
+		return nil, ErrOperationCancelled
+	}
+	if !ok || op.Status != StatusInProgress || owner == "" || op.LeaseOwner != owner {
+		return nil, ErrOperationNotFound
+	}
+	return op, nil
+}
+
+func (s *MemoryStore) CompleteOperation(id string, owner string, result float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, err := s.leasedOperation(id, owner)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	op.Status = StatusCompleted
+	op.Result = result
+	op.LeaseOwner = ""
+	op.LeaseExpiresAt = ""
+	op.UpdatedAt = now
+
+	if op.IsRoot {
+		if task := s.state.Tasks[op.TaskID]; task != nil {
+			task.Status = StatusCompleted
+			task.Result = result
+			task.UpdatedAt = now
+			s.enqueueDeliveries(task, now)
+			s.resolveReferences(task.ID, result, now)
 		}
+		return s.changed()
 	}
 
-	if oldestTask != nil {
-		copyTask := *oldestTask
+	for _, dependent := range s.state.Operations {
+		if dependent.LeftDependency == id {
+			dependent.Operand1 = result
+			dependent.LeftDependency = ""
+			dependent.UpdatedAt = now
+		}
+		if dependent.RightDependency == id {
+			dependent.Operand2 = result
+			dependent.RightDependency = ""
+			dependent.UpdatedAt = now
+		}
+		if dependent.TaskID == op.TaskID && dependent.Status == StatusWaiting &&
+			dependent.LeftDependency == "" && dependent.RightDependency == "" {
+			dependent.Status = StatusPending
+		}
+	}
+	return s.changed()
+}
+
+func (s *MemoryStore) FailOperation(id string, owner string, failure Failure) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		oldestTask.Status = StatusInProgress
-		oldestTask.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	op, err := s.leasedOperation(id, owner)
+	if err != nil {
+		return err
+	}
 
-		return &copyTask
+	now := time.Now().UTC()
+	if IsRetryable(failure.Code) {
+		s.retryOperation(op, failure, now)
+	} else {
+		failure.AgentID = op.LeaseOwner
+		s.stopTask(op.TaskID, op.ID, StatusFailed, failure, now.Format(time.RFC3339))
 	}
+	return s.changed()
+}
 
-	return nil
+// retryOperation puts a failed operation back into the queue after a backoff
+// delay, or moves the whole task to the dead-letter state when it has used
+// up its attempts.
+func (s *MemoryStore) retryOperation(op *Operation, failure Failure, now time.Time) {
+	timestamp := now.Format(time.RFC3339)
+	failure.AgentID = op.LeaseOwner
+	op.Attempts++
+	op.LastError = failure.Message
+
+	task := s.state.Tasks[op.TaskID]
+	if task == nil || op.Attempts >= task.MaxAttempts {
+		s.stopTask(op.TaskID, op.ID, StatusDeadLetter, failure, timestamp)
+		return
+	}
+
+	op.Status = StatusPending
+	op.NextAttemptAt = now.Add(s.retry.Backoff(op.Attempts)).Format(time.RFC3339)
+	op.LeaseOwner = ""
+	op.LeaseExpiresAt = ""
+	op.UpdatedAt = timestamp
+	task.Retries++
+	task.UpdatedAt = timestamp
 }
 
-func (s *Storage) AddTask(task *Task) error {
+// stopTask moves a task and its unfinished operations to status (Failed or
+// DeadLetter) and records why. opID is the operation that failed, if any.
+// Other operations that are being computed are cancelled like in CancelTask.
+// Tasks waiting for its result fail too.
+func (s *MemoryStore) stopTask(taskID string, opID string, status string, failure Failure, now string) {
+	for _, other := range s.state.Operations {
+		switch {
+		case (opID != "" && other.ID == opID) || (other.TaskID == taskID &&
+			(other.Status == StatusPending || other.Status == StatusWaiting)):
+			other.Status = status
+			other.LeaseOwner = ""
+			other.LeaseExpiresAt = ""
+			other.UpdatedAt = now
+		case other.TaskID == taskID && other.Status == StatusInProgress:
+			other.Status = StatusCancelled
+			other.LeaseExpiresAt = ""
+			other.UpdatedAt = now
+		}
+	}
+	if task := s.state.Tasks[taskID]; task != nil {
+		failure.OperationID = opID
+		failure.FailedAt = now
+		task.Status = status
+		task.Failure = &failure
+		task.UpdatedAt = now
+		s.enqueueDeliveries(task, now)
+	}
+	s.failDependents(taskID, status, now)
+}
+
+func (s *MemoryStore) CancelTask(id string, userLogin string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.tasks[task.ID]; exists {
-		return fmt.Errorf("task with ID %s already exists", task.ID)
+	task, ok := s.state.Tasks[id]
+	if !ok || task.UserLogin != userLogin {
+		return ErrTaskNotFound
+	}
+	if isFinalStatus(task.Status) {
+		return ErrTaskFinished
 	}
 
-	s.tasks[task.ID] = task
-	return nil
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, op := range s.state.Operations {
+		if op.TaskID == id && (op.Status == StatusPending || op.Status == StatusWaiting || op.Status == StatusInProgress) {
+			op.Status = StatusCancelled
+			op.LeaseExpiresAt = ""
+			op.UpdatedAt = now
+		}
+	}
+	task.Status = StatusCancelled
+	task.UpdatedAt = now
+	s.enqueueDeliveries(task, now)
+	s.failDependents(id, StatusCancelled, now)
+	return s.changed()
+}
+
+func (s *MemoryStore) TakeCancelledOperations(owner string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for _, op := range s.state.Operations {
+		if op.Status == StatusCancelled && op.LeaseOwner == owner {
+			op.LeaseOwner = ""
+			ids = append(ids, op.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return ids, s.changed()
+}
+
+func (s *MemoryStore) ReleaseExpiredLeases() ([]string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return s.retryLeased(func(op *Operation) bool {
+		return op.LeaseExpiresAt < now
+	}, Failure{
+		Code:    ErrorCodeTimeout,
+		Message: "lease expired before the agent reported a result",
+	})
+}
+
+func (s *MemoryStore) RequeueAgentOperations(owner string) ([]string, error) {
+	return s.retryLeased(func(op *Operation) bool {
+		return op.LeaseOwner == owner
+	}, Failure{
+		Code:    ErrorCodeAgentLost,
+		Message: "agent stopped sending heartbeats",
+	})
+}
+
+func (s *MemoryStore) retryLeased(match func(*Operation) bool, failure Failure) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var leased []*Operation
+	for _, op := range s.state.Operations {
+		if op.Status == StatusInProgress && match(op) {
+			leased = append(leased, op)
+		}
+	}
+	if len(leased) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	var taskIDs []string
+	for _, op := range leased {
+		s.retryOperation(op, failure, now)
+		taskIDs = append(taskIDs, op.TaskID)
+	}
+	return taskIDs, s.changed()
 }
 
-func (s *Storage) GetTaskByID(taskID string) *Task {
+func (s *MemoryStore) CountActiveTasks(userLogin string) (int, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	task, ok := s.tasks[taskID]
+	count := 0
+	for _, task := range s.state.Tasks {
+		if task.UserLogin == userLogin &&
+			(task.Status == StatusPending || task.Status == StatusWaiting || task.Status == StatusInProgress) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) GetTask(id string) (*Task, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	task, ok := s.state.Tasks[id]
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	copyTask := *task
-	return &copyTask
+	return &copyTask, nil
 }
 
-func (s *Storage) UpdateTask(task *Task) error {
+func (s *MemoryStore) ListTasksByStatus(status string) ([]*Task, error) {
+	return s.findTasks(func(task *Task) bool {
+		return task.Status == status
+	}), nil
+}
+
+func (s *MemoryStore) GetTaskOperations(taskID string) ([]*Operation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ops []*Operation
+	for _, id := range s.state.Order {
+		if op := s.state.Operations[id]; op != nil && op.TaskID == taskID {
+			copyOp := *op
+			ops = append(ops, &copyOp)
+		}
+	}
+	return ops, nil
+}
+
+func (s *MemoryStore) RequeueTask(id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.tasks[task.ID]; !exists {
-		return fmt.Errorf("task with ID %s does not exist", task.ID)
+	task, ok := s.state.Tasks[id]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if task.Status != StatusDeadLetter {
+		return ErrTaskNotDeadLetter
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, op := range s.state.Operations {
+		if op.TaskID != id || (op.Status != StatusDeadLetter && op.Status != StatusCancelled) {
+			continue
+		}
+		op.Status = StatusPending
+		if op.LeftDependency != "" || op.RightDependency != "" {
+			op.Status = StatusWaiting
+		}
+		op.Attempts = 0
+		op.NextAttemptAt = ""
+		op.LeaseOwner = ""
+		op.UpdatedAt = now
 	}
+	task.Status = StatusPending
+	task.Failure = nil
+	task.UpdatedAt = now
+	return s.changed()
+}
 
-	s.tasks[task.ID] = task
+func (s *MemoryStore) CreateUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(user.Login)
+	if _, exists := s.state.Users[key]; exists {
+		return ErrUserExists
+	}
+
+	stored := *user
+	s.state.Users[key] = &stored
+	return s.changed()
+}
+
+func (s *MemoryStore) GetUser(login string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.state.Users[strings.ToLower(login)]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (s *MemoryStore) ListUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]*User, 0, len(s.state.Users))
+	for _, user := range s.state.Users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return strings.ToLower(users[i].Login) < strings.ToLower(users[j].Login)
+	})
+	return users, nil
+}
+
+func (s *MemoryStore) UpdateUser(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.state.Users[strings.ToLower(user.Login)]
+	if !exists {
+		return ErrUserNotFound
+	}
+	stored.Role = user.Role
+	stored.Disabled = user.Disabled
+	return s.changed()
+}
+
+// copyUser copies user; users saved before roles existed are plain users.
+func copyUser(user *User) *User {
+	copied := *user
+	if copied.Role == "" {
+		copied.Role = RoleUser
+	}
+	return &copied
+}
+
+func (s *MemoryStore) CreateWebhook(hook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copyHook := *hook
+	s.state.Webhooks[hook.ID] = &copyHook
+	return s.changed()
+}
+
+func (s *MemoryStore) GetUserWebhooks(userLogin string) ([]*Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hooks []*Webhook
+	for _, hook := range s.userWebhooks(userLogin) {
+		copyHook := *hook
+		hooks = append(hooks, &copyHook)
+	}
+	return hooks, nil
+}
+
+func (s *MemoryStore) userWebhooks(userLogin string) []*Webhook {
+	var hooks []*Webhook
+	for _, hook := range s.state.Webhooks {
+		if hook.UserLogin == userLogin {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].CreatedAt < hooks[j].CreatedAt
+	})
+	return hooks
+}
+
+func (s *MemoryStore) DeleteWebhook(id string, userLogin string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hook, ok := s.state.Webhooks[id]
+	if !ok || hook.UserLogin != userLogin {
+		return ErrWebhookNotFound
+	}
+	delete(s.state.Webhooks, id)
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, d := range s.state.Deliveries {
+		if d.WebhookID == id && d.Status == DeliveryPending {
+			d.Status = DeliveryFailed
+			d.NextAttemptAt = ""
+			d.UpdatedAt = now
+		}
+	}
+	return s.changed()
+}
+
+func (s *MemoryStore) enqueueDeliveries(task *Task, now string) {
+	for _, d := range newDeliveries(task, s.userWebhooks(task.UserLogin), now) {
+		s.state.Deliveries[d.ID] = d
+	}
+}
+
+func (s *MemoryStore) DueDeliveries(now time.Time, limit int) ([]*Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cutoff := now.UTC().Format(time.RFC3339)
+	var due []*Delivery
+	for _, d := range s.state.Deliveries {
+		if d.Status == DeliveryPending && d.NextAttemptAt <= cutoff {
+			copyDelivery := *d
+			copyDelivery.History = nil
+			if hook := s.state.Webhooks[d.WebhookID]; hook != nil {
+				copyDelivery.secret = hook.Secret
+			}
+			due = append(due, &copyDelivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt < due[j].NextAttemptAt
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (s *MemoryStore) RecordDeliveryAttempt(delivery *Delivery, attempt DeliveryAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.state.Deliveries[delivery.ID]
+	if !ok {
+		return fmt.Errorf("delivery %s not found", delivery.ID)
+	}
+	d.Status = delivery.Status
+	d.Attempts = delivery.Attempts
+	d.NextAttemptAt = delivery.NextAttemptAt
+	d.UpdatedAt = delivery.UpdatedAt
+	d.History = append(d.History, attempt)
+	return s.changed()
+}
+
+func (s *MemoryStore) GetUserDeliveries(userLogin string, taskID string) ([]*Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var deliveries []*Delivery
+	for _, d := range s.state.Deliveries {
+		if d.UserLogin == userLogin && (taskID == "" || d.TaskID == taskID) {
+			copyDelivery := *d
+			copyDelivery.History = append([]DeliveryAttempt(nil), d.History...)
+			deliveries = append(deliveries, &copyDelivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt > deliveries[j].CreatedAt
+	})
+	return deliveries, nil
+}
+
+func (s *MemoryStore) Close() error {
 	return nil
 }
+
+func idempotencyKey(userLogin string, key string) string {
+	return userLogin + "\x00" + key
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(record *IdempotencyRecord, notBefore time.Time) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := idempotencyKey(record.UserLogin, record.Key)
+	if existing, ok := s.state.Idempotency[id]; ok && existing.CreatedAt >= notBefore.UTC().Format(time.RFC3339) {
+		copyRecord := *existing
+		return &copyRecord, nil
+	}
+
+	copyRecord := *record
+	copyRecord.StatusCode = 0
+	copyRecord.ContentType = ""
+	copyRecord.Response = ""
+	s.state.Idempotency[id] = &copyRecord
+	return nil, s.changed()
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.state.Idempotency[idempotencyKey(record.UserLogin, record.Key)]
+	if !ok {
+		return nil
+	}
+	existing.StatusCode = record.StatusCode
+	existing.ContentType = record.ContentType
+	existing.Response = record.Response
+	return s.changed()
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(userLogin string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.state.Idempotency, idempotencyKey(userLogin, key))
+	return s.changed()
+}
+
+func (s *MemoryStore) PurgeIdempotencyKeys(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := before.UTC().Format(time.RFC3339)
+	var purged int64
+	for id, record := range s.state.Idempotency {
+		if record.CreatedAt < cutoff {
+			delete(s.state.Idempotency, id)
+			purged++
+		}
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, s.changed()
+}
+
+func copyWorkspace(workspace *Workspace) *Workspace {
+	copyWorkspace := *workspace
+	copyWorkspace.Variables = make(map[string]float64, len(workspace.Variables))
+	for name, value := range workspace.Variables {
+		copyWorkspace.Variables[name] = value
+	}
+	return &copyWorkspace
+}
+
+func (s *MemoryStore) CreateWorkspace(workspace *Workspace) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.state.Workspaces {
+		if existing.UserLogin == workspace.UserLogin && existing.Name == workspace.Name {
+			return ErrWorkspaceExists
+		}
+	}
+	s.state.Workspaces[workspace.ID] = copyWorkspace(workspace)
+	return s.changed()
+}
+
+func (s *MemoryStore) GetUserWorkspaces(userLogin string) ([]*Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var workspaces []*Workspace
+	for _, workspace := range s.state.Workspaces {
+		if workspace.UserLogin == userLogin {
+			workspaces = append(workspaces, copyWorkspace(workspace))
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].Name < workspaces[j].Name
+	})
+	return workspaces, nil
+}
+
+func (s *MemoryStore) GetWorkspace(id string, userLogin string) (*Workspace, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	workspace, ok := s.state.Workspaces[id]
+	if !ok || workspace.UserLogin != userLogin {
+		return nil, nil
+	}
+	return copyWorkspace(workspace), nil
+}
+
+func (s *MemoryStore) DeleteWorkspace(id string, userLogin string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workspace, ok := s.state.Workspaces[id]
+	if !ok || workspace.UserLogin != userLogin {
+		return ErrWorkspaceNotFound
+	}
+	delete(s.state.Workspaces, id)
+	return s.changed()
+}
+
+func (s *MemoryStore) SetVariable(workspaceID string, userLogin string, name string, value float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workspace, ok := s.state.Workspaces[workspaceID]
+	if !ok || workspace.UserLogin != userLogin {
+		return ErrWorkspaceNotFound
+	}
+	if workspace.Variables == nil {
+		workspace.Variables = make(map[string]float64)
+	}
+	workspace.Variables[name] = value
+	return s.changed()
+}
+
+func (s *MemoryStore) DeleteVariable(workspaceID string, userLogin string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workspace, ok := s.state.Workspaces[workspaceID]
+	if !ok || workspace.UserLogin != userLogin {
+		return ErrWorkspaceNotFound
+	}
+	if _, ok := workspace.Variables[name]; !ok {
+		return ErrVariableNotFound
+	}
+	delete(workspace.Variables, name)
+	return s.changed()
+}
+
+func (s *MemoryStore) CreateAgentCredential(credential *AgentCredential, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.state.AgentTokens[tokenHash]; exists {
+		return fmt.Errorf("agent token already exists")
+	}
+	copyCredential := *credential
+	s.state.AgentCredentials[credential.ID] = &copyCredential
+	s.state.AgentTokens[tokenHash] = credential.ID
+	return s.changed()
+}
+
+func (s *MemoryStore) ListAgentCredentials() ([]*AgentCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var credentials []*AgentCredential
+	for _, credential := range s.state.AgentCredentials {
+		copyCredential := *credential
+		credentials = append(credentials, &copyCredential)
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		if credentials[i].CreatedAt != credentials[j].CreatedAt {
+			return credentials[i].CreatedAt < credentials[j].CreatedAt
+		}
+		return credentials[i].ID < credentials[j].ID
+	})
+	return credentials, nil
+}
+
+func (s *MemoryStore) GetAgentCredentialByToken(tokenHash string) (*AgentCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	credential, ok := s.state.AgentCredentials[s.state.AgentTokens[tokenHash]]
+	if !ok {
+		return nil, nil
+	}
+	copyCredential := *credential
+	return &copyCredential, nil
+}
+
+func (s *MemoryStore) RevokeAgentCredential(id string, revokedAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	credential, ok := s.state.AgentCredentials[id]
+	if !ok {
+		return ErrAgentCredentialNotFound
+	}
+	if credential.RevokedAt == "" {
+		credential.RevokedAt = revokedAt
+	}
+	return s.changed()
+}
+
+func (s *MemoryStore) CreateRefreshToken(token *RefreshToken, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.state.RefreshTokenHashes[tokenHash]; exists {
+		return fmt.Errorf("refresh token already exists")
+	}
+	copyToken := *token
+	s.state.RefreshTokens[token.ID] = &copyToken
+	s.state.RefreshTokenHashes[tokenHash] = token.ID
+	return s.changed()
+}
+
+func (s *MemoryStore) RotateRefreshToken(tokenHash string, next *RefreshToken, nextHash string, now string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.state.RefreshTokens[s.state.RefreshTokenHashes[tokenHash]]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if token.RotatedAt != "" {
+		s.revokeRefreshTokenFamily(token.FamilyID, now)
+		if err := s.changed(); err != nil {
+			return nil, err
+		}
+		copyToken := *token
+		return &copyToken, ErrRefreshTokenReused
+	}
+	if token.RevokedAt != "" {
+		copyToken := *token
+		return &copyToken, ErrRefreshTokenRevoked
+	}
+	if token.ExpiresAt <= now {
+		copyToken := *token
+		return &copyToken, ErrRefreshTokenExpired
+	}
+
+	token.RotatedAt = now
+	next.FamilyID = token.FamilyID
+	next.UserLogin = token.UserLogin
+	copyNext := *next
+	s.state.RefreshTokens[next.ID] = &copyNext
+	s.state.RefreshTokenHashes[nextHash] = next.ID
+
+	copyToken := *token
+	return &copyToken, s.changed()
+}
+
+func (s *MemoryStore) RevokeRefreshTokenFamily(familyID string, revokedAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeRefreshTokenFamily(familyID, revokedAt)
+	return s.changed()
+}
+
+func (s *MemoryStore) RevokeUserRefreshTokens(userLogin string, revokedAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.state.RefreshTokens {
+		if token.UserLogin == userLogin && token.RevokedAt == "" {
+			token.RevokedAt = revokedAt
+		}
+	}
+	return s.changed()
+}
+
+func (s *MemoryStore) revokeRefreshTokenFamily(familyID string, revokedAt string) {
+	for _, token := range s.state.RefreshTokens {
+		if token.FamilyID == familyID && token.RevokedAt == "" {
+			token.RevokedAt = revokedAt
+		}
+	}
+}
+
+func (s *MemoryStore) DenyAccessToken(jti string, expiresAt string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.state.DeniedAccessTokens[jti]; !exists {
+		s.state.DeniedAccessTokens[jti] = expiresAt
+	}
+	return s.changed()
+}
+
+func (s *MemoryStore) IsAccessTokenDenied(jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, denied := s.state.DeniedAccessTokens[jti]
+	return denied, nil
+}
+
+func (s *MemoryStore) PurgeExpiredTokens(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.UTC().Format(time.RFC3339)
+	var purged int64
+	for hash, id := range s.state.RefreshTokenHashes {
+		if token := s.state.RefreshTokens[id]; token.ExpiresAt <= cutoff {
+			delete(s.state.RefreshTokens, id)
+			delete(s.state.RefreshTokenHashes, hash)
+			purged++
+		}
+	}
+	for jti, expiresAt := range s.state.DeniedAccessTokens {
+		if expiresAt <= cutoff {
+			delete(s.state.DeniedAccessTokens, jti)
+			purged++
+		}
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, s.changed()
+}
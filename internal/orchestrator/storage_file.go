@@ -0,0 +1,81 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileStore is a MemoryStore that writes a JSON snapshot of its state to disk
+// after every change and loads it back on start.
+type FileStore struct {
+	*MemoryStore
+	path string
+	// saved is the snapshot last written to disk.
+	saved []byte
+}
+
+func OpenFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read storage file: %v", err)
+	}
+	if len(data) > 0 {
+		state := newMemoryState()
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("failed to decode storage file: %v", err)
+		}
+		store.state = state
+		store.saved = data
+	}
+
+	store.persist = store.save
+	return store, nil
+}
+
+// save writes state to disk. If that fails the change is undone in memory as
+// well, so the store keeps matching the file and a retried request applies
+// its change only once.
+func (s *FileStore) save(state *memoryState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		err = fmt.Errorf("failed to encode storage file: %v", err)
+	} else {
+		err = s.write(data)
+	}
+	if err != nil {
+		restored := newMemoryState()
+		if len(s.saved) > 0 {
+			if decodeErr := json.Unmarshal(s.saved, restored); decodeErr != nil {
+				return fmt.Errorf("%v; failed to restore the saved state: %v", err, decodeErr)
+			}
+		}
+		*state = *restored
+		return err
+	}
+	s.saved = data
+	return nil
+}
+
+func (s *FileStore) write(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write storage file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write storage file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write storage file: %v", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
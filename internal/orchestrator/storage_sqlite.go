@@ -3,53 +3,64 @@ package orchestrator
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrOperationNotFound  = errors.New("operation not found or not leased by this agent")
+	ErrOperationCancelled = errors.New("operation was cancelled")
+	ErrTaskNotFound       = errors.New("task not found")
+	ErrTaskFinished       = errors.New("task already finished")
 )
 
 type SQLiteStorage struct {
-	db *sql.DB
+	db    *sql.DB
+	retry RetryPolicy
 }
 
 func NewSQLiteStorage() (*SQLiteStorage, error) {
-	db, err := sql.Open("sqlite3", "./tasks.db")
+	return OpenSQLiteStorage("./tasks.db")
+}
+
+func OpenSQLiteStorage(path string) (*SQLiteStorage, error) {
+	db, err := openDatabase(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return nil, err
 	}
 
-	if err := createTables(db); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %v", err)
+	applied, err := MigrateUp(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
 	}
 
-	return &SQLiteStorage{db: db}, nil
+	return &SQLiteStorage{db: db, retry: DefaultRetryPolicy}, nil
 }
 
-func createTables(db *sql.DB) error {
-
-	_, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS tasks (
-		id TEXT PRIMARY KEY,
-		expression TEXT NOT NULL,
-		status TEXT NOT NULL,
-		result REAL,
-		user_login TEXT NOT NULL,
-		created_at TEXT NOT NULL,
-		updated_at TEXT NOT NULL
-	)`)
+func openDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
+	return db, nil
+}
 
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		login TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		created_at TEXT NOT NULL
-	)`)
-	return err
+func (s *SQLiteStorage) SetRetryPolicy(policy RetryPolicy) {
+	s.retry = policy
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
 }
 
 func (s *SQLiteStorage) AddTask(task *Task) error {
@@ -62,14 +73,345 @@ func (s *SQLiteStorage) AddTask(task *Task) error {
 	return err
 }
 
+func (s *SQLiteStorage) AddTaskWithOperations(task *Task, ops []*Operation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertTask(tx, task, ops, 0); err != nil {
+		return err
+	}
+	if err := attachReferences(tx, task); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddBatch stores the batch and all of its tasks in one transaction.
+func (s *SQLiteStorage) AddBatch(batch *Batch, items []BatchItem) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO batches (id, user_login, created_at) 
+		VALUES (?, ?, ?)`,
+		batch.ID, batch.UserLogin, batch.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert batch: %v", err)
+	}
+
+	for i, item := range items {
+		if err := insertTask(tx, item.Task, item.Operations, i); err != nil {
+			return err
+		}
+	}
+	// Items may refer to each other, so references are attached only once
+	// every task of the batch exists.
+	for _, item := range items {
+		if err := attachReferences(tx, item.Task); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertTask(tx *sql.Tx, task *Task, ops []*Operation, batchIndex int) error {
+	var variables sql.NullString
+	if task.Variables != nil {
+		data, err := json.Marshal(task.Variables)
+		if err != nil {
+			return fmt.Errorf("failed to encode variables: %v", err)
+		}
+		variables = sql.NullString{String: string(data), Valid: true}
+	}
+	var references sql.NullString
+	if len(task.References) > 0 {
+		data, err := json.Marshal(task.References)
+		if err != nil {
+			return fmt.Errorf("failed to encode references: %v", err)
+		}
+		references = sql.NullString{String: string(data), Valid: true}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO tasks 
+		(id, expression, status, result, user_login, callback_url, max_attempts, priority, batch_id, batch_index, label, 
+		workspace_id, variables, referenced_tasks, created_at, updated_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		task.ID, task.Expression, task.Status, task.Result, task.UserLogin,
+		nullString(task.CallbackURL), task.MaxAttempts, task.Priority,
+		nullString(task.BatchID), batchIndex, nullString(task.Label),
+		nullString(task.WorkspaceID), variables, references, task.CreatedAt, task.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert task: %v", err)
+	}
+
+	for _, ref := range task.References {
+		_, err = tx.Exec(`
+			INSERT INTO task_references (task_id, referenced_task_id) 
+			VALUES (?, ?)`,
+			task.ID, ref)
+		if err != nil {
+			return fmt.Errorf("failed to insert reference: %v", err)
+		}
+	}
+
+	for _, op := range ops {
+		_, err = tx.Exec(`
+			INSERT INTO operations 
+			(id, task_id, operand1, operand2, operator, left_dependency, right_dependency, is_root, status, created_at, updated_at) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			op.ID, op.TaskID, op.Operand1, op.Operand2, op.Operator,
+			nullString(op.LeftDependency), nullString(op.RightDependency), op.IsRoot,
+			op.Status, op.CreatedAt, op.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert operation: %v", err)
+		}
+	}
+
+	if isFinalStatus(task.Status) {
+		return enqueueDeliveries(tx, task.ID, task.UpdatedAt)
+	}
+	return nil
+}
+
+// attachReferences runs in the transaction that inserts task. References to
+// tasks that have already completed are resolved at once, and a reference
+// to a task that can no longer complete fails the new task.
+func attachReferences(tx *sql.Tx, task *Task) error {
+	if len(task.References) == 0 {
+		return nil
+	}
+	var current string
+	if err := tx.QueryRow(`SELECT status FROM tasks WHERE id = ?`, task.ID).Scan(&current); err != nil {
+		return fmt.Errorf("failed to get task: %v", err)
+	}
+	if current != StatusWaiting {
+		// Already failed because another item of its batch did.
+		return nil
+	}
+
+	for _, ref := range task.References {
+		var status string
+		var result sql.NullFloat64
+		err := tx.QueryRow(`SELECT status, result FROM tasks WHERE id = ?`, ref).Scan(&status, &result)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get referenced task: %v", err)
+		}
+
+		if status == StatusCompleted {
+			if err := resolveReferences(tx, ref, result.Float64, task.CreatedAt); err != nil {
+				return err
+			}
+		} else if status == "" || isFinalStatus(status) {
+			return stopTask(tx, task.ID, "", StatusFailed, referenceFailure(ref, status), task.CreatedAt)
+		}
+	}
+	return nil
+}
+
+// resolveReferences feeds the result of a completed task into the tasks
+// that refer to it and releases those that no longer wait for anything.
+func resolveReferences(tx *sql.Tx, taskID string, result float64, now string) error {
+	if _, err := tx.Exec(`
+		UPDATE operations 
+		SET operand1 = ?, left_dependency = NULL, updated_at = ? 
+		WHERE left_dependency = ?`,
+		result, now, taskID); err != nil {
+		return fmt.Errorf("failed to resolve reference: %v", err)
+	}
+	if _, err := tx.Exec(`
+		UPDATE operations 
+		SET operand2 = ?, right_dependency = NULL, updated_at = ? 
+		WHERE right_dependency = ?`,
+		result, now, taskID); err != nil {
+		return fmt.Errorf("failed to resolve reference: %v", err)
+	}
+
+	dependents, err := waitingDependents(tx, taskID)
+	if err != nil {
+		return err
+	}
+	for _, id := range dependents {
+		var unresolved int
+		err := tx.QueryRow(`
+			SELECT COUNT(*) FROM operations o 
+			JOIN task_references r ON r.task_id = o.task_id 
+			WHERE o.task_id = ? AND r.referenced_task_id IN (o.left_dependency, o.right_dependency)`,
+			id).Scan(&unresolved)
+		if err != nil {
+			return fmt.Errorf("failed to count references: %v", err)
+		}
+		if unresolved > 0 {
+			continue
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE tasks 
+			SET status = ?, updated_at = ? 
+			WHERE id = ?`,
+			StatusPending, now, id); err != nil {
+			return fmt.Errorf("failed to release task: %v", err)
+		}
+		if _, err := tx.Exec(`
+			UPDATE operations 
+			SET status = ? 
+			WHERE task_id = ? AND status = ? AND left_dependency IS NULL AND right_dependency IS NULL`,
+			StatusPending, id, StatusWaiting); err != nil {
+			return fmt.Errorf("failed to release operations: %v", err)
+		}
+	}
+	return nil
+}
+
+// failDependents fails the tasks that are still waiting for taskID, which
+// has ended with status without a result (or was deleted, when status is
+// empty).
+func failDependents(tx *sql.Tx, taskID string, status string, now string) error {
+	dependents, err := waitingDependents(tx, taskID)
+	if err != nil {
+		return err
+	}
+	for _, id := range dependents {
+		if err := stopTask(tx, id, "", StatusFailed, referenceFailure(taskID, status), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitingDependents(tx *sql.Tx, taskID string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT r.task_id FROM task_references r 
+		JOIN tasks t ON t.id = r.task_id 
+		WHERE r.referenced_task_id = ? AND t.status = ?`,
+		taskID, StatusWaiting)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dependent tasks: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan dependent task: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStorage) GetDependentTasks(taskID string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT task_id FROM task_references WHERE referenced_task_id = ?`, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dependent tasks: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan dependent task: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStorage) GetBatch(id string, userLogin string) (*Batch, []*Task, error) {
+	var batch Batch
+	err := s.db.QueryRow(`
+		SELECT id, user_login, created_at 
+		FROM batches 
+		WHERE id = ? AND user_login = ?`,
+		id, userLogin).Scan(&batch.ID, &batch.UserLogin, &batch.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to get batch: %v", err)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+taskColumns+` 
+		FROM tasks 
+		WHERE batch_id = ? 
+		ORDER BY batch_index ASC`,
+		id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query batch tasks: %v", err)
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan task: %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return &batch, tasks, rows.Err()
+}
+
 func (s *SQLiteStorage) GetUserTasks(ctx context.Context, userLogin string) ([]*Task, error) {
-	query := `
-        SELECT id, expression, status, result, created_at, updated_at 
-        FROM tasks 
-        WHERE user_login = ? 
-        ORDER BY created_at DESC`
+	return s.QueryTasks(ctx, TaskQuery{UserLogin: userLogin, SortBy: SortCreatedAt, Descending: true})
+}
+
+// QueryTasks lists the tasks selected by query using keyset pagination on the
+// sort column and the task ID.
+func (s *SQLiteStorage) QueryTasks(ctx context.Context, query TaskQuery) ([]*Task, error) {
+	column := SortCreatedAt
+	if query.SortBy == SortUpdatedAt {
+		column = SortUpdatedAt
+	}
+	order, compare := "ASC", ">"
+	if query.Descending {
+		order, compare = "DESC", "<"
+	}
+
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if query.UserLogin != "" {
+		where = append(where, "user_login = ?")
+		args = append(args, query.UserLogin)
+	}
+	if query.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, query.Status)
+	}
+	if query.CreatedAfter != "" {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.CreatedAfter)
+	}
+	if query.CreatedBefore != "" {
+		where = append(where, "created_at < ?")
+		args = append(args, query.CreatedBefore)
+	}
+	if query.Contains != "" {
+		where = append(where, "instr(expression, ?) > 0")
+		args = append(args, query.Contains)
+	}
+	if query.After != nil {
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", column, compare))
+		args = append(args, query.After.Value, query.After.Value, query.After.ID)
+	}
+
+	sqlQuery := `SELECT ` + taskColumns + ` FROM tasks WHERE ` + strings.Join(where, " AND ") +
+		fmt.Sprintf(" ORDER BY %[1]s %[2]s, id %[2]s", column, order)
+	if query.Limit > 0 {
+		sqlQuery += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
 
-	rows, err := s.db.QueryContext(ctx, query, userLogin)
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query failed: %w", err)
 	}
@@ -77,19 +419,11 @@ func (s *SQLiteStorage) GetUserTasks(ctx context.Context, userLogin string) ([]*
 
 	var tasks []*Task
 	for rows.Next() {
-		var task Task
-		if err := rows.Scan(
-			&task.ID,
-			&task.Expression,
-			&task.Status,
-			&task.Result,
-			&task.CreatedAt,
-			&task.UpdatedAt,
-		); err != nil {
+		task, err := scanTask(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan failed: %w", err)
 		}
-		task.UserLogin = userLogin
-		tasks = append(tasks, &task)
+		tasks = append(tasks, task)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -99,54 +433,21 @@ func (s *SQLiteStorage) GetUserTasks(ctx context.Context, userLogin string) ([]*
 	return tasks, nil
 }
 
-func (s *SQLiteStorage) GetPendingTask() (*Task, error) {
-	row := s.db.QueryRow(`
-        SELECT id, expression, status, user_login, created_at
-        FROM tasks 
-        WHERE status = ? 
-        ORDER BY created_at ASC 
-        LIMIT 1`,
-		StatusPending)
-
-	var task Task
-	err := row.Scan(
-		&task.ID,
-		&task.Expression,
-		&task.Status,
-		&task.UserLogin,
-		&task.CreatedAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &task, nil
-}
-
 func (s *SQLiteStorage) GetTaskByID(id string, userLogin string) (*Task, error) {
 	row := s.db.QueryRow(`
-		SELECT id, expression, status, result, created_at, updated_at 
+		SELECT `+taskColumns+` 
 		FROM tasks 
 		WHERE id = ? AND user_login = ?`,
 		id, userLogin)
 
-	var task Task
-	err := row.Scan(
-		&task.ID,
-		&task.Expression,
-		&task.Status,
-		&task.Result,
-		&task.CreatedAt,
-		&task.UpdatedAt)
+	task, err := scanTask(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("failed to get task: %v", err)
 	}
-	task.UserLogin = userLogin
-	return &task, nil
+	return task, nil
 }
 
 func (s *SQLiteStorage) UpdateTask(task *Task) error {
@@ -177,79 +478,1440 @@ func (s *SQLiteStorage) UpdateTask(task *Task) error {
 	return tx.Commit()
 }
 
-func (s *SQLiteStorage) DeleteTask(id string, userLogin string) error {
-	_, err := s.db.Exec(`
-		DELETE FROM tasks 
-		WHERE id = ? AND user_login = ?`,
-		id, userLogin)
+// ClaimOperation atomically leases the next pending operation to owner. Higher
+// priority tasks go first; within a priority users take turns, so whoever was
+// served longest ago gets the next operation, and a user's own operations
+// run oldest first. The lease has to be completed before it expires, otherwise the operation is
+// returned to the queue by ReleaseExpiredLeases.
+func (s *SQLiteStorage) ClaimOperation(owner string, lease time.Duration) (*Operation, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to delete task: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-func (s *SQLiteStorage) GetTasksByStatus(userLogin string, status string) ([]*Task, error) {
-	rows, err := s.db.Query(`
-		SELECT id, expression, status, result, created_at, updated_at 
-		FROM tasks 
-		WHERE user_login = ? AND status = ? 
-		ORDER BY created_at DESC`,
-		userLogin, status)
+	now := time.Now().UTC()
+	row := tx.QueryRow(`
+		UPDATE operations 
+		SET status = ?, lease_owner = ?, lease_expires_at = ?, updated_at = ? 
+		WHERE id = (
+			SELECT o.id FROM operations o 
+			JOIN tasks t ON t.id = o.task_id 
+			LEFT JOIN user_dispatch d ON d.user_login = t.user_login 
+			WHERE o.status = ? AND (o.next_attempt_at IS NULL OR o.next_attempt_at <= ?) 
+			ORDER BY t.priority DESC, COALESCE(d.last_dispatch, 0) ASC, o.created_at ASC 
+			LIMIT 1
+		)
+		RETURNING `+operationColumns,
+		StatusInProgress, owner, now.Add(lease).Format(time.RFC3339), now.Format(time.RFC3339),
+		StatusPending, now.Format(time.RFC3339))
+
+	op, err := scanOperation(row)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query tasks: %v", err)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to claim operation: %v", err)
 	}
-	defer rows.Close()
 
-	var tasks []*Task
-	for rows.Next() {
-		var task Task
-		err := rows.Scan(
-			&task.ID,
-			&task.Expression,
-			&task.Status,
-			&task.Result,
-			&task.CreatedAt,
-			&task.UpdatedAt)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan task: %v", err)
-		}
-		task.UserLogin = userLogin
-		tasks = append(tasks, &task)
+	_, err = tx.Exec(`
+		UPDATE tasks 
+		SET status = ?, updated_at = ? 
+		WHERE id = ? AND status = ?`,
+		StatusInProgress, now.Format(time.RFC3339), op.TaskID, StatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update task: %v", err)
 	}
-	return tasks, nil
-}
 
-func (s *SQLiteStorage) CreateUser(user *User) error {
-	_, err := s.db.Exec(`
-		INSERT INTO users 
-		(login, password_hash, created_at) 
-		VALUES (?, ?, ?)`,
-		user.Login,
-		user.PasswordHash,
-		time.Now().UTC().Format(time.RFC3339))
+	_, err = tx.Exec(`
+		INSERT INTO user_dispatch (user_login, last_dispatch) 
+		SELECT user_login, (SELECT COALESCE(MAX(last_dispatch), 0) + 1 FROM user_dispatch) 
+		FROM tasks WHERE id = ? 
+		ON CONFLICT (user_login) DO UPDATE SET last_dispatch = excluded.last_dispatch`,
+		op.TaskID)
 	if err != nil {
-		return fmt.Errorf("failed to create user: %v", err)
+		return nil, fmt.Errorf("failed to record dispatch: %v", err)
 	}
-	return nil
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit claim: %v", err)
+	}
+	return op, nil
 }
 
-func (s *SQLiteStorage) GetUser(login string) (*User, error) {
+func (s *SQLiteStorage) GetOperation(id string) (*Operation, error) {
 	row := s.db.QueryRow(`
-		SELECT login, password_hash, created_at 
-		FROM users 
-		WHERE login = ?`,
-		login)
+		SELECT `+operationColumns+` 
+		FROM operations 
+		WHERE id = ?`,
+		id)
 
-	var user User
-	err := row.Scan(
-		&user.Login,
-		&user.PasswordHash,
-		&user.CreatedAt)
+	op, err := scanOperation(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("failed to get user: %v", err)
+		return nil, fmt.Errorf("failed to get operation: %v", err)
 	}
-	return &user, nil
+	return op, nil
+}
+
+// ReleaseExpiredLeases gives operations whose lease has expired another
+// attempt.
+func (s *SQLiteStorage) ReleaseExpiredLeases() ([]string, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return s.retryLeased(`o.lease_expires_at < ?`, now, Failure{
+		Code:    ErrorCodeTimeout,
+		Message: "lease expired before the agent reported a result",
+	})
+}
+
+// RequeueAgentOperations gives every operation leased by owner another
+// attempt.
+func (s *SQLiteStorage) RequeueAgentOperations(owner string) ([]string, error) {
+	return s.retryLeased(`o.lease_owner = ?`, owner, Failure{
+		Code:    ErrorCodeAgentLost,
+		Message: "agent stopped sending heartbeats",
+	})
+}
+
+func (s *SQLiteStorage) retryLeased(condition string, arg interface{}, failure Failure) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT o.id, o.task_id, o.attempts, t.max_attempts, COALESCE(o.lease_owner, '') 
+		FROM operations o 
+		JOIN tasks t ON t.id = o.task_id 
+		WHERE o.status = ? AND `+condition,
+		StatusInProgress, arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query leases: %v", err)
+	}
+
+	var leases []operationLease
+	for rows.Next() {
+		var lease operationLease
+		if err := rows.Scan(&lease.id, &lease.taskID, &lease.attempts, &lease.maxAttempts, &lease.owner); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan lease: %v", err)
+		}
+		leases = append(leases, lease)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var taskIDs []string
+	for _, lease := range leases {
+		if err := s.retryOperation(tx, lease, failure, now); err != nil {
+			return nil, err
+		}
+		taskIDs = append(taskIDs, lease.taskID)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %v", err)
+	}
+	return taskIDs, nil
+}
+
+// CompleteOperation stores the result of an operation and feeds it into the
+// operations that depend on it. Completing the root operation completes the
+// whole task.
+func (s *SQLiteStorage) CompleteOperation(id string, owner string, result float64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	lease, err := leasedOperation(tx, id, owner)
+	if err != nil {
+		return err
+	}
+	taskID := lease.taskID
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err = tx.Exec(`
+		UPDATE operations 
+		SET status = ?, result = ?, lease_owner = NULL, lease_expires_at = NULL, updated_at = ? 
+		WHERE id = ?`,
+		StatusCompleted, result, now, id); err != nil {
+		return fmt.Errorf("failed to update operation: %v", err)
+	}
+
+	if lease.isRoot {
+		if _, err = tx.Exec(`
+			UPDATE tasks 
+			SET status = ?, result = ?, updated_at = ? 
+			WHERE id = ?`,
+			StatusCompleted, result, now, taskID); err != nil {
+			return fmt.Errorf("failed to update task: %v", err)
+		}
+		if err := enqueueDeliveries(tx, taskID, now); err != nil {
+			return err
+		}
+		if err := resolveReferences(tx, taskID, result, now); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err = tx.Exec(`
+		UPDATE operations 
+		SET operand1 = ?, left_dependency = NULL, updated_at = ? 
+		WHERE left_dependency = ?`,
+		result, now, id); err != nil {
+		return fmt.Errorf("failed to resolve dependency: %v", err)
+	}
+	if _, err = tx.Exec(`
+		UPDATE operations 
+		SET operand2 = ?, right_dependency = NULL, updated_at = ? 
+		WHERE right_dependency = ?`,
+		result, now, id); err != nil {
+		return fmt.Errorf("failed to resolve dependency: %v", err)
+	}
+	if _, err = tx.Exec(`
+		UPDATE operations 
+		SET status = ? 
+		WHERE task_id = ? AND status = ? AND left_dependency IS NULL AND right_dependency IS NULL`,
+		StatusPending, taskID, StatusWaiting); err != nil {
+		return fmt.Errorf("failed to release operations: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+type operationLease struct {
+	id          string
+	taskID      string
+	owner       string
+	isRoot      bool
+	attempts    int
+	maxAttempts int
+}
+
+// leasedOperation looks up an operation that owner is about to report on.
+// Only the agent holding the lease can report on it.
+func leasedOperation(tx *sql.Tx, id string, owner string) (operationLease, error) {
+	var lease operationLease
+	var status string
+	var leaseOwner sql.NullString
+	err := tx.QueryRow(`
+		SELECT o.task_id, o.is_root, o.status, o.lease_owner, o.attempts, t.max_attempts 
+		FROM operations o 
+		JOIN tasks t ON t.id = o.task_id 
+		WHERE o.id = ?`,
+		id).Scan(&lease.taskID, &lease.isRoot, &status, &leaseOwner, &lease.attempts, &lease.maxAttempts)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return lease, ErrOperationNotFound
+		}
+		return lease, fmt.Errorf("failed to get operation: %v", err)
+	}
+
+	if status == StatusCancelled {
+		return lease, ErrOperationCancelled
+	}
+	if status != StatusInProgress || owner == "" || leaseOwner.String != owner {
+		return lease, ErrOperationNotFound
+	}
+	lease.id = id
+	lease.owner = leaseOwner.String
+	return lease, nil
+}
+
+// retryOperation puts a failed operation back into the queue after a backoff
+// delay, or moves the whole task to the dead-letter state when it has used
+// up its attempts.
+func (s *SQLiteStorage) retryOperation(tx *sql.Tx, lease operationLease, failure Failure, now time.Time) error {
+	attempts := lease.attempts + 1
+	timestamp := now.Format(time.RFC3339)
+	failure.AgentID = lease.owner
+	failure.OperationID = lease.id
+
+	if attempts >= lease.maxAttempts {
+		if _, err := tx.Exec(`
+			UPDATE operations 
+			SET attempts = ?, last_error = ? 
+			WHERE id = ?`,
+			attempts, failure.Message, lease.id); err != nil {
+			return fmt.Errorf("failed to update operation: %v", err)
+		}
+		return stopTask(tx, lease.taskID, lease.id, StatusDeadLetter, failure, timestamp)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE operations 
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, lease_owner = NULL, lease_expires_at = NULL, updated_at = ? 
+		WHERE id = ?`,
+		StatusPending, attempts, now.Add(s.retry.Backoff(attempts)).Format(time.RFC3339), failure.Message,
+		timestamp, lease.id); err != nil {
+		return fmt.Errorf("failed to requeue operation: %v", err)
+	}
+	if _, err := tx.Exec(`
+		UPDATE tasks 
+		SET retries = retries + 1, updated_at = ? 
+		WHERE id = ?`,
+		timestamp, lease.taskID); err != nil {
+		return fmt.Errorf("failed to update task: %v", err)
+	}
+	return nil
+}
+
+// stopTask moves a task and its unfinished operations to status (Failed or
+// DeadLetter) and records why. Other operations that are being computed are
+// cancelled like in CancelTask, so their agents are told to drop them and
+// they are never handed out again. Tasks waiting for its result fail too.
+func stopTask(tx *sql.Tx, taskID string, opID string, status string, failure Failure, now string) error {
+	if _, err := tx.Exec(`
+		UPDATE operations 
+		SET status = ?, lease_expires_at = NULL, updated_at = ? 
+		WHERE task_id = ? AND id != ? AND status = ?`,
+		StatusCancelled, now, taskID, opID, StatusInProgress); err != nil {
+		return fmt.Errorf("failed to cancel operations: %v", err)
+	}
+	if _, err := tx.Exec(`
+		UPDATE operations 
+		SET status = ?, lease_owner = NULL, lease_expires_at = NULL, updated_at = ? 
+		WHERE id = ? OR (task_id = ? AND status IN (?, ?))`,
+		status, now, opID, taskID, StatusPending, StatusWaiting); err != nil {
+		return fmt.Errorf("failed to update operations: %v", err)
+	}
+	if _, err := tx.Exec(`
+		UPDATE tasks 
+		SET status = ?, error_code = ?, error_message = ?, failed_by = ?, failed_operation = ?, failed_at = ?, updated_at = ? 
+		WHERE id = ?`,
+		status, failure.Code, failure.Message, nullString(failure.AgentID), nullString(opID), now, now, taskID); err != nil {
+		return fmt.Errorf("failed to update task: %v", err)
+	}
+	if err := enqueueDeliveries(tx, taskID, now); err != nil {
+		return err
+	}
+	return failDependents(tx, taskID, status, now)
+}
+
+// FailOperation records that an operation could not be computed. Transient
+// failures are retried according to the retry policy; any other failure, or
+// running out of attempts, stops the whole task so its remaining operations
+// are never handed out.
+func (s *SQLiteStorage) FailOperation(id string, owner string, failure Failure) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	lease, err := leasedOperation(tx, id, owner)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if IsRetryable(failure.Code) {
+		err = s.retryOperation(tx, lease, failure, now)
+	} else {
+		failure.AgentID = lease.owner
+		err = stopTask(tx, lease.taskID, id, StatusFailed, failure, now.Format(time.RFC3339))
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelTask stops a task that has not finished yet. Its unfinished
+// operations are cancelled too; operations that are being computed keep their
+// lease owner so the agent can be told to drop them.
+func (s *SQLiteStorage) CancelTask(id string, userLogin string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT status FROM tasks WHERE id = ? AND user_login = ?`, id, userLogin).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTaskNotFound
+		}
+		return fmt.Errorf("failed to get task: %v", err)
+	}
+	if isFinalStatus(status) {
+		return ErrTaskFinished
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err = tx.Exec(`
+		UPDATE operations 
+		SET status = ?, lease_expires_at = NULL, updated_at = ? 
+		WHERE task_id = ? AND status IN (?, ?, ?)`,
+		StatusCancelled, now, id, StatusPending, StatusWaiting, StatusInProgress); err != nil {
+		return fmt.Errorf("failed to cancel operations: %v", err)
+	}
+	if _, err = tx.Exec(`
+		UPDATE tasks 
+		SET status = ?, updated_at = ? 
+		WHERE id = ?`,
+		StatusCancelled, now, id); err != nil {
+		return fmt.Errorf("failed to cancel task: %v", err)
+	}
+	if err := enqueueDeliveries(tx, id, now); err != nil {
+		return err
+	}
+	if err := failDependents(tx, id, StatusCancelled, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TakeCancelledOperations returns the cancelled operations that owner was
+// computing and forgets the lease, so each one is reported only once.
+func (s *SQLiteStorage) TakeCancelledOperations(owner string) ([]string, error) {
+	rows, err := s.db.Query(`
+		UPDATE operations 
+		SET lease_owner = NULL 
+		WHERE status = ? AND lease_owner = ? 
+		RETURNING id`,
+		StatusCancelled, owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take cancelled operations: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStorage) CountActiveTasks(userLogin string) (int, error) {
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM tasks 
+		WHERE user_login = ? AND status IN (?, ?, ?)`,
+		userLogin, StatusPending, StatusWaiting, StatusInProgress).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count tasks: %v", err)
+	}
+	return count, nil
+}
+
+func (s *SQLiteStorage) GetTask(id string) (*Task, error) {
+	task, err := scanTask(s.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get task: %v", err)
+	}
+	return task, nil
+}
+
+func (s *SQLiteStorage) ListTasksByStatus(status string) ([]*Task, error) {
+	rows, err := s.db.Query(`
+		SELECT `+taskColumns+` 
+		FROM tasks 
+		WHERE status = ? 
+		ORDER BY created_at DESC`,
+		status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %v", err)
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (s *SQLiteStorage) GetTaskOperations(taskID string) ([]*Operation, error) {
+	rows, err := s.db.Query(`
+		SELECT `+operationColumns+` 
+		FROM operations 
+		WHERE task_id = ? 
+		ORDER BY created_at ASC, rowid ASC`,
+		taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query operations: %v", err)
+	}
+	defer rows.Close()
+
+	var ops []*Operation
+	for rows.Next() {
+		op, err := scanOperation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %v", err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+// RequeueTask gives a dead-letter task a fresh set of attempts. Operations
+// cancelled when the task stopped are queued again as well.
+func (s *SQLiteStorage) RequeueTask(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT status FROM tasks WHERE id = ?`, id).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTaskNotFound
+		}
+		return fmt.Errorf("failed to get task: %v", err)
+	}
+	if status != StatusDeadLetter {
+		return ErrTaskNotDeadLetter
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err = tx.Exec(`
+		UPDATE operations 
+		SET status = CASE WHEN left_dependency IS NULL AND right_dependency IS NULL THEN ? ELSE ? END, 
+			attempts = 0, next_attempt_at = NULL, lease_owner = NULL, updated_at = ? 
+		WHERE task_id = ? AND status IN (?, ?)`,
+		StatusPending, StatusWaiting, now, id, StatusDeadLetter, StatusCancelled); err != nil {
+		return fmt.Errorf("failed to requeue operations: %v", err)
+	}
+	if _, err = tx.Exec(`
+		UPDATE tasks 
+		SET status = ?, error_code = NULL, error_message = NULL, failed_by = NULL, failed_operation = NULL, failed_at = NULL, updated_at = ? 
+		WHERE id = ?`,
+		StatusPending, now, id); err != nil {
+		return fmt.Errorf("failed to requeue task: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) DeleteTask(id string, userLogin string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		DELETE FROM tasks 
+		WHERE id = ? AND user_login = ?`,
+		id, userLogin)
+	if err != nil {
+		return fmt.Errorf("failed to delete task: %v", err)
+	}
+	if deleted, _ := res.RowsAffected(); deleted == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM operations WHERE task_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete operations: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM task_references WHERE task_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete references: %v", err)
+	}
+	if err := failDependents(tx, id, "", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) GetTasksByStatus(userLogin string, status string) ([]*Task, error) {
+	return s.QueryTasks(context.Background(), TaskQuery{
+		UserLogin: userLogin, Status: status, SortBy: SortCreatedAt, Descending: true,
+	})
+}
+
+func (s *SQLiteStorage) CreateUser(user *User) error {
+	role := user.Role
+	if role == "" {
+		role = RoleUser
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO users 
+		(login, password_hash, role, disabled, created_at) 
+		VALUES (?, ?, ?, ?, ?)`,
+		user.Login,
+		user.PasswordHash,
+		role,
+		user.Disabled,
+		user.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			return ErrUserExists
+		}
+		return fmt.Errorf("failed to create user: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetUser(login string) (*User, error) {
+	user, err := scanUser(s.db.QueryRow(`
+		SELECT login, password_hash, role, disabled, created_at 
+		FROM users 
+		WHERE login = ? COLLATE NOCASE`,
+		login))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+	return user, nil
+}
+
+func (s *SQLiteStorage) ListUsers() ([]*User, error) {
+	rows, err := s.db.Query(`
+		SELECT login, password_hash, role, disabled, created_at 
+		FROM users 
+		ORDER BY login COLLATE NOCASE ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteStorage) UpdateUser(user *User) error {
+	res, err := s.db.Exec(`
+		UPDATE users 
+		SET role = ?, disabled = ? 
+		WHERE login = ? COLLATE NOCASE`,
+		user.Role, user.Disabled, user.Login)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	var createdAt string
+	if err := row.Scan(&user.Login, &user.PasswordHash, &user.Role, &user.Disabled, &createdAt); err != nil {
+		return nil, err
+	}
+	user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return &user, nil
+}
+
+func (s *SQLiteStorage) CreateWebhook(hook *Webhook) error {
+	_, err := s.db.Exec(`
+		INSERT INTO webhooks (id, user_login, url, secret, created_at) 
+		VALUES (?, ?, ?, ?, ?)`,
+		hook.ID, hook.UserLogin, hook.URL, hook.Secret, hook.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetUserWebhooks(userLogin string) ([]*Webhook, error) {
+	return queryWebhooks(s.db, userLogin)
+}
+
+func (s *SQLiteStorage) DeleteWebhook(id string, userLogin string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM webhooks WHERE id = ? AND user_login = ?`, id, userLogin)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+
+	if _, err = tx.Exec(`
+		UPDATE webhook_deliveries 
+		SET status = ?, next_attempt_at = NULL, updated_at = ? 
+		WHERE webhook_id = ? AND status = ?`,
+		DeliveryFailed, time.Now().UTC().Format(time.RFC3339), id, DeliveryPending); err != nil {
+		return fmt.Errorf("failed to cancel deliveries: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) DueDeliveries(now time.Time, limit int) ([]*Delivery, error) {
+	rows, err := s.db.Query(`
+		SELECT `+deliveryColumns+`, COALESCE(w.secret, '') 
+		FROM webhook_deliveries d 
+		LEFT JOIN webhooks w ON w.id = d.webhook_id 
+		WHERE d.status = ? AND d.next_attempt_at <= ? 
+		ORDER BY d.next_attempt_at ASC 
+		LIMIT ?`,
+		DeliveryPending, now.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		var secret string
+		d, err := scanDelivery(rows, &secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan delivery: %v", err)
+		}
+		d.secret = secret
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLiteStorage) RecordDeliveryAttempt(delivery *Delivery, attempt DeliveryAttempt) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`
+		UPDATE webhook_deliveries 
+		SET status = ?, attempts = ?, next_attempt_at = ?, updated_at = ? 
+		WHERE id = ?`,
+		delivery.Status, delivery.Attempts, nullString(delivery.NextAttemptAt), delivery.UpdatedAt,
+		delivery.ID); err != nil {
+		return fmt.Errorf("failed to update delivery: %v", err)
+	}
+
+	if _, err = tx.Exec(`
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, attempted_at) 
+		VALUES (?, ?, ?, ?, ?)`,
+		delivery.ID, attempt.Attempt, attempt.StatusCode, nullString(attempt.Error),
+		attempt.AttemptedAt); err != nil {
+		return fmt.Errorf("failed to insert attempt: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) GetUserDeliveries(userLogin string, taskID string) ([]*Delivery, error) {
+	rows, err := s.db.Query(`
+		SELECT `+deliveryColumns+` 
+		FROM webhook_deliveries d 
+		WHERE d.user_login = ? AND (? = '' OR d.task_id = ?) 
+		ORDER BY d.created_at DESC`,
+		userLogin, taskID, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deliveries: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	byID := make(map[string]*Delivery)
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan delivery: %v", err)
+		}
+		deliveries = append(deliveries, d)
+		byID[d.ID] = d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	attempts, err := s.db.Query(`
+		SELECT a.delivery_id, a.attempt, COALESCE(a.status_code, 0), COALESCE(a.error, ''), a.attempted_at 
+		FROM webhook_attempts a 
+		JOIN webhook_deliveries d ON d.id = a.delivery_id 
+		WHERE d.user_login = ? AND (? = '' OR d.task_id = ?) 
+		ORDER BY a.attempt ASC`,
+		userLogin, taskID, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attempts: %v", err)
+	}
+	defer attempts.Close()
+
+	for attempts.Next() {
+		var deliveryID string
+		var attempt DeliveryAttempt
+		if err := attempts.Scan(&deliveryID, &attempt.Attempt, &attempt.StatusCode, &attempt.Error, &attempt.AttemptedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan attempt: %v", err)
+		}
+		if d := byID[deliveryID]; d != nil {
+			d.History = append(d.History, attempt)
+		}
+	}
+	return deliveries, attempts.Err()
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func queryWebhooks(db queryer, userLogin string) ([]*Webhook, error) {
+	rows, err := db.Query(`
+		SELECT id, user_login, url, secret, created_at 
+		FROM webhooks 
+		WHERE user_login = ? 
+		ORDER BY created_at ASC`,
+		userLogin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	var hooks []*Webhook
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.ID, &hook.UserLogin, &hook.URL, &hook.Secret, &hook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		hooks = append(hooks, &hook)
+	}
+	return hooks, rows.Err()
+}
+
+// enqueueDeliveries queues webhook deliveries for a task that has just
+// reached a final status, inside the transaction that finished it.
+func enqueueDeliveries(tx *sql.Tx, taskID string, now string) error {
+	task, err := scanTask(tx.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, taskID))
+	if err != nil {
+		return fmt.Errorf("failed to load task: %v", err)
+	}
+	hooks, err := queryWebhooks(tx, task.UserLogin)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range newDeliveries(task, hooks, now) {
+		if _, err := tx.Exec(`
+			INSERT INTO webhook_deliveries 
+			(id, task_id, webhook_id, user_login, url, event, status, attempts, next_attempt_at, created_at, updated_at) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			d.ID, d.TaskID, nullString(d.WebhookID), d.UserLogin, d.URL, d.Event, d.Status,
+			d.Attempts, d.NextAttemptAt, d.CreatedAt, d.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to queue delivery: %v", err)
+		}
+	}
+	return nil
+}
+
+const deliveryColumns = `d.id, d.task_id, d.webhook_id, d.user_login, d.url, d.event, d.status,
+	d.attempts, d.next_attempt_at, d.created_at, d.updated_at`
+
+func scanDelivery(row rowScanner, extra ...interface{}) (*Delivery, error) {
+	var d Delivery
+	var webhookID, nextAttemptAt sql.NullString
+	dest := []interface{}{
+		&d.ID,
+		&d.TaskID,
+		&webhookID,
+		&d.UserLogin,
+		&d.URL,
+		&d.Event,
+		&d.Status,
+		&d.Attempts,
+		&nextAttemptAt,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	d.WebhookID = webhookID.String
+	d.NextAttemptAt = nextAttemptAt.String
+	return &d, nil
+}
+
+const taskColumns = `id, expression, status, result, user_login, created_at, updated_at,
+	error_code, error_message, failed_by, failed_operation, failed_at, callback_url, retries, max_attempts, priority, batch_id, label, workspace_id, variables, referenced_tasks`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTask(row rowScanner) (*Task, error) {
+	var task Task
+	var result sql.NullFloat64
+	var errorCode, errorMessage, failedBy, failedOperation, failedAt, callbackURL, batchID, label sql.NullString
+	var workspaceID, variables, references sql.NullString
+	err := row.Scan(
+		&task.ID,
+		&task.Expression,
+		&task.Status,
+		&result,
+		&task.UserLogin,
+		&task.CreatedAt,
+		&task.UpdatedAt,
+		&errorCode,
+		&errorMessage,
+		&failedBy,
+		&failedOperation,
+		&failedAt,
+		&callbackURL,
+		&task.Retries,
+		&task.MaxAttempts,
+		&task.Priority,
+		&batchID,
+		&label,
+		&workspaceID,
+		&variables,
+		&references)
+	if err != nil {
+		return nil, err
+	}
+
+	task.Result = result.Float64
+	task.CallbackURL = callbackURL.String
+	task.BatchID = batchID.String
+	task.Label = label.String
+	task.WorkspaceID = workspaceID.String
+	if variables.Valid {
+		if err := json.Unmarshal([]byte(variables.String), &task.Variables); err != nil {
+			return nil, fmt.Errorf("invalid variables of task %s: %v", task.ID, err)
+		}
+	}
+	if references.Valid {
+		if err := json.Unmarshal([]byte(references.String), &task.References); err != nil {
+			return nil, fmt.Errorf("invalid references of task %s: %v", task.ID, err)
+		}
+	}
+	if errorCode.Valid {
+		task.Failure = &Failure{
+			Code:        errorCode.String,
+			Message:     errorMessage.String,
+			AgentID:     failedBy.String,
+			OperationID: failedOperation.String,
+			FailedAt:    failedAt.String,
+		}
+	}
+	return &task, nil
+}
+
+const operationColumns = `id, task_id, operand1, operand2, operator, left_dependency, right_dependency,
+	is_root, status, result, lease_owner, lease_expires_at, attempts, next_attempt_at, last_error,
+	created_at, updated_at`
+
+func scanOperation(row rowScanner) (*Operation, error) {
+	var op Operation
+	var result sql.NullFloat64
+	var leftDependency, rightDependency, leaseOwner, leaseExpiresAt, nextAttemptAt, lastError sql.NullString
+	err := row.Scan(
+		&op.ID,
+		&op.TaskID,
+		&op.Operand1,
+		&op.Operand2,
+		&op.Operator,
+		&leftDependency,
+		&rightDependency,
+		&op.IsRoot,
+		&op.Status,
+		&result,
+		&leaseOwner,
+		&leaseExpiresAt,
+		&op.Attempts,
+		&nextAttemptAt,
+		&lastError,
+		&op.CreatedAt,
+		&op.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	op.LeftDependency = leftDependency.String
+	op.RightDependency = rightDependency.String
+	op.Result = result.Float64
+	op.LeaseOwner = leaseOwner.String
+	op.LeaseExpiresAt = leaseExpiresAt.String
+	op.NextAttemptAt = nextAttemptAt.String
+	op.LastError = lastError.String
+	return &op, nil
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func (s *SQLiteStorage) ReserveIdempotencyKey(record *IdempotencyRecord, notBefore time.Time) (*IdempotencyRecord, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM idempotency_keys 
+		WHERE user_login = ? AND key = ? AND created_at < ?`,
+		record.UserLogin, record.Key, notBefore.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire idempotency key: %v", err)
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO idempotency_keys (user_login, key, request_hash, created_at) 
+		VALUES (?, ?, ?, ?) 
+		ON CONFLICT (user_login, key) DO NOTHING`,
+		record.UserLogin, record.Key, record.RequestHash, record.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve idempotency key: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, tx.Commit()
+	}
+
+	var existing IdempotencyRecord
+	var contentType, response sql.NullString
+	err = tx.QueryRow(`
+		SELECT user_login, key, request_hash, status_code, content_type, response, created_at 
+		FROM idempotency_keys 
+		WHERE user_login = ? AND key = ?`,
+		record.UserLogin, record.Key).Scan(
+		&existing.UserLogin, &existing.Key, &existing.RequestHash, &existing.StatusCode,
+		&contentType, &response, &existing.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %v", err)
+	}
+	existing.ContentType = contentType.String
+	existing.Response = response.String
+	return &existing, tx.Commit()
+}
+
+func (s *SQLiteStorage) CompleteIdempotencyKey(record *IdempotencyRecord) error {
+	_, err := s.db.Exec(`
+		UPDATE idempotency_keys 
+		SET status_code = ?, content_type = ?, response = ? 
+		WHERE user_login = ? AND key = ?`,
+		record.StatusCode, nullString(record.ContentType), record.Response, record.UserLogin, record.Key)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) ReleaseIdempotencyKey(userLogin string, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE user_login = ? AND key = ?`, userLogin, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) PurgeIdempotencyKeys(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, before.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLiteStorage) CreateWorkspace(workspace *Workspace) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO workspaces (id, user_login, name, created_at) 
+		VALUES (?, ?, ?, ?)`,
+		workspace.ID, workspace.UserLogin, workspace.Name, workspace.CreatedAt)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+			return ErrWorkspaceExists
+		}
+		return fmt.Errorf("failed to insert workspace: %v", err)
+	}
+
+	for name, value := range workspace.Variables {
+		_, err = tx.Exec(`
+			INSERT INTO workspace_variables (workspace_id, name, value, updated_at) 
+			VALUES (?, ?, ?, ?)`,
+			workspace.ID, name, value, workspace.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to insert variable: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) GetUserWorkspaces(userLogin string) ([]*Workspace, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_login, name, created_at 
+		FROM workspaces 
+		WHERE user_login = ? 
+		ORDER BY name ASC`,
+		userLogin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspaces: %v", err)
+	}
+	defer rows.Close()
+
+	var workspaces []*Workspace
+	byID := make(map[string]*Workspace)
+	for rows.Next() {
+		workspace := &Workspace{Variables: make(map[string]float64)}
+		if err := rows.Scan(&workspace.ID, &workspace.UserLogin, &workspace.Name, &workspace.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan workspace: %v", err)
+		}
+		workspaces = append(workspaces, workspace)
+		byID[workspace.ID] = workspace
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	vars, err := s.db.Query(`
+		SELECT v.workspace_id, v.name, v.value 
+		FROM workspace_variables v 
+		JOIN workspaces w ON w.id = v.workspace_id 
+		WHERE w.user_login = ?`,
+		userLogin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query variables: %v", err)
+	}
+	defer vars.Close()
+
+	for vars.Next() {
+		var workspaceID, name string
+		var value float64
+		if err := vars.Scan(&workspaceID, &name, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan variable: %v", err)
+		}
+		if workspace, ok := byID[workspaceID]; ok {
+			workspace.Variables[name] = value
+		}
+	}
+	return workspaces, vars.Err()
+}
+
+func (s *SQLiteStorage) GetWorkspace(id string, userLogin string) (*Workspace, error) {
+	workspace := &Workspace{Variables: make(map[string]float64)}
+	err := s.db.QueryRow(`
+		SELECT id, user_login, name, created_at 
+		FROM workspaces 
+		WHERE id = ? AND user_login = ?`,
+		id, userLogin).Scan(&workspace.ID, &workspace.UserLogin, &workspace.Name, &workspace.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get workspace: %v", err)
+	}
+
+	rows, err := s.db.Query(`SELECT name, value FROM workspace_variables WHERE workspace_id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query variables: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan variable: %v", err)
+		}
+		workspace.Variables[name] = value
+	}
+	return workspace, rows.Err()
+}
+
+func (s *SQLiteStorage) DeleteWorkspace(id string, userLogin string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM workspaces WHERE id = ? AND user_login = ?`, id, userLogin)
+	if err != nil {
+		return fmt.Errorf("failed to delete workspace: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWorkspaceNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM workspace_variables WHERE workspace_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete variables: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) SetVariable(workspaceID string, userLogin string, name string, value float64) error {
+	res, err := s.db.Exec(`
+		INSERT INTO workspace_variables (workspace_id, name, value, updated_at) 
+		SELECT id, ?, ?, ? FROM workspaces WHERE id = ? AND user_login = ? 
+		ON CONFLICT (workspace_id, name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		name, value, time.Now().UTC().Format(time.RFC3339), workspaceID, userLogin)
+	if err != nil {
+		return fmt.Errorf("failed to set variable: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWorkspaceNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DeleteVariable(workspaceID string, userLogin string, name string) error {
+	var exists int
+	err := s.db.QueryRow(`SELECT 1 FROM workspaces WHERE id = ? AND user_login = ?`, workspaceID, userLogin).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get workspace: %v", err)
+	}
+
+	res, err := s.db.Exec(`DELETE FROM workspace_variables WHERE workspace_id = ? AND name = ?`, workspaceID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete variable: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrVariableNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) CreateAgentCredential(credential *AgentCredential, tokenHash string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO agent_credentials (id, name, token_hash, created_by, created_at) 
+		VALUES (?, ?, ?, ?, ?)`,
+		credential.ID, credential.Name, tokenHash, credential.CreatedBy, credential.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert agent credential: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) ListAgentCredentials() ([]*AgentCredential, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, created_by, created_at, revoked_at 
+		FROM agent_credentials 
+		ORDER BY created_at ASC, id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query agent credentials: %v", err)
+	}
+	defer rows.Close()
+
+	var credentials []*AgentCredential
+	for rows.Next() {
+		credential, err := scanAgentCredential(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan agent credential: %v", err)
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, rows.Err()
+}
+
+func (s *SQLiteStorage) GetAgentCredentialByToken(tokenHash string) (*AgentCredential, error) {
+	credential, err := scanAgentCredential(s.db.QueryRow(`
+		SELECT id, name, created_by, created_at, revoked_at 
+		FROM agent_credentials 
+		WHERE token_hash = ?`,
+		tokenHash))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get agent credential: %v", err)
+	}
+	return credential, nil
+}
+
+// RevokeAgentCredential marks the credential as revoked. Revoking it again
+// keeps the original time.
+func (s *SQLiteStorage) RevokeAgentCredential(id string, revokedAt string) error {
+	res, err := s.db.Exec(`
+		UPDATE agent_credentials 
+		SET revoked_at = COALESCE(revoked_at, ?) 
+		WHERE id = ?`,
+		revokedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke agent credential: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAgentCredentialNotFound
+	}
+	return nil
+}
+
+func scanAgentCredential(row rowScanner) (*AgentCredential, error) {
+	var credential AgentCredential
+	var revokedAt sql.NullString
+	if err := row.Scan(&credential.ID, &credential.Name, &credential.CreatedBy, &credential.CreatedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	credential.RevokedAt = revokedAt.String
+	return &credential, nil
+}
+
+func (s *SQLiteStorage) CreateRefreshToken(token *RefreshToken, tokenHash string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO refresh_tokens (id, family_id, user_login, token_hash, created_at, expires_at) 
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		token.ID, token.FamilyID, token.UserLogin, tokenHash, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert refresh token: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) RotateRefreshToken(tokenHash string, next *RefreshToken, nextHash string, now string) (*RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var token RefreshToken
+	var rotatedAt, revokedAt sql.NullString
+	err = tx.QueryRow(`
+		SELECT id, family_id, user_login, created_at, expires_at, rotated_at, revoked_at 
+		FROM refresh_tokens 
+		WHERE token_hash = ?`,
+		tokenHash).Scan(&token.ID, &token.FamilyID, &token.UserLogin, &token.CreatedAt, &token.ExpiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %v", err)
+	}
+	token.RotatedAt = rotatedAt.String
+	token.RevokedAt = revokedAt.String
+
+	reused := token.RotatedAt != ""
+	if !reused {
+		if token.RevokedAt != "" {
+			return &token, ErrRefreshTokenRevoked
+		}
+		if token.ExpiresAt <= now {
+			return &token, ErrRefreshTokenExpired
+		}
+
+		res, err := tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE id = ? AND rotated_at IS NULL`, now, token.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rotate refresh token: %v", err)
+		}
+		// Another request rotated the token since it was read.
+		n, _ := res.RowsAffected()
+		reused = n == 0
+	}
+	if reused {
+		if err := revokeRefreshTokenFamily(tx, token.FamilyID, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		return &token, ErrRefreshTokenReused
+	}
+
+	next.FamilyID = token.FamilyID
+	next.UserLogin = token.UserLogin
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (id, family_id, user_login, token_hash, created_at, expires_at) 
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		next.ID, next.FamilyID, next.UserLogin, nextHash, next.CreatedAt, next.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert refresh token: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	token.RotatedAt = now
+	return &token, nil
+}
+
+func (s *SQLiteStorage) RevokeRefreshTokenFamily(familyID string, revokedAt string) error {
+	return revokeRefreshTokenFamily(s.db, familyID, revokedAt)
+}
+
+func (s *SQLiteStorage) RevokeUserRefreshTokens(userLogin string, revokedAt string) error {
+	_, err := s.db.Exec(`
+		UPDATE refresh_tokens 
+		SET revoked_at = COALESCE(revoked_at, ?) 
+		WHERE user_login = ?`,
+		revokedAt, userLogin)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %v", err)
+	}
+	return nil
+}
+
+func revokeRefreshTokenFamily(db execer, familyID string, revokedAt string) error {
+	_, err := db.Exec(`
+		UPDATE refresh_tokens 
+		SET revoked_at = COALESCE(revoked_at, ?) 
+		WHERE family_id = ?`,
+		revokedAt, familyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DenyAccessToken(jti string, expiresAt string) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO denied_access_tokens (jti, expires_at) VALUES (?, ?)`, jti, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to deny access token: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) IsAccessTokenDenied(jti string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM denied_access_tokens WHERE jti = ?`, jti).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to check access token: %v", err)
+	}
+	return n > 0, nil
+}
+
+// PurgeExpiredTokens forgets refresh tokens and denied access tokens that
+// could not be used anymore anyway.
+func (s *SQLiteStorage) PurgeExpiredTokens(now time.Time) (int64, error) {
+	cutoff := now.UTC().Format(time.RFC3339)
+	refresh, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE expires_at <= ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge refresh tokens: %v", err)
+	}
+	denied, err := s.db.Exec(`DELETE FROM denied_access_tokens WHERE expires_at <= ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge denied access tokens: %v", err)
+	}
+	refreshCount, _ := refresh.RowsAffected()
+	deniedCount, _ := denied.RowsAffected()
+	return refreshCount + deniedCount, nil
 }
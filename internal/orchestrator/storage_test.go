@@ -0,0 +1,965 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var backends = map[string]func(t *testing.T) Backend{
+	BackendSQLite: func(t *testing.T) Backend {
+		store, err := OpenSQLiteStorage(filepath.Join(t.TempDir(), "tasks.db"))
+		require.NoError(t, err)
+		return store
+	},
+	BackendMemory: func(t *testing.T) Backend {
+		return NewMemoryStore()
+	},
+	BackendFile: func(t *testing.T) Backend {
+		store, err := OpenFileStore(filepath.Join(t.TempDir(), "tasks.json"))
+		require.NoError(t, err)
+		return store
+	},
+}
+
+func TestTaskStoreConformance(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range conformanceCases {
+				t.Run(tc.name, func(t *testing.T) {
+					store := open(t)
+					defer store.Close()
+					tc.run(t, store)
+				})
+			}
+		})
+	}
+}
+
+func addExpression(t *testing.T, store TaskStore, expression, userLogin string) (Task, []*Operation) {
+	t.Helper()
+
+	task, ops, err := CreateTask(expression, userLogin)
+	require.NoError(t, err)
+	require.NoError(t, store.AddTaskWithOperations(&task, ops))
+	return task, ops
+}
+
+func claimAll(t *testing.T, store TaskStore, owner string) []*Operation {
+	t.Helper()
+
+	var claimed []*Operation
+	for {
+		op, err := store.ClaimOperation(owner, time.Minute)
+		require.NoError(t, err)
+		if op == nil {
+			return claimed
+		}
+		claimed = append(claimed, op)
+	}
+}
+
+var conformanceCases = []struct {
+	name string
+	run  func(t *testing.T, store TaskStore)
+}{
+	{"add and get", func(t *testing.T, store TaskStore) {
+		task, _ := addExpression(t, store, "1+2", "alice")
+
+		got, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, "1+2", got.Expression)
+		assert.Equal(t, StatusPending, got.Status)
+
+		got, err = store.GetTaskByID(task.ID, "bob")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+
+		got, err = store.GetTaskByID("missing", "alice")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	}},
+	{"claim hands out each ready operation once", func(t *testing.T, store TaskStore) {
+		task, _ := addExpression(t, store, "(1+2)*(3+4)", "alice")
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 2)
+		assert.NotEqual(t, claimed[0].ID, claimed[1].ID)
+		for _, op := range claimed {
+			assert.Equal(t, StatusInProgress, op.Status)
+			assert.Equal(t, "agent-1", op.LeaseOwner)
+			assert.NotEmpty(t, op.LeaseExpiresAt)
+		}
+
+		got, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusInProgress, got.Status)
+	}},
+	{"concurrent claims never share an operation", func(t *testing.T, store TaskStore) {
+		const tasks, agents = 20, 8
+		for i := 0; i < tasks; i++ {
+			addExpression(t, store, "(1+2)*(3+4)", "alice")
+		}
+
+		var mu sync.Mutex
+		var claimed []string
+		var wg sync.WaitGroup
+		for i := 0; i < agents; i++ {
+			wg.Add(1)
+			go func(owner string) {
+				defer wg.Done()
+				for {
+					op, err := store.ClaimOperation(owner, time.Minute)
+					if !assert.NoError(t, err) || op == nil {
+						return
+					}
+					mu.Lock()
+					claimed = append(claimed, op.ID)
+					mu.Unlock()
+				}
+			}(fmt.Sprintf("agent-%d", i))
+		}
+		wg.Wait()
+
+		unique := make(map[string]bool)
+		for _, id := range claimed {
+			assert.False(t, unique[id], "operation %s was claimed twice", id)
+			unique[id] = true
+		}
+		assert.Len(t, unique, 2*tasks)
+	}},
+	{"only expired leases are reaped back to pending", func(t *testing.T, store TaskStore) {
+		store.(Backend).SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+		addExpression(t, store, "(1+2)*(3+4)", "alice")
+
+		expired, err := store.ClaimOperation("agent-1", -time.Minute)
+		require.NoError(t, err)
+		live, err := store.ClaimOperation("agent-2", time.Minute)
+		require.NoError(t, err)
+
+		released, err := store.ReleaseExpiredLeases()
+		require.NoError(t, err)
+		assert.Equal(t, []string{expired.TaskID}, released)
+
+		got, err := store.GetOperation(expired.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusPending, got.Status)
+		assert.Empty(t, got.LeaseOwner)
+		assert.Empty(t, got.LeaseExpiresAt)
+		assert.Equal(t, 1, got.Attempts)
+		assert.NotEmpty(t, got.LastError)
+
+		got, err = store.GetOperation(live.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusInProgress, got.Status)
+		assert.Equal(t, "agent-2", got.LeaseOwner)
+
+		released, err = store.ReleaseExpiredLeases()
+		require.NoError(t, err)
+		assert.Empty(t, released)
+	}},
+	{"complete resolves dependencies and finishes the task", func(t *testing.T, store TaskStore) {
+		task, _ := addExpression(t, store, "(1+2)*(3+4)", "alice")
+
+		for _, op := range claimAll(t, store, "agent-1") {
+			require.NoError(t, store.CompleteOperation(op.ID, "agent-1", op.Operand1+op.Operand2))
+		}
+
+		root := claimAll(t, store, "agent-1")
+		require.Len(t, root, 1)
+		assert.Equal(t, "*", root[0].Operator)
+		assert.ElementsMatch(t, []float64{3, 7}, []float64{root[0].Operand1, root[0].Operand2})
+
+		require.NoError(t, store.CompleteOperation(root[0].ID, "agent-1", 21))
+
+		got, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusCompleted, got.Status)
+		assert.Equal(t, float64(21), got.Result)
+	}},
+	{"complete requires the lease owner", func(t *testing.T, store TaskStore) {
+		addExpression(t, store, "1+2", "alice")
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 1)
+
+		err := store.CompleteOperation(claimed[0].ID, "agent-2", 3)
+		assert.ErrorIs(t, err, ErrOperationNotFound)
+		err = store.FailOperation(claimed[0].ID, "agent-2", Failure{Code: ErrorCodeUnknown})
+		assert.ErrorIs(t, err, ErrOperationNotFound)
+		err = store.CompleteOperation(claimed[0].ID, "", 3)
+		assert.ErrorIs(t, err, ErrOperationNotFound, "an empty owner matches no lease")
+		err = store.FailOperation(claimed[0].ID, "", Failure{Code: ErrorCodeUnknown})
+		assert.ErrorIs(t, err, ErrOperationNotFound)
+
+		require.NoError(t, store.CompleteOperation(claimed[0].ID, "agent-1", 3))
+		err = store.CompleteOperation(claimed[0].ID, "agent-1", 3)
+		assert.ErrorIs(t, err, ErrOperationNotFound)
+	}},
+	{"fail stops the whole task", func(t *testing.T, store TaskStore) {
+		task, _ := addExpression(t, store, "(1/0)+(2*3)", "alice")
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 2)
+		failure := Failure{Code: ErrorCodeDivisionByZero, Message: "division by zero"}
+		require.NoError(t, store.FailOperation(claimed[0].ID, "agent-1", failure))
+
+		got, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusFailed, got.Status)
+		require.NotNil(t, got.Failure)
+		assert.Equal(t, ErrorCodeDivisionByZero, got.Failure.Code)
+		assert.Equal(t, "division by zero", got.Failure.Message)
+		assert.Equal(t, "agent-1", got.Failure.AgentID)
+		assert.Equal(t, claimed[0].ID, got.Failure.OperationID)
+		assert.NotEmpty(t, got.Failure.FailedAt)
+
+		tasks, err := store.GetUserTasks(context.Background(), "alice")
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		assert.Equal(t, got.Failure, tasks[0].Failure)
+
+		err = store.CompleteOperation(claimed[1].ID, "agent-1", 6)
+		assert.ErrorIs(t, err, ErrOperationCancelled)
+		assert.Empty(t, claimAll(t, store, "agent-1"))
+	}},
+	{"stopping a task cancels its running operations", func(t *testing.T, store TaskStore) {
+		store.(Backend).SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+		task, _ := addExpression(t, store, "(1/0)+(2*3)", "alice")
+
+		failing, err := store.ClaimOperation("agent-1", time.Minute)
+		require.NoError(t, err)
+		running, err := store.ClaimOperation("agent-2", -time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, running)
+		require.NoError(t, store.FailOperation(failing.ID, "agent-1", Failure{Code: ErrorCodeDivisionByZero}))
+
+		got, err := store.GetOperation(running.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusCancelled, got.Status)
+
+		released, err := store.ReleaseExpiredLeases()
+		require.NoError(t, err)
+		assert.Empty(t, released, "the expired lease belongs to a failed task")
+		assert.Empty(t, claimAll(t, store, "agent-3"))
+
+		ids, err := store.TakeCancelledOperations("agent-2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{running.ID}, ids)
+
+		gotTask, err := store.GetTask(task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusFailed, gotTask.Status)
+	}},
+	{"requeue restores operations cancelled by the dead letter", func(t *testing.T, store TaskStore) {
+		task, ops, err := CreateTask("(1+2)*(3+4)", "alice")
+		require.NoError(t, err)
+		task.MaxAttempts = 1
+		require.NoError(t, store.AddTaskWithOperations(&task, ops))
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 2)
+		require.NoError(t, store.FailOperation(claimed[0].ID, "agent-1", Failure{Code: ErrorCodeTimeout}))
+		err = store.CompleteOperation(claimed[1].ID, "agent-1", 0)
+		assert.ErrorIs(t, err, ErrOperationCancelled)
+
+		require.NoError(t, store.RequeueTask(task.ID))
+		claimed = claimAll(t, store, "agent-2")
+		require.Len(t, claimed, 2)
+		for _, op := range claimed {
+			require.NoError(t, store.CompleteOperation(op.ID, "agent-2", op.Operand1+op.Operand2))
+		}
+		root := claimAll(t, store, "agent-2")
+		require.Len(t, root, 1)
+		require.NoError(t, store.CompleteOperation(root[0].ID, "agent-2", 21))
+
+		got, err := store.GetTask(task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusCompleted, got.Status)
+	}},
+	{"get operation returns the stored operation", func(t *testing.T, store TaskStore) {
+		task, ops := addExpression(t, store, "(1+2)*3", "alice")
+
+		op, err := store.GetOperation(ops[1].ID)
+		require.NoError(t, err)
+		require.NotNil(t, op)
+		assert.Equal(t, task.ID, op.TaskID)
+		assert.Equal(t, ops[0].ID, op.LeftDependency)
+		assert.True(t, op.IsRoot)
+		assert.Equal(t, StatusWaiting, op.Status)
+
+		missing, err := store.GetOperation("missing")
+		require.NoError(t, err)
+		assert.Nil(t, missing)
+	}},
+	{"finished tasks queue webhook deliveries", func(t *testing.T, store TaskStore) {
+		hooks := store.(WebhookStore)
+		require.NoError(t, hooks.CreateWebhook(&Webhook{
+			ID: "hook-1", UserLogin: "alice", URL: "http://example.com/hook", Secret: "s", CreatedAt: "2025-01-01T00:00:00Z",
+		}))
+
+		task, ops, err := CreateTask("1/0", "alice")
+		require.NoError(t, err)
+		task.CallbackURL = "http://example.com/callback"
+		require.NoError(t, store.AddTaskWithOperations(&task, ops))
+		addExpression(t, store, "1+1", "bob")
+
+		op, err := store.ClaimOperation("agent-1", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, store.FailOperation(op.ID, "agent-1", Failure{Code: ErrorCodeDivisionByZero}))
+
+		due, err := hooks.DueDeliveries(time.Now(), 10)
+		require.NoError(t, err)
+		require.Len(t, due, 2)
+		for _, d := range due {
+			assert.Equal(t, task.ID, d.TaskID)
+			assert.Equal(t, EventTaskFailed, d.Event)
+		}
+
+		d := due[0]
+		d.Attempts = 1
+		d.Status = DeliveryDelivered
+		d.NextAttemptAt = ""
+		require.NoError(t, hooks.RecordDeliveryAttempt(d, DeliveryAttempt{Attempt: 1, StatusCode: 200, AttemptedAt: d.CreatedAt}))
+
+		due, err = hooks.DueDeliveries(time.Now(), 10)
+		require.NoError(t, err)
+		assert.Len(t, due, 1)
+
+		log, err := hooks.GetUserDeliveries("alice", task.ID)
+		require.NoError(t, err)
+		require.Len(t, log, 2)
+		for _, entry := range log {
+			if entry.ID == d.ID {
+				assert.Equal(t, []DeliveryAttempt{{Attempt: 1, StatusCode: 200, AttemptedAt: d.CreatedAt}}, entry.History)
+			}
+		}
+
+		require.NoError(t, hooks.DeleteWebhook("hook-1", "alice"))
+		assert.ErrorIs(t, hooks.DeleteWebhook("hook-1", "alice"), ErrWebhookNotFound)
+	}},
+	{"cancel stops the task and reports running operations once", func(t *testing.T, store TaskStore) {
+		task, _ := addExpression(t, store, "(1+2)*(3+4)", "alice")
+
+		running, err := store.ClaimOperation("agent-1", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, running)
+
+		assert.ErrorIs(t, store.CancelTask(task.ID, "bob"), ErrTaskNotFound)
+		require.NoError(t, store.CancelTask(task.ID, "alice"))
+		assert.ErrorIs(t, store.CancelTask(task.ID, "alice"), ErrTaskFinished)
+
+		got, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusCancelled, got.Status)
+		assert.Empty(t, claimAll(t, store, "agent-2"))
+
+		ids, err := store.TakeCancelledOperations("agent-1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{running.ID}, ids)
+		ids, err = store.TakeCancelledOperations("agent-1")
+		require.NoError(t, err)
+		assert.Empty(t, ids)
+
+		err = store.CompleteOperation(running.ID, "agent-1", 3)
+		assert.ErrorIs(t, err, ErrOperationCancelled)
+		err = store.FailOperation(running.ID, "agent-1", Failure{Code: ErrorCodeUnknown})
+		assert.ErrorIs(t, err, ErrOperationCancelled)
+	}},
+	{"expired leases return to the queue", func(t *testing.T, store TaskStore) {
+		store.(Backend).SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+		addExpression(t, store, "1+2", "alice")
+
+		op, err := store.ClaimOperation("agent-1", -time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, op)
+
+		released, err := store.ReleaseExpiredLeases()
+		require.NoError(t, err)
+		assert.Equal(t, []string{op.TaskID}, released)
+
+		again, err := store.ClaimOperation("agent-2", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, again)
+		assert.Equal(t, op.ID, again.ID)
+		assert.Equal(t, "agent-2", again.LeaseOwner)
+	}},
+	{"operations of a dead agent are requeued", func(t *testing.T, store TaskStore) {
+		store.(Backend).SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+		addExpression(t, store, "1+2", "alice")
+		addExpression(t, store, "3+4", "alice")
+
+		_, err := store.ClaimOperation("agent-1", time.Minute)
+		require.NoError(t, err)
+		_, err = store.ClaimOperation("agent-2", time.Minute)
+		require.NoError(t, err)
+
+		requeued, err := store.RequeueAgentOperations("agent-1")
+		require.NoError(t, err)
+		assert.Len(t, requeued, 1)
+		assert.Len(t, claimAll(t, store, "agent-3"), 1)
+	}},
+	{"transient failures wait for the backoff", func(t *testing.T, store TaskStore) {
+		store.(Backend).SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BackoffBase: time.Hour})
+		task, _ := addExpression(t, store, "1+2", "alice")
+
+		op, err := store.ClaimOperation("agent-1", time.Minute)
+		require.NoError(t, err)
+		require.NoError(t, store.FailOperation(op.ID, "agent-1", Failure{Code: ErrorCodeUnknown, Message: "boom"}))
+		assert.Empty(t, claimAll(t, store, "agent-2"))
+
+		got, err := store.GetOperation(op.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusPending, got.Status)
+		assert.Equal(t, 1, got.Attempts)
+		assert.NotEmpty(t, got.NextAttemptAt)
+		assert.Equal(t, "boom", got.LastError)
+
+		gotTask, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, 1, gotTask.Retries)
+		assert.Nil(t, gotTask.Failure)
+	}},
+	{"exhausted retries dead-letter the task and can be requeued", func(t *testing.T, store TaskStore) {
+		store.(Backend).SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+		task, _ := addExpression(t, store, "1+2", "alice")
+		require.ErrorIs(t, store.RequeueTask(task.ID), ErrTaskNotDeadLetter)
+
+		for i := 0; i < task.MaxAttempts; i++ {
+			op, err := store.ClaimOperation("agent-1", time.Minute)
+			require.NoError(t, err)
+			require.NotNil(t, op)
+			require.NoError(t, store.FailOperation(op.ID, "agent-1", Failure{Code: ErrorCodeTimeout}))
+		}
+		assert.Empty(t, claimAll(t, store, "agent-2"))
+
+		dead, err := store.ListTasksByStatus(StatusDeadLetter)
+		require.NoError(t, err)
+		require.Len(t, dead, 1)
+		assert.Equal(t, task.ID, dead[0].ID)
+		require.NotNil(t, dead[0].Failure)
+		assert.Equal(t, ErrorCodeTimeout, dead[0].Failure.Code)
+
+		ops, err := store.GetTaskOperations(task.ID)
+		require.NoError(t, err)
+		require.Len(t, ops, 1)
+		assert.Equal(t, StatusDeadLetter, ops[0].Status)
+
+		require.NoError(t, store.RequeueTask(task.ID))
+		assert.ErrorIs(t, store.RequeueTask("missing"), ErrTaskNotFound)
+
+		got, err := store.GetTask(task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusPending, got.Status)
+		assert.Nil(t, got.Failure)
+
+		op, err := store.ClaimOperation("agent-2", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, op)
+		require.NoError(t, store.CompleteOperation(op.ID, "agent-2", 3))
+
+		got, err = store.GetTask(task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, StatusCompleted, got.Status)
+	}},
+	{"users take turns behind a large backlog", func(t *testing.T, store TaskStore) {
+		owners := make(map[string]string)
+		for i := 0; i < 50; i++ {
+			task, _ := addExpression(t, store, "1+2", "alice")
+			owners[task.ID] = "alice"
+		}
+		small, _ := addExpression(t, store, "3+4", "bob")
+		owners[small.ID] = "bob"
+
+		served := make(map[string]int)
+		for i := 0; i < 2; i++ {
+			op, err := store.ClaimOperation("agent-1", time.Minute)
+			require.NoError(t, err)
+			require.NotNil(t, op)
+			served[owners[op.TaskID]]++
+		}
+		assert.Equal(t, map[string]int{"alice": 1, "bob": 1}, served)
+	}},
+	{"higher priority is claimed first", func(t *testing.T, store TaskStore) {
+		for i := 0; i < 10; i++ {
+			addExpression(t, store, "1+2", "alice")
+		}
+		task, ops, err := CreateTask("3+4", "alice")
+		require.NoError(t, err)
+		task.Priority = 5
+		require.NoError(t, store.AddTaskWithOperations(&task, ops))
+
+		op, err := store.ClaimOperation("agent-1", time.Minute)
+		require.NoError(t, err)
+		require.NotNil(t, op)
+		assert.Equal(t, task.ID, op.TaskID)
+
+		got, err := store.GetTask(task.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 5, got.Priority)
+	}},
+	{"batch stores its tasks in order", func(t *testing.T, store TaskStore) {
+		batch := &Batch{ID: "batch-1", UserLogin: "alice", CreatedAt: "2025-01-01T00:00:00Z"}
+		var items []BatchItem
+		for _, expression := range []string{"1+2", "7", "3*4"} {
+			task, ops, err := CreateTask(expression, "alice")
+			require.NoError(t, err)
+			task.BatchID = batch.ID
+			task.Label = "row " + expression
+			items = append(items, BatchItem{Task: &task, Operations: ops})
+		}
+		require.NoError(t, store.AddBatch(batch, items))
+
+		got, tasks, err := store.GetBatch(batch.ID, "bob")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+		assert.Nil(t, tasks)
+
+		got, tasks, err = store.GetBatch(batch.ID, "alice")
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		require.Len(t, tasks, 3)
+		for i, task := range tasks {
+			assert.Equal(t, items[i].Task.ID, task.ID)
+			assert.Equal(t, batch.ID, task.BatchID)
+			assert.Equal(t, items[i].Task.Label, task.Label)
+		}
+		assert.Equal(t, StatusCompleted, tasks[1].Status)
+		assert.Len(t, claimAll(t, store, "agent-1"), 2)
+	}},
+	{"idempotency keys are reserved once per user", func(t *testing.T, store TaskStore) {
+		keys := store.(Backend)
+		now := time.Now().UTC()
+		record := &IdempotencyRecord{UserLogin: "alice", Key: "k1", RequestHash: "h1", CreatedAt: now.Format(time.RFC3339)}
+
+		existing, err := keys.ReserveIdempotencyKey(record, now.Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Nil(t, existing)
+
+		other := &IdempotencyRecord{UserLogin: "bob", Key: "k1", RequestHash: "h2", CreatedAt: record.CreatedAt}
+		existing, err = keys.ReserveIdempotencyKey(other, now.Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Nil(t, existing, "keys are scoped to the user")
+
+		existing, err = keys.ReserveIdempotencyKey(record, now.Add(-time.Hour))
+		require.NoError(t, err)
+		require.NotNil(t, existing)
+		assert.Equal(t, 0, existing.StatusCode)
+
+		record.StatusCode = 201
+		record.ContentType = "application/json"
+		record.Response = `{"id":"task-1"}`
+		require.NoError(t, keys.CompleteIdempotencyKey(record))
+
+		existing, err = keys.ReserveIdempotencyKey(record, now.Add(-time.Hour))
+		require.NoError(t, err)
+		require.NotNil(t, existing)
+		assert.Equal(t, *record, *existing)
+
+		existing, err = keys.ReserveIdempotencyKey(record, now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Nil(t, existing, "expired keys can be reused")
+
+		require.NoError(t, keys.ReleaseIdempotencyKey("alice", "k1"))
+		purged, err := keys.PurgeIdempotencyKeys(now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), purged)
+	}},
+	{"workspaces keep variables per user", func(t *testing.T, store TaskStore) {
+		workspaces := store.(Backend)
+		workspace := &Workspace{
+			ID:        "ws-1",
+			UserLogin: "alice",
+			Name:      "finance",
+			Variables: map[string]float64{"rate": 0.13},
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		require.NoError(t, workspaces.CreateWorkspace(workspace))
+
+		duplicate := *workspace
+		duplicate.ID = "ws-2"
+		assert.ErrorIs(t, workspaces.CreateWorkspace(&duplicate), ErrWorkspaceExists)
+		duplicate.UserLogin = "bob"
+		require.NoError(t, workspaces.CreateWorkspace(&duplicate), "names are scoped to the user")
+
+		require.NoError(t, workspaces.SetVariable("ws-1", "alice", "limit", 100))
+		require.NoError(t, workspaces.SetVariable("ws-1", "alice", "rate", 0.2))
+		assert.ErrorIs(t, workspaces.SetVariable("ws-1", "bob", "rate", 1), ErrWorkspaceNotFound)
+
+		got, err := workspaces.GetWorkspace("ws-1", "alice")
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, map[string]float64{"rate": 0.2, "limit": 100}, got.Variables)
+
+		got, err = workspaces.GetWorkspace("ws-1", "bob")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+
+		require.NoError(t, workspaces.DeleteVariable("ws-1", "alice", "limit"))
+		assert.ErrorIs(t, workspaces.DeleteVariable("ws-1", "alice", "limit"), ErrVariableNotFound)
+
+		list, err := workspaces.GetUserWorkspaces("alice")
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, map[string]float64{"rate": 0.2}, list[0].Variables)
+
+		assert.ErrorIs(t, workspaces.DeleteWorkspace("ws-1", "bob"), ErrWorkspaceNotFound)
+		require.NoError(t, workspaces.DeleteWorkspace("ws-1", "alice"))
+		got, err = workspaces.GetWorkspace("ws-1", "alice")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+
+		task, ops, err := CreateTaskWithVariables("rate*2", "alice", map[string]float64{"rate": 0.5, "unused": 1})
+		require.NoError(t, err)
+		task.WorkspaceID = "ws-1"
+		require.NoError(t, store.AddTaskWithOperations(&task, ops))
+		stored, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "ws-1", stored.WorkspaceID)
+		assert.Equal(t, map[string]float64{"rate": 0.5}, stored.Variables)
+	}},
+	{"references wait for the referenced task", func(t *testing.T, store TaskStore) {
+		first, _ := addExpression(t, store, "1+2", "alice")
+		second, _ := addExpression(t, store, "ans("+first.ID+") * (2+2)", "alice")
+		assert.Equal(t, StatusWaiting, second.Status)
+		assert.Equal(t, []string{first.ID}, second.References)
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 1, "nothing of the waiting task is handed out")
+		assert.Equal(t, first.ID, claimed[0].TaskID)
+		require.NoError(t, store.CompleteOperation(claimed[0].ID, "agent-1", 3))
+
+		dependents, err := store.GetDependentTasks(first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{second.ID}, dependents)
+
+		got, err := store.GetTaskByID(second.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusPending, got.Status)
+		assert.Equal(t, []string{first.ID}, got.References)
+
+		inner := claimAll(t, store, "agent-1")
+		require.Len(t, inner, 1)
+		require.NoError(t, store.CompleteOperation(inner[0].ID, "agent-1", 4))
+		root := claimAll(t, store, "agent-1")
+		require.Len(t, root, 1)
+		assert.Equal(t, []float64{3, 4}, []float64{root[0].Operand1, root[0].Operand2})
+		require.NoError(t, store.CompleteOperation(root[0].ID, "agent-1", 12))
+
+		got, err = store.GetTaskByID(second.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusCompleted, got.Status)
+		assert.Equal(t, float64(12), got.Result)
+	}},
+	{"references to completed tasks resolve at once", func(t *testing.T, store TaskStore) {
+		first, _ := addExpression(t, store, "5", "alice")
+		second, _ := addExpression(t, store, "$"+first.ID, "alice")
+
+		got, err := store.GetTaskByID(second.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusPending, got.Status)
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 1)
+		assert.Equal(t, second.ID, claimed[0].TaskID)
+		assert.Equal(t, float64(5), claimed[0].Operand1)
+	}},
+	{"failure propagates to referencing tasks", func(t *testing.T, store TaskStore) {
+		first, _ := addExpression(t, store, "1/0", "alice")
+		second, _ := addExpression(t, store, "$"+first.ID+" + 1", "alice")
+		third, _ := addExpression(t, store, "$"+second.ID+" * 2", "alice")
+
+		claimed := claimAll(t, store, "agent-1")
+		require.Len(t, claimed, 1)
+		require.NoError(t, store.FailOperation(claimed[0].ID, "agent-1", Failure{Code: ErrorCodeDivisionByZero}))
+
+		for _, id := range []string{second.ID, third.ID} {
+			got, err := store.GetTaskByID(id, "alice")
+			require.NoError(t, err)
+			assert.Equal(t, StatusFailed, got.Status)
+			require.NotNil(t, got.Failure)
+			assert.Equal(t, ErrorCodeDependencyFailed, got.Failure.Code)
+		}
+
+		late, _ := addExpression(t, store, "$"+first.ID+" - 1", "alice")
+		got, err := store.GetTaskByID(late.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusFailed, got.Status)
+		assert.Empty(t, claimAll(t, store, "agent-1"))
+
+		cancelled, _ := addExpression(t, store, "2+2", "alice")
+		waiting, _ := addExpression(t, store, "$"+cancelled.ID+" + 1", "alice")
+		require.NoError(t, store.CancelTask(cancelled.ID, "alice"))
+		got, err = store.GetTaskByID(waiting.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusFailed, got.Status)
+		assert.Contains(t, got.Failure.Message, "was cancelled")
+	}},
+	{"agent credentials are found by token hash until revoked", func(t *testing.T, store TaskStore) {
+		credentials := store.(Backend)
+		credential := &AgentCredential{ID: "cred-1", Name: "rack-1", CreatedBy: "root", CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+		require.NoError(t, credentials.CreateAgentCredential(credential, hashToken("secret")))
+
+		got, err := credentials.GetAgentCredentialByToken(hashToken("secret"))
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, *credential, *got)
+
+		got, err = credentials.GetAgentCredentialByToken(hashToken("other"))
+		require.NoError(t, err)
+		assert.Nil(t, got)
+
+		require.NoError(t, credentials.RevokeAgentCredential("cred-1", "2026-01-02T00:00:00Z"))
+		require.NoError(t, credentials.RevokeAgentCredential("cred-1", "2026-03-04T00:00:00Z"))
+		assert.ErrorIs(t, credentials.RevokeAgentCredential("missing", "2026-01-02T00:00:00Z"), ErrAgentCredentialNotFound)
+
+		list, err := credentials.ListAgentCredentials()
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, "2026-01-02T00:00:00Z", list[0].RevokedAt)
+	}},
+	{"reused refresh token revokes its family", func(t *testing.T, store TaskStore) {
+		sessions := store.(Backend)
+		now := "2026-01-01T00:00:00Z"
+		first := &RefreshToken{ID: "r1", FamilyID: "f1", UserLogin: "alice", CreatedAt: now, ExpiresAt: "2026-02-01T00:00:00Z"}
+		require.NoError(t, sessions.CreateRefreshToken(first, hashToken("one")))
+
+		second := &RefreshToken{ID: "r2", CreatedAt: now, ExpiresAt: "2026-02-01T00:00:00Z"}
+		rotated, err := sessions.RotateRefreshToken(hashToken("one"), second, hashToken("two"), now)
+		require.NoError(t, err)
+		assert.Equal(t, "r1", rotated.ID)
+		assert.Equal(t, "alice", second.UserLogin)
+		assert.Equal(t, "f1", second.FamilyID)
+
+		_, err = sessions.RotateRefreshToken(hashToken("missing"), &RefreshToken{ID: "r3", ExpiresAt: now}, hashToken("three"), now)
+		assert.ErrorIs(t, err, ErrRefreshTokenNotFound)
+
+		rotated, err = sessions.RotateRefreshToken(hashToken("one"), &RefreshToken{ID: "r3", ExpiresAt: now}, hashToken("three"), now)
+		assert.ErrorIs(t, err, ErrRefreshTokenReused)
+		require.NotNil(t, rotated)
+		assert.Equal(t, "alice", rotated.UserLogin)
+
+		_, err = sessions.RotateRefreshToken(hashToken("two"), &RefreshToken{ID: "r3", ExpiresAt: now}, hashToken("three"), now)
+		assert.ErrorIs(t, err, ErrRefreshTokenRevoked, "the newest token of the family is revoked too")
+	}},
+	{"expired refresh tokens and denied access tokens are purged", func(t *testing.T, store TaskStore) {
+		sessions := store.(Backend)
+		token := &RefreshToken{ID: "r1", FamilyID: "f1", UserLogin: "alice", CreatedAt: "2026-01-01T00:00:00Z", ExpiresAt: "2026-01-02T00:00:00Z"}
+		require.NoError(t, sessions.CreateRefreshToken(token, hashToken("one")))
+		_, err := sessions.RotateRefreshToken(hashToken("one"), &RefreshToken{ID: "r2"}, hashToken("two"), "2026-01-03T00:00:00Z")
+		assert.ErrorIs(t, err, ErrRefreshTokenExpired)
+
+		require.NoError(t, sessions.DenyAccessToken("jti-1", "2026-01-02T00:00:00Z"))
+		require.NoError(t, sessions.DenyAccessToken("jti-2", "2026-01-05T00:00:00Z"))
+		denied, err := sessions.IsAccessTokenDenied("jti-1")
+		require.NoError(t, err)
+		assert.True(t, denied)
+		denied, err = sessions.IsAccessTokenDenied("jti-3")
+		require.NoError(t, err)
+		assert.False(t, denied)
+
+		purged, err := sessions.PurgeExpiredTokens(time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), purged)
+		denied, err = sessions.IsAccessTokenDenied("jti-2")
+		require.NoError(t, err)
+		assert.True(t, denied)
+		_, err = sessions.RotateRefreshToken(hashToken("one"), &RefreshToken{ID: "r2"}, hashToken("two"), "2026-01-03T00:00:00Z")
+		assert.ErrorIs(t, err, ErrRefreshTokenNotFound)
+	}},
+	{"users keep roles and can be disabled", func(t *testing.T, store TaskStore) {
+		users := store.(Backend)
+		require.NoError(t, users.CreateUser(&User{Login: "Bob", PasswordHash: "x", Role: RoleUser, CreatedAt: time.Now()}))
+		require.NoError(t, users.CreateUser(&User{Login: "alice", PasswordHash: "x", Role: RoleAdmin, CreatedAt: time.Now()}))
+
+		bob, err := users.GetUser("bob")
+		require.NoError(t, err)
+		bob.Role = RoleOperator
+		bob.Disabled = true
+		require.NoError(t, users.UpdateUser(bob))
+		assert.ErrorIs(t, users.UpdateUser(&User{Login: "carol", Role: RoleUser}), ErrUserNotFound)
+
+		list, err := users.ListUsers()
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, "alice", list[0].Login)
+		assert.Equal(t, RoleAdmin, list[0].Role)
+		assert.False(t, list[0].Disabled)
+		assert.Equal(t, "Bob", list[1].Login)
+		assert.Equal(t, RoleOperator, list[1].Role)
+		assert.True(t, list[1].Disabled)
+	}},
+	{"query without a user lists every user's tasks", func(t *testing.T, store TaskStore) {
+		addExpression(t, store, "1+2", "alice")
+		addExpression(t, store, "3+4", "bob")
+
+		tasks, err := store.QueryTasks(context.Background(), TaskQuery{SortBy: SortCreatedAt})
+		require.NoError(t, err)
+		assert.Len(t, tasks, 2)
+
+		tasks, err = store.QueryTasks(context.Background(), TaskQuery{UserLogin: "bob", SortBy: SortCreatedAt})
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		assert.Equal(t, "3+4", tasks[0].Expression)
+	}},
+	{"revoking a user's refresh tokens covers all families", func(t *testing.T, store TaskStore) {
+		sessions := store.(Backend)
+		for i, family := range []string{"f1", "f2"} {
+			token := &RefreshToken{ID: family, FamilyID: family, UserLogin: "alice", CreatedAt: "2026-01-01T00:00:00Z", ExpiresAt: "2026-02-01T00:00:00Z"}
+			require.NoError(t, sessions.CreateRefreshToken(token, hashToken(fmt.Sprint(i))))
+		}
+		require.NoError(t, sessions.RevokeUserRefreshTokens("alice", "2026-01-02T00:00:00Z"))
+		for i := range []string{"f1", "f2"} {
+			_, err := sessions.RotateRefreshToken(hashToken(fmt.Sprint(i)), &RefreshToken{ID: "next"}, hashToken("next"), "2026-01-03T00:00:00Z")
+			assert.ErrorIs(t, err, ErrRefreshTokenRevoked)
+		}
+	}},
+	{"query pages through filtered tasks", func(t *testing.T, store TaskStore) {
+		var ids []string
+		for i, expression := range []string{"1+2", "2*3", "10+20", "4", "5+6"} {
+			task, ops, err := CreateTask(expression, "alice")
+			require.NoError(t, err)
+			task.CreatedAt = time.Date(2025, 1, 1+i, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+			require.NoError(t, store.AddTaskWithOperations(&task, ops))
+			ids = append(ids, task.ID)
+		}
+		addExpression(t, store, "1+2", "bob")
+
+		query := TaskQuery{UserLogin: "alice", SortBy: SortCreatedAt, Descending: true, Limit: 2}
+		var pages [][]string
+		for {
+			tasks, err := store.QueryTasks(context.Background(), query)
+			require.NoError(t, err)
+			if len(tasks) == 0 {
+				break
+			}
+			var page []string
+			for _, task := range tasks {
+				page = append(page, task.ID)
+			}
+			pages = append(pages, page)
+			query.After = query.cursorFor(tasks[len(tasks)-1])
+		}
+		assert.Equal(t, [][]string{{ids[4], ids[3]}, {ids[2], ids[1]}, {ids[0]}}, pages)
+
+		tasks, err := store.QueryTasks(context.Background(), TaskQuery{
+			UserLogin:     "alice",
+			Contains:      "+",
+			CreatedAfter:  "2025-01-02T00:00:00Z",
+			CreatedBefore: "2025-01-05T00:00:00Z",
+			SortBy:        SortCreatedAt,
+		})
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		assert.Equal(t, ids[2], tasks[0].ID)
+
+		tasks, err = store.QueryTasks(context.Background(), TaskQuery{UserLogin: "alice", Status: StatusCompleted, SortBy: SortUpdatedAt})
+		require.NoError(t, err)
+		require.Len(t, tasks, 1)
+		assert.Equal(t, ids[3], tasks[0].ID)
+	}},
+	{"list by user and status", func(t *testing.T, store TaskStore) {
+		first, _ := addExpression(t, store, "1+2", "alice")
+		addExpression(t, store, "5", "alice")
+		addExpression(t, store, "3+4", "bob")
+
+		tasks, err := store.GetUserTasks(context.Background(), "alice")
+		require.NoError(t, err)
+		assert.Len(t, tasks, 2)
+
+		pending, err := store.GetTasksByStatus("alice", StatusPending)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		assert.Equal(t, first.ID, pending[0].ID)
+
+		completed, err := store.GetTasksByStatus("alice", StatusCompleted)
+		require.NoError(t, err)
+		require.Len(t, completed, 1)
+		assert.Equal(t, float64(5), completed[0].Result)
+
+		active, err := store.CountActiveTasks("alice")
+		require.NoError(t, err)
+		assert.Equal(t, 1, active)
+	}},
+	{"update and delete", func(t *testing.T, store TaskStore) {
+		task, _ := addExpression(t, store, "1+2", "alice")
+
+		task.Status = StatusCompleted
+		task.Result = 3
+		require.NoError(t, store.UpdateTask(&task))
+
+		got, err := store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, StatusCompleted, got.Status)
+		assert.Equal(t, float64(3), got.Result)
+
+		require.NoError(t, store.DeleteTask(task.ID, "bob"))
+		got, err = store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.NotNil(t, got)
+
+		require.NoError(t, store.DeleteTask(task.ID, "alice"))
+		got, err = store.GetTaskByID(task.ID, "alice")
+		require.NoError(t, err)
+		assert.Nil(t, got)
+		assert.Empty(t, claimAll(t, store, "agent-1"))
+	}},
+}
+
+func TestFileStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+
+	store, err := OpenFileStore(path)
+	require.NoError(t, err)
+	task, _ := addExpression(t, store, "2*3", "alice")
+	require.NoError(t, store.CreateUser(&User{Login: "alice", PasswordHash: "hash"}))
+
+	store, err = OpenFileStore(path)
+	require.NoError(t, err)
+
+	claimed := claimAll(t, store, "agent-1")
+	require.Len(t, claimed, 1)
+	assert.True(t, claimed[0].IsRoot)
+	require.NoError(t, store.CompleteOperation(claimed[0].ID, "agent-1", 6))
+
+	got, err := store.GetTaskByID(task.ID, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, StatusCompleted, got.Status)
+
+	user, err := store.GetUser("ALICE")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", user.Login)
+}
+
+func TestFileStoreUndoesChangesItCannotSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	store, err := OpenFileStore(filepath.Join(dir, "tasks.json"))
+	require.NoError(t, err)
+	kept, _ := addExpression(t, store, "1+1", "alice")
+
+	require.NoError(t, os.RemoveAll(dir))
+	task, ops, err := CreateTask("2*3", "alice")
+	require.NoError(t, err)
+	require.Error(t, store.AddTaskWithOperations(&task, ops))
+
+	got, err := store.GetTask(task.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got, "the failed change is not kept in memory")
+	got, err = store.GetTask(kept.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	require.NoError(t, store.AddTaskWithOperations(&task, ops))
+	claimed := claimAll(t, store, "agent-1")
+	assert.Len(t, claimed, 2, "a retry adds the task once")
+}
@@ -0,0 +1,145 @@
+package orchestrator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+const (
+	SortCreatedAt = "created_at"
+	SortUpdatedAt = "updated_at"
+)
+
+// TaskQuery selects a page of a user's tasks. Empty fields do not filter.
+type TaskQuery struct {
+	// UserLogin selects the tasks of one user; empty selects every user's.
+	UserLogin     string
+	Status        string
+	CreatedAfter  string
+	CreatedBefore string
+	Contains      string
+
+	SortBy     string
+	Descending bool
+	Limit      int
+	// After continues the listing behind the last task of a previous page.
+	After *TaskCursor
+}
+
+// TaskCursor is the position of a task in a sorted listing: the value of the
+// sort column and the task ID, which breaks ties between equal values.
+type TaskCursor struct {
+	SortBy string `json:"s"`
+	Value  string `json:"v"`
+	ID     string `json:"id"`
+}
+
+func (q TaskQuery) cursorFor(task *Task) *TaskCursor {
+	return &TaskCursor{SortBy: q.SortBy, Value: q.sortValue(task), ID: task.ID}
+}
+
+func (q TaskQuery) sortValue(task *Task) string {
+	if q.SortBy == SortUpdatedAt {
+		return task.UpdatedAt
+	}
+	return task.CreatedAt
+}
+
+func (c *TaskCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTaskCursor(value string) (*TaskCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor TaskCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+var taskStatuses = []string{
+	StatusPending, StatusWaiting, StatusInProgress, StatusCompleted, StatusFailed, StatusCancelled, StatusDeadLetter,
+}
+
+func parseTimestamp(name, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// parseTaskQuery reads the listing parameters of GET /api/v1/expressions:
+// status, created_after, created_before, q, sort, limit and cursor.
+func parseTaskQuery(userLogin string, values url.Values) (TaskQuery, error) {
+	query := TaskQuery{
+		UserLogin:  userLogin,
+		Status:     values.Get("status"),
+		Contains:   values.Get("q"),
+		SortBy:     SortCreatedAt,
+		Descending: true,
+		Limit:      defaultPageSize,
+	}
+
+	if query.Status != "" {
+		known := false
+		for _, status := range taskStatuses {
+			known = known || status == query.Status
+		}
+		if !known {
+			return query, fmt.Errorf("unknown status %q", query.Status)
+		}
+	}
+
+	var err error
+	if query.CreatedAfter, err = parseTimestamp("created_after", values.Get("created_after")); err != nil {
+		return query, err
+	}
+	if query.CreatedBefore, err = parseTimestamp("created_before", values.Get("created_before")); err != nil {
+		return query, err
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		query.Descending = strings.HasPrefix(sort, "-")
+		query.SortBy = strings.TrimPrefix(sort, "-")
+		if query.SortBy != SortCreatedAt && query.SortBy != SortUpdatedAt {
+			return query, fmt.Errorf("sort must be one of created_at, -created_at, updated_at, -updated_at")
+		}
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		query.Limit = n
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		if query.After, err = decodeTaskCursor(cursor); err != nil {
+			return query, err
+		}
+		if query.After.SortBy != query.SortBy {
+			return query, fmt.Errorf("cursor belongs to a listing sorted by %s", query.After.SortBy)
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,67 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type expressionPage struct {
+	Expressions []*Task `json:"expressions"`
+	NextCursor  string  `json:"next_cursor"`
+}
+
+func listExpressions(t *testing.T, server *Server, token, query string) (int, expressionPage) {
+	t.Helper()
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleGetExpressions), http.MethodGet, "/api/v1/expressions"+query, token, nil)
+	var page expressionPage
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	}
+	return w.Code, page
+}
+
+func TestListExpressionsWithCursor(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+	created := make(map[string]bool)
+	for _, expression := range []string{"1+2", "3+4", "5+6"} {
+		created[calculate(t, server, token, map[string]string{"expression": expression})] = true
+	}
+
+	code, first := listExpressions(t, server, token, "?limit=2&sort=created_at")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, first.Expressions, 2)
+	require.NotEmpty(t, first.NextCursor)
+
+	code, second := listExpressions(t, server, token, "?limit=2&sort=created_at&cursor="+first.NextCursor)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, second.Expressions, 1)
+	assert.Empty(t, second.NextCursor)
+
+	for _, task := range append(first.Expressions, second.Expressions...) {
+		assert.True(t, created[task.ID])
+		delete(created, task.ID)
+	}
+	assert.Empty(t, created)
+
+	code, _ = listExpressions(t, server, token, "?sort=-updated_at&cursor="+first.NextCursor)
+	assert.Equal(t, http.StatusBadRequest, code, "cursor of another sort order")
+}
+
+func TestListExpressionsRejectsInvalidQuery(t *testing.T) {
+	server, _, token := newStreamingServer(t)
+
+	for _, query := range []string{"?status=Unknown", "?limit=0", "?limit=1000", "?sort=expression", "?created_after=yesterday", "?cursor=not-a-cursor"} {
+		code, _ := listExpressions(t, server, token, query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+
+	code, page := listExpressions(t, server, token, "?status=Completed")
+	require.Equal(t, http.StatusOK, code)
+	assert.NotNil(t, page.Expressions)
+	assert.Empty(t, page.Expressions)
+}
@@ -0,0 +1,84 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TaskStore is implemented by every storage backend of the orchestrator.
+// Lookups of a missing task or operation return nil and a nil error.
+type TaskStore interface {
+	AddTaskWithOperations(task *Task, ops []*Operation) error
+	AddBatch(batch *Batch, items []BatchItem) error
+	GetBatch(id string, userLogin string) (*Batch, []*Task, error)
+	GetTaskByID(id string, userLogin string) (*Task, error)
+	GetUserTasks(ctx context.Context, userLogin string) ([]*Task, error)
+	GetTasksByStatus(userLogin string, status string) ([]*Task, error)
+	QueryTasks(ctx context.Context, query TaskQuery) ([]*Task, error)
+	UpdateTask(task *Task) error
+	DeleteTask(id string, userLogin string) error
+	CancelTask(id string, userLogin string) error
+	// CountActiveTasks counts the tasks of the user that are not finished yet.
+	CountActiveTasks(userLogin string) (int, error)
+	// GetDependentTasks returns the IDs of the tasks that refer to the
+	// result of taskID.
+	GetDependentTasks(taskID string) ([]string, error)
+
+	// Unscoped lookups for administrators.
+	GetTask(id string) (*Task, error)
+	ListTasksByStatus(status string) ([]*Task, error)
+	GetTaskOperations(taskID string) ([]*Operation, error)
+	RequeueTask(id string) error
+
+	GetOperation(id string) (*Operation, error)
+	ClaimOperation(owner string, lease time.Duration) (*Operation, error)
+	CompleteOperation(id string, owner string, result float64) error
+	FailOperation(id string, owner string, failure Failure) error
+	// ReleaseExpiredLeases and RequeueAgentOperations return the task ID of
+	// every operation they gave another attempt.
+	ReleaseExpiredLeases() ([]string, error)
+	RequeueAgentOperations(owner string) ([]string, error)
+	TakeCancelledOperations(owner string) ([]string, error)
+
+	Close() error
+}
+
+type Backend interface {
+	TaskStore
+	UserStorage
+	WebhookStore
+	IdempotencyStore
+	WorkspaceStore
+	AgentCredentialStore
+	SessionStore
+
+	SetRetryPolicy(policy RetryPolicy)
+}
+
+const (
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+	BackendFile   = "file"
+)
+
+func OpenBackend(config Config) (Backend, error) {
+	var backend Backend
+	var err error
+	switch config.StorageBackend {
+	case BackendSQLite, "":
+		backend, err = OpenSQLiteStorage(config.DatabasePath)
+	case BackendMemory:
+		backend = NewMemoryStore()
+	case BackendFile:
+		backend, err = OpenFileStore(config.StorageFile)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.StorageBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backend.SetRetryPolicy(config.RetryPolicy)
+	return backend, nil
+}
@@ -0,0 +1,89 @@
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postCredentials(t *testing.T, handler http.HandlerFunc, login, password string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{"login": login, "password": password})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return w
+}
+
+func TestUsersSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+
+	server := newServer(t, withDatabase(path))
+	w := postCredentials(t, server.handleRegister, "alice", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, server.Close())
+
+	server = newServer(t, withDatabase(path))
+
+	w = postCredentials(t, server.handleLogin, "alice", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.NotEmpty(t, result.Token)
+
+	w = postCredentials(t, server.handleLogin, "alice", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLoginIsCaseInsensitive(t *testing.T) {
+	server := newServer(t, withDatabase(filepath.Join(t.TempDir(), "tasks.db")))
+
+	w := postCredentials(t, server.handleRegister, "Alice", "secret")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = postCredentials(t, server.handleRegister, "alice", "other")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	err := server.userStorage.CreateUser(&User{Login: "ALICE", PasswordHash: "hash"})
+	assert.ErrorIs(t, err, ErrUserExists)
+
+	w = postCredentials(t, server.handleLogin, "ALICE", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	user, err := server.userStorage.GetUser("aLiCe")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", user.Login)
+}
+
+func TestLegacyUsersWithCaseDuplicatesAreRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+
+	db, err := openDatabase(path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			login TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		);
+		INSERT INTO users (login, password_hash, created_at) 
+		VALUES ('bob', 'x', '2025-01-01T00:00:00Z'), ('Bob', 'y', '2025-01-01T00:00:00Z');`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = OpenSQLiteStorage(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bob, Bob")
+}
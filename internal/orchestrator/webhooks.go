@@ -0,0 +1,426 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+const (
+	EventTaskCompleted  = "task.completed"
+	EventTaskFailed     = "task.failed"
+	EventTaskCancelled  = "task.cancelled"
+	EventTaskDeadLetter = "task.dead_letter"
+)
+
+const (
+	DeliveryPending   = "Pending"
+	DeliveryDelivered = "Delivered"
+	DeliveryFailed    = "Failed"
+)
+
+const webhookBatchSize = 32
+
+type Webhook struct {
+	ID        string `json:"id"`
+	UserLogin string `json:"user_login"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Delivery is one notification about a finished task to one URL. It is
+// created in the same write that finishes the task and retried until it
+// succeeds or runs out of attempts.
+type Delivery struct {
+	ID            string            `json:"id"`
+	TaskID        string            `json:"task_id"`
+	WebhookID     string            `json:"webhook_id,omitempty"`
+	UserLogin     string            `json:"user_login"`
+	URL           string            `json:"url"`
+	Event         string            `json:"event"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt string            `json:"next_attempt_at,omitempty"`
+	History       []DeliveryAttempt `json:"history,omitempty"`
+	CreatedAt     string            `json:"created_at"`
+	UpdatedAt     string            `json:"updated_at"`
+
+	// secret signs the payload. It is empty for callback_url deliveries,
+	// which are signed with the server-wide WEBHOOK_SECRET.
+	secret string
+}
+
+type DeliveryAttempt struct {
+	Attempt     int    `json:"attempt"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Error       string `json:"error,omitempty"`
+	AttemptedAt string `json:"attempted_at"`
+}
+
+// WebhookStore keeps webhook subscriptions and their deliveries. Deliveries
+// are queued by the TaskStore when a task reaches a final status.
+type WebhookStore interface {
+	CreateWebhook(hook *Webhook) error
+	GetUserWebhooks(userLogin string) ([]*Webhook, error)
+	DeleteWebhook(id string, userLogin string) error
+
+	DueDeliveries(now time.Time, limit int) ([]*Delivery, error)
+	RecordDeliveryAttempt(delivery *Delivery, attempt DeliveryAttempt) error
+	GetUserDeliveries(userLogin string, taskID string) ([]*Delivery, error)
+}
+
+func taskEvent(status string) string {
+	switch status {
+	case StatusCompleted:
+		return EventTaskCompleted
+	case StatusCancelled:
+		return EventTaskCancelled
+	case StatusDeadLetter:
+		return EventTaskDeadLetter
+	default:
+		return EventTaskFailed
+	}
+}
+
+// newDeliveries builds the deliveries for a task that has just finished: one
+// for its callback_url and one per webhook of its owner.
+func newDeliveries(task *Task, hooks []*Webhook, now string) []*Delivery {
+	var deliveries []*Delivery
+	if task.CallbackURL != "" {
+		deliveries = append(deliveries, &Delivery{URL: task.CallbackURL})
+	}
+	for _, hook := range hooks {
+		deliveries = append(deliveries, &Delivery{WebhookID: hook.ID, URL: hook.URL, secret: hook.Secret})
+	}
+
+	event := taskEvent(task.Status)
+	for _, d := range deliveries {
+		d.ID = uuid.New().String()
+		d.TaskID = task.ID
+		d.UserLogin = task.UserLogin
+		d.Event = event
+		d.Status = DeliveryPending
+		d.NextAttemptAt = now
+		d.CreatedAt = now
+		d.UpdatedAt = now
+	}
+	return deliveries
+}
+
+// validateWebhookURL rejects URLs whose host resolves to an address of the
+// orchestrator's own network, so users cannot make it send requests there.
+func (s *Server) validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if s.config.WebhookAllowPrivate {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve host %s: %v", u.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr.IP) {
+			return fmt.Errorf("host %s resolves to the non-public address %s", u.Hostname(), addr.IP)
+		}
+	}
+	return nil
+}
+
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// newWebhookClient checks the address again when connecting, because the
+// host may resolve to another address than it did when the URL was accepted.
+func newWebhookClient(config Config) *http.Client {
+	dialer := &net.Dialer{Timeout: config.WebhookTimeout}
+	if !config.WebhookAllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   config.WebhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, ForceAttemptHTTP2: true},
+	}
+}
+
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signPayload returns the value of the X-Signature-256 header.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) deliverWebhooks() {
+	ticker := time.NewTicker(s.config.WebhookInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.dispatchWebhooks()
+	}
+}
+
+// dispatchWebhooks sends every delivery that is due and records the outcome.
+func (s *Server) dispatchWebhooks() {
+	deliveries, err := s.webhooks.DueDeliveries(time.Now().UTC(), webhookBatchSize)
+	if err != nil {
+		log.Printf("Failed to load webhook deliveries: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *Delivery) {
+			defer wg.Done()
+			s.attemptDelivery(delivery)
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+func (s *Server) attemptDelivery(delivery *Delivery) {
+	now := time.Now().UTC()
+	delivery.Attempts++
+	attempt := DeliveryAttempt{
+		Attempt:     delivery.Attempts,
+		AttemptedAt: now.Format(time.RFC3339),
+	}
+
+	statusCode, err := s.sendDelivery(delivery)
+	attempt.StatusCode = statusCode
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.NextAttemptAt = ""
+	case delivery.Attempts >= s.config.WebhookMaxAttempts:
+		attempt.Error = err.Error()
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = ""
+		log.Printf("Webhook delivery %s to %s failed permanently: %v", delivery.ID, delivery.URL, err)
+	default:
+		attempt.Error = err.Error()
+		delivery.NextAttemptAt = now.Add(exponentialBackoff(s.config.WebhookRetryBase, delivery.Attempts)).Format(time.RFC3339)
+	}
+	delivery.UpdatedAt = attempt.AttemptedAt
+
+	if err := s.webhooks.RecordDeliveryAttempt(delivery, attempt); err != nil {
+		log.Printf("Failed to record webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+func (s *Server) sendDelivery(delivery *Delivery) (int, error) {
+	task, err := s.storage.GetTaskByID(delivery.TaskID, delivery.UserLogin)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load task: %v", err)
+	}
+	if task == nil {
+		return 0, errors.New("task no longer exists")
+	}
+
+	payload, err := json.Marshal(struct {
+		Event      string `json:"event"`
+		DeliveryID string `json:"delivery_id"`
+		Task       *Task  `json:"task"`
+	}{
+		Event:      delivery.Event,
+		DeliveryID: delivery.ID,
+		Task:       task,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+
+	secret := delivery.secret
+	if delivery.WebhookID == "" {
+		secret = s.config.WebhookSecret
+	}
+	if secret == "" {
+		return 0, errors.New("no secret to sign the delivery")
+	}
+	req.Header.Set("X-Signature-256", signPayload(secret, payload))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := s.webhooks.GetUserWebhooks(userLogin)
+		if err != nil {
+			log.Printf("Failed to list webhooks: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, hook := range hooks {
+			hook.Secret = ""
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*Webhook{"webhooks": hooks})
+	case http.MethodPost:
+		var req struct {
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.validateWebhookURL(req.URL); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid url: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Secret == "" {
+			if req.Secret, err = generateSecret(); err != nil {
+				http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		hook := &Webhook{
+			ID:        uuid.New().String(),
+			UserLogin: userLogin,
+			URL:       req.URL,
+			Secret:    req.Secret,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		if err := s.webhooks.CreateWebhook(hook); err != nil {
+			log.Printf("Failed to create webhook: %v", err)
+			http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/webhooks/")
+	if id == "deliveries" {
+		s.handleWebhookDeliveries(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = s.webhooks.DeleteWebhook(id, userLogin)
+	if err == ErrWebhookNotFound {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete webhook %s: %v", id, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	deliveries, err := s.webhooks.GetUserDeliveries(userLogin, r.URL.Query().Get("task_id"))
+	if err != nil {
+		log.Printf("Failed to list webhook deliveries: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]*Delivery{"deliveries": deliveries})
+}
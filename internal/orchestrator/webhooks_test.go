@@ -0,0 +1,230 @@
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	if rc.failures > 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newWebhookServer(t *testing.T, maxAttempts int) (*Server, string) {
+	t.Helper()
+
+	server := newServer(t, func(config *Config) {
+		config.WebhookSecret = "callback-secret"
+		config.WebhookAllowPrivate = true
+		config.WebhookMaxAttempts = maxAttempts
+		config.WebhookRetryBase = 0
+	})
+	return server, registerAndLogin(t, server, "alice")
+}
+
+func authorizedRequest(t *testing.T, handler http.HandlerFunc, method, target, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+
+	r := httptest.NewRequest(method, target, reader)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func calculate(t *testing.T, server *Server, token string, body map[string]string) string {
+	t.Helper()
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token, body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	return created.ID
+}
+
+func deliveries(t *testing.T, server *Server, token string) []*Delivery {
+	t.Helper()
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleWebhook), http.MethodGet, "/api/v1/webhooks/deliveries", token, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result struct {
+		Deliveries []*Delivery `json:"deliveries"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	return result.Deliveries
+}
+
+func TestWebhooksDeliverSignedPayloads(t *testing.T) {
+	server, token := newWebhookServer(t, 3)
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleWebhooks), http.MethodPost, "/api/v1/webhooks", token,
+		map[string]string{"url": ts.URL + "/hook"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var hook Webhook
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&hook))
+	require.NotEmpty(t, hook.Secret)
+
+	id := calculate(t, server, token, map[string]string{"expression": "1+2", "callback_url": ts.URL + "/callback"})
+	finishTask(t, server)
+	server.dispatchWebhooks()
+
+	require.Len(t, receiver.requests, 2)
+	secrets := map[string]string{"/hook": hook.Secret, "/callback": "callback-secret"}
+	for i, r := range receiver.requests {
+		assert.Equal(t, EventTaskCompleted, r.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, signPayload(secrets[r.URL.Path], receiver.bodies[i]), r.Header.Get("X-Signature-256"))
+
+		var payload struct {
+			Event string `json:"event"`
+			Task  Task   `json:"task"`
+		}
+		require.NoError(t, json.Unmarshal(receiver.bodies[i], &payload))
+		assert.Equal(t, id, payload.Task.ID)
+		assert.Equal(t, StatusCompleted, payload.Task.Status)
+		assert.Equal(t, float64(3), payload.Task.Result)
+	}
+
+	for _, d := range deliveries(t, server, token) {
+		assert.Equal(t, DeliveryDelivered, d.Status)
+		require.Len(t, d.History, 1)
+		assert.Equal(t, http.StatusNoContent, d.History[0].StatusCode)
+	}
+
+	server.dispatchWebhooks()
+	assert.Len(t, receiver.requests, 2)
+}
+
+func TestWebhooksRetryUntilDelivered(t *testing.T) {
+	server, token := newWebhookServer(t, 3)
+	receiver := &webhookReceiver{failures: 2}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	calculate(t, server, token, map[string]string{"expression": "1+2", "callback_url": ts.URL})
+	finishTask(t, server)
+
+	for i := 0; i < 3; i++ {
+		server.dispatchWebhooks()
+	}
+
+	got := deliveries(t, server, token)
+	require.Len(t, got, 1)
+	assert.Equal(t, DeliveryDelivered, got[0].Status)
+	assert.Equal(t, 3, got[0].Attempts)
+	require.Len(t, got[0].History, 3)
+	assert.Equal(t, http.StatusInternalServerError, got[0].History[0].StatusCode)
+	assert.NotEmpty(t, got[0].History[0].Error)
+	assert.Equal(t, http.StatusNoContent, got[0].History[2].StatusCode)
+}
+
+func TestWebhooksGiveUpAfterMaxAttempts(t *testing.T) {
+	server, token := newWebhookServer(t, 2)
+	receiver := &webhookReceiver{failures: 10}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	calculate(t, server, token, map[string]string{"expression": "1+2", "callback_url": ts.URL})
+	finishTask(t, server)
+
+	for i := 0; i < 4; i++ {
+		server.dispatchWebhooks()
+	}
+
+	got := deliveries(t, server, token)
+	require.Len(t, got, 1)
+	assert.Equal(t, DeliveryFailed, got[0].Status)
+	assert.Equal(t, 2, got[0].Attempts)
+	assert.Len(t, receiver.requests, 2)
+}
+
+func TestCalculateRejectsInvalidCallbackURL(t *testing.T) {
+	server, token := newWebhookServer(t, 3)
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token,
+		map[string]string{"expression": "1+2", "callback_url": "ftp://example.com"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	unsigned := newServer(t)
+	token = registerAndLogin(t, unsigned, "alice")
+	w = authorizedRequest(t, unsigned.authMiddleware(unsigned.handleCalculate), http.MethodPost, "/api/v1/calculate", token,
+		map[string]string{"expression": "1+2", "callback_url": "https://example.com/callback"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "WEBHOOK_SECRET")
+}
+
+func TestWebhooksCannotReachPrivateAddresses(t *testing.T) {
+	server := newServer(t, func(config *Config) { config.WebhookSecret = "callback-secret" })
+	token := registerAndLogin(t, server, "alice")
+
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+	} {
+		w := authorizedRequest(t, server.authMiddleware(server.handleWebhooks), http.MethodPost, "/api/v1/webhooks", token, map[string]string{"url": target})
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		w = authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token,
+			map[string]string{"expression": "1+2", "callback_url": target})
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+	}
+
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+	_, err := server.webhookClient.Post(ts.URL, "application/json", nil)
+	require.Error(t, err, "an accepted host that now resolves to loopback is refused when dialing")
+	assert.Contains(t, err.Error(), "not public")
+	assert.Empty(t, receiver.requests)
+}
+
+func TestBackoffDoubles(t *testing.T) {
+	assert.Equal(t, time.Second, exponentialBackoff(time.Second, 1))
+	assert.Equal(t, 2*time.Second, exponentialBackoff(time.Second, 2))
+	assert.Equal(t, 8*time.Second, exponentialBackoff(time.Second, 4))
+
+	policy := RetryPolicy{BackoffBase: time.Second, BackoffMax: 3 * time.Second}
+	assert.Equal(t, 3*time.Second, policy.Backoff(4))
+}
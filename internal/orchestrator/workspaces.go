@@ -0,0 +1,239 @@
+package orchestrator
+
+import (
+	"distributed-calculator/internal/expr"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	ErrWorkspaceExists   = errors.New("workspace already exists")
+	ErrVariableNotFound  = errors.New("variable not found")
+)
+
+const maxVariableNameLength = 64
+
+// Workspace is a named set of variables that a user's expressions can refer
+// to.
+type Workspace struct {
+	ID        string             `json:"id"`
+	UserLogin string             `json:"user_login"`
+	Name      string             `json:"name"`
+	Variables map[string]float64 `json:"variables"`
+	CreatedAt string             `json:"created_at"`
+}
+
+type WorkspaceStore interface {
+	CreateWorkspace(workspace *Workspace) error
+	GetUserWorkspaces(userLogin string) ([]*Workspace, error)
+	GetWorkspace(id string, userLogin string) (*Workspace, error)
+	DeleteWorkspace(id string, userLogin string) error
+	SetVariable(workspaceID string, userLogin string, name string, value float64) error
+	DeleteVariable(workspaceID string, userLogin string, name string) error
+}
+
+func validateVariableName(name string) error {
+	if len(name) > maxVariableNameLength {
+		return fmt.Errorf("variable name is longer than %d characters", maxVariableNameLength)
+	}
+	if !expr.IsIdentifier(name) {
+		return fmt.Errorf("variable name %q must start with a letter or '_' and contain only letters, digits and '_'", name)
+	}
+	return nil
+}
+
+// workspaceVariables returns the variables of the workspace expressions are
+// submitted to, or nil when no workspace was given.
+func (s *Server) workspaceVariables(workspaceID string, userLogin string) (map[string]float64, error) {
+	if workspaceID == "" {
+		return nil, nil
+	}
+	workspace, err := s.workspaces.GetWorkspace(workspaceID, userLogin)
+	if err != nil {
+		return nil, err
+	}
+	if workspace == nil {
+		return nil, ErrWorkspaceNotFound
+	}
+	return workspace.Variables, nil
+}
+
+func (s *Server) handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		workspaces, err := s.workspaces.GetUserWorkspaces(userLogin)
+		if err != nil {
+			log.Printf("Failed to get workspaces: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if workspaces == nil {
+			workspaces = []*Workspace{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]*Workspace{"workspaces": workspaces})
+	case http.MethodPost:
+		s.createWorkspace(w, r, userLogin)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) createWorkspace(w http.ResponseWriter, r *http.Request, userLogin string) {
+	var req struct {
+		Name      string             `json:"name"`
+		Variables map[string]float64 `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Workspace name is required", http.StatusBadRequest)
+		return
+	}
+	for name := range req.Variables {
+		if err := validateVariableName(name); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid variable: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Variables == nil {
+		req.Variables = map[string]float64{}
+	}
+
+	workspace := &Workspace{
+		ID:        uuid.New().String(),
+		UserLogin: userLogin,
+		Name:      req.Name,
+		Variables: req.Variables,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	err := s.workspaces.CreateWorkspace(workspace)
+	if err == ErrWorkspaceExists {
+		http.Error(w, "Workspace with this name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create workspace: %v", err)
+		http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(workspace)
+}
+
+// handleWorkspace serves /api/v1/workspaces/{id} and
+// /api/v1/workspaces/{id}/variables/{name}.
+func (s *Server) handleWorkspace(w http.ResponseWriter, r *http.Request) {
+	userLogin, err := s.getUserFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/workspaces/")
+	if id, name, ok := strings.Cut(path, "/variables/"); ok {
+		s.handleVariable(w, r, userLogin, id, name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		workspace, err := s.workspaces.GetWorkspace(path, userLogin)
+		if err != nil {
+			log.Printf("Failed to get workspace %s: %v", path, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if workspace == nil {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(workspace)
+	case http.MethodDelete:
+		err := s.workspaces.DeleteWorkspace(path, userLogin)
+		if err == ErrWorkspaceNotFound {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete workspace %s: %v", path, err)
+			http.Error(w, "Failed to delete workspace", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleVariable(w http.ResponseWriter, r *http.Request, userLogin, workspaceID, name string) {
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		if err := validateVariableName(name); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid variable: %v", err), http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Value *float64 `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Value == nil {
+			http.Error(w, "Variable value is required", http.StatusBadRequest)
+			return
+		}
+		err = s.workspaces.SetVariable(workspaceID, userLogin, name, *req.Value)
+	case http.MethodDelete:
+		err = s.workspaces.DeleteVariable(workspaceID, userLogin, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch err {
+	case nil:
+	case ErrWorkspaceNotFound:
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return
+	case ErrVariableNotFound:
+		http.Error(w, "Variable not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Failed to update variable %s of workspace %s: %v", name, workspaceID, err)
+		http.Error(w, "Failed to update variable", http.StatusInternalServerError)
+		return
+	}
+
+	workspace, err := s.workspaces.GetWorkspace(workspaceID, userLogin)
+	if err != nil || workspace == nil {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workspace)
+}
@@ -0,0 +1,73 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateWithWorkspaceSnapshotsVariables(t *testing.T) {
+	server, token := newWebhookServer(t, 1)
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleWorkspaces), http.MethodPost, "/api/v1/workspaces", token, map[string]interface{}{
+		"name":      "finance",
+		"variables": map[string]float64{"rate": 0.13},
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var workspace Workspace
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&workspace))
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleWorkspaces), http.MethodPost, "/api/v1/workspaces", token, map[string]string{"name": "finance"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	id := calculate(t, server, token, map[string]string{"expression": "rate*100", "workspace_id": workspace.ID})
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleWorkspace), http.MethodPut, "/api/v1/workspaces/"+workspace.ID+"/variables/rate", token, map[string]float64{"value": 0.2})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	task, err := server.storage.GetTaskByID(id, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, workspace.ID, task.WorkspaceID)
+	assert.Equal(t, map[string]float64{"rate": 0.13}, task.Variables)
+
+	ops, err := server.storage.GetTaskOperations(id)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	assert.Equal(t, 0.13, ops[0].Operand1)
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": "rate*limit", "workspace_id": workspace.ID})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `unknown variable "limit"`)
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleCalculate), http.MethodPost, "/api/v1/calculate", token, map[string]string{"expression": "rate*2", "workspace_id": "missing"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Workspace not found")
+}
+
+func TestWorkspaceVariableValidation(t *testing.T) {
+	server, token := newWebhookServer(t, 1)
+
+	w := authorizedRequest(t, server.authMiddleware(server.handleWorkspaces), http.MethodPost, "/api/v1/workspaces", token, map[string]interface{}{
+		"name":      "bad",
+		"variables": map[string]float64{"1rate": 1},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleWorkspaces), http.MethodPost, "/api/v1/workspaces", token, map[string]string{"name": "ok"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var workspace Workspace
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&workspace))
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleWorkspace), http.MethodPut, "/api/v1/workspaces/"+workspace.ID+"/variables/rate", token, map[string]string{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	bob := registerAndLogin(t, server, "bob")
+	w = authorizedRequest(t, server.authMiddleware(server.handleWorkspace), http.MethodGet, "/api/v1/workspaces/"+workspace.ID, bob, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = authorizedRequest(t, server.authMiddleware(server.handleWorkspace), http.MethodDelete, "/api/v1/workspaces/"+workspace.ID, token, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}